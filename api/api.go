@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
@@ -11,21 +12,45 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/messagebird"
 )
 
+// maxBatchSize is the maximum number of messages accepted in a single batch.
+const maxBatchSize = 1000
+
 type handler struct {
 	http.Handler
 	handlerOnce sync.Once // Guards initialization of Handler.
 
-	svc service
+	svc        service
+	signingKey string
 }
 
 type service interface {
-	SendMessage(ctx context.Context, m *birdbroker.Message) error
+	CancelMessage(ctx context.Context, id string) (*birdbroker.Record, error)
+	GetMessage(ctx context.Context, id string) (*birdbroker.Record, error)
+	SendMessage(ctx context.Context, m *birdbroker.Message) (*birdbroker.Record, error)
+	SendMessageIdempotent(ctx context.Context, key string, m *birdbroker.Message) (*birdbroker.Record, error)
+	SendMessages(ctx context.Context, ms []*birdbroker.Message) []birdbroker.BatchResult
+	UpdateDeliveryStatus(ctx context.Context, dr *birdbroker.DeliveryReport) error
+}
+
+// Option configures a handler created by NewHandler.
+type Option func(h *handler)
+
+// WithSigningKey enables the MessageBird status report webhook, which only
+// accepts requests signed with MessageBird signing key key.
+func WithSigningKey(key string) Option {
+	return func(h *handler) {
+		h.signingKey = key
+	}
 }
 
-func NewHandler(s service) *handler {
+func NewHandler(s service, opts ...Option) *handler {
 	h := &handler{svc: s}
+	for _, opt := range opts {
+		opt(h)
+	}
 	return h.withRoutes()
 }
 
@@ -34,6 +59,12 @@ func (h *handler) withRoutes() *handler {
 		r := mux.NewRouter()
 		r.Use(h.logMiddleware)
 		r.HandleFunc("/messages", h.sendMessage).Methods(http.MethodPost)
+		r.HandleFunc("/messages/batch", h.sendMessages).Methods(http.MethodPost)
+		r.HandleFunc("/messages/{id}", h.getMessage).Methods(http.MethodGet)
+		r.HandleFunc("/messages/{id}", h.cancelMessage).Methods(http.MethodDelete)
+		if h.signingKey != "" {
+			r.HandleFunc("/webhooks/messagebird/status", h.messageBirdStatus).Methods(http.MethodGet, http.MethodPost)
+		}
 		h.Handler = r
 	})
 	return h
@@ -52,6 +83,31 @@ func (h *handler) error(w http.ResponseWriter, err error) {
 		Error string `json:"error"`
 	}
 
+	if errors.Is(err, birdbroker.ErrNotFound) {
+		h.response(w, http.StatusNotFound, res{
+			Error: http.StatusText(http.StatusNotFound),
+		})
+		return
+	}
+	if errors.Is(err, birdbroker.ErrConflict) {
+		h.response(w, http.StatusConflict, res{
+			Error: http.StatusText(http.StatusConflict),
+		})
+		return
+	}
+	if errors.Is(err, birdbroker.ErrKeyReused) {
+		h.response(w, http.StatusUnprocessableEntity, res{
+			Error: "Idempotency-Key was used for a different request",
+		})
+		return
+	}
+	if errors.Is(err, messagebird.ErrInvalidSignature) {
+		h.response(w, http.StatusUnauthorized, res{
+			Error: http.StatusText(http.StatusUnauthorized),
+		})
+		return
+	}
+
 	var ce birdbroker.ClientError
 	if !errors.As(err, &ce) {
 		h.response(w, http.StatusInternalServerError, res{
@@ -79,6 +135,72 @@ func (h *handler) response(w http.ResponseWriter, code int, v interface{}) {
 	}
 }
 
+func (h *handler) getMessage(w http.ResponseWriter, r *http.Request) {
+	rec, err := h.svc.GetMessage(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		if !errors.Is(err, birdbroker.ErrNotFound) {
+			log.Printf("%T: GetMessage: %s", h.svc, err)
+		}
+		h.error(w, err)
+		return
+	}
+
+	h.response(w, http.StatusOK, rec)
+}
+
+// cancelMessage calls back a message that was not handed to MessageBird yet.
+func (h *handler) cancelMessage(w http.ResponseWriter, r *http.Request) {
+	rec, err := h.svc.CancelMessage(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		if !errors.Is(err, birdbroker.ErrNotFound) && !errors.Is(err, birdbroker.ErrConflict) {
+			log.Printf("%T: CancelMessage: %s", h.svc, err)
+		}
+		h.error(w, err)
+		return
+	}
+
+	h.response(w, http.StatusOK, rec)
+}
+
+// messageBirdStatus receives status reports from MessageBird. Reports about
+// unknown messages are acknowledged anyway, as MessageBird would otherwise
+// keep retrying them.
+func (h *handler) messageBirdStatus(w http.ResponseWriter, r *http.Request) {
+	if err := messagebird.VerifySignature(r, h.signingKey); err != nil {
+		log.Printf("messagebird: VerifySignature: %s", err)
+		h.error(w, err)
+		return
+	}
+
+	sr, err := messagebird.ParseStatusReport(r)
+	if err != nil {
+		log.Printf("messagebird: ParseStatusReport: %s", err)
+		h.error(w, birdbroker.ClientError{
+			Reason: "Invalid status report",
+		})
+		return
+	}
+
+	err = h.svc.UpdateDeliveryStatus(r.Context(), &birdbroker.DeliveryReport{
+		MessageID:     sr.Reference,
+		MessageBirdID: sr.ID,
+		Recipient:     sr.Recipient,
+		Status:        sr.Status,
+		Reason:        sr.StatusReason,
+		At:            sr.StatusDatetime,
+	})
+	if err != nil && !errors.Is(err, birdbroker.ErrNotFound) {
+		log.Printf("%T: UpdateDeliveryStatus: %s", h.svc, err)
+		h.error(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Ignoring status report for unknown message %q (%s)", sr.Reference, sr.ID)
+	}
+
+	h.response(w, http.StatusOK, nil)
+}
+
 func (h *handler) sendMessage(w http.ResponseWriter, r *http.Request) {
 	var m birdbroker.Message
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
@@ -88,11 +210,53 @@ func (h *handler) sendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.svc.SendMessage(context.Background(), &m); err != nil {
+	// Retried requests with the same Idempotency-Key header get the
+	// original message back, instead of sending it again.
+	var rec *birdbroker.Record
+	var err error
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		rec, err = h.svc.SendMessageIdempotent(context.Background(), key, &m)
+	} else {
+		rec, err = h.svc.SendMessage(context.Background(), &m)
+	}
+	if err != nil {
 		log.Printf("%T: SendMessage: %s", h.svc, err)
 		h.error(w, err)
 		return
 	}
 
-	h.response(w, http.StatusCreated, nil)
+	w.Header().Set("Location", "/messages/"+rec.ID)
+	h.response(w, http.StatusCreated, rec)
+}
+
+func (h *handler) sendMessages(w http.ResponseWriter, r *http.Request) {
+	var ms []*birdbroker.Message
+	if err := json.NewDecoder(r.Body).Decode(&ms); err != nil {
+		h.error(w, birdbroker.ClientError{
+			Reason: "Cannot decode request body",
+		})
+		return
+	}
+	if len(ms) == 0 || len(ms) > maxBatchSize {
+		h.error(w, birdbroker.ClientError{
+			Reason: fmt.Sprintf("Batch must hold 1-%d messages", maxBatchSize),
+		})
+		return
+	}
+	for _, m := range ms {
+		if m == nil {
+			h.error(w, birdbroker.ClientError{
+				Reason: "Batch must not hold null messages",
+			})
+			return
+		}
+	}
+
+	res := h.svc.SendMessages(context.Background(), ms)
+
+	h.response(w, http.StatusOK, struct {
+		Results []birdbroker.BatchResult `json:"results"`
+	}{
+		Results: res,
+	})
 }
@@ -1,11 +1,18 @@
 package api
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/epels/birdbroker-go"
 	"github.com/epels/birdbroker-go/internal/mock"
@@ -28,6 +35,20 @@ func TestError(t *testing.T) {
 		}
 	})
 
+	t.Run("Not found", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+
+		var h handler
+		h.error(rec, fmt.Errorf("lookup: %w", birdbroker.ErrNotFound))
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Got %d, expected 404", rec.Code)
+		}
+		if b := rec.Body.String(); b != `{"error":"Not Found"}` {
+			t.Errorf(`Got %q, expected {"error":"Not Found"}`, b)
+		}
+	})
+
 	t.Run("Internal error", func(t *testing.T) {
 		rec := httptest.NewRecorder()
 
@@ -82,7 +103,7 @@ func TestSendMessage(t *testing.T) {
 		var called bool
 		h := &handler{
 			svc: &mock.Service{
-				SendMessageFunc: func(m *birdbroker.Message) error {
+				SendMessageFunc: func(m *birdbroker.Message) (*birdbroker.Record, error) {
 					called = true
 
 					if m.Body != "Hello!" {
@@ -95,7 +116,10 @@ func TestSendMessage(t *testing.T) {
 						t.Errorf("Got %q, expected 31612345678", m.Recipient)
 					}
 
-					return nil
+					return &birdbroker.Record{
+						ID:     "abc123",
+						Status: birdbroker.StatusQueued,
+					}, nil
 				},
 			},
 		}
@@ -113,18 +137,98 @@ func TestSendMessage(t *testing.T) {
 		if rec.Code != http.StatusCreated {
 			t.Errorf("Got %d, expected 201", rec.Code)
 		}
+		if loc := rec.Header().Get("Location"); loc != "/messages/abc123" {
+			t.Errorf("Got %q, expected /messages/abc123", loc)
+		}
+		var res birdbroker.Record
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatalf("encoding/json: Decoder.Decode: %s", err)
+		}
+		if res.ID != "abc123" {
+			t.Errorf("Got %q, expected abc123", res.ID)
+		}
+		if res.Status != birdbroker.StatusQueued {
+			t.Errorf("Got %q, expected queued", res.Status)
+		}
 		if !called {
 			t.Errorf("Got false, expected true")
 		}
 	})
 
+	t.Run("Idempotency key", func(t *testing.T) {
+		var called bool
+		h := &handler{
+			svc: &mock.Service{
+				SendMessageIdempotentFunc: func(key string, m *birdbroker.Message) (*birdbroker.Record, error) {
+					called = true
+
+					if key != "retry-1" {
+						t.Errorf("Got %q, expected retry-1", key)
+					}
+					return &birdbroker.Record{
+						ID:     "abc123",
+						Status: birdbroker.StatusSent,
+					}, nil
+				},
+			},
+		}
+		h.withRoutes()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/messages", strings.NewReader("{}"))
+		req.Header.Set("Idempotency-Key", "retry-1")
+
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Errorf("Got %d, expected 201", rec.Code)
+		}
+		if loc := rec.Header().Get("Location"); loc != "/messages/abc123" {
+			t.Errorf("Got %q, expected /messages/abc123", loc)
+		}
+		if !called {
+			t.Errorf("Got false, expected true")
+		}
+	})
+
+	t.Run("Idempotency key: conflicts", func(t *testing.T) {
+		tt := []struct {
+			name string
+			err  error
+			code int
+		}{
+			{"Reused", birdbroker.ErrKeyReused, http.StatusUnprocessableEntity},
+			{"In progress", birdbroker.ErrConflict, http.StatusConflict},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				h := &handler{
+					svc: &mock.Service{
+						SendMessageIdempotentFunc: func(key string, m *birdbroker.Message) (*birdbroker.Record, error) {
+							return nil, fmt.Errorf("wrapped: %w", tc.err)
+						},
+					},
+				}
+				h.withRoutes()
+
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, "/messages", strings.NewReader("{}"))
+				req.Header.Set("Idempotency-Key", "retry-1")
+
+				h.ServeHTTP(rec, req)
+				if rec.Code != tc.code {
+					t.Errorf("Got %d, expected %d", rec.Code, tc.code)
+				}
+			})
+		}
+	})
+
 	t.Run("Bad request", func(t *testing.T) {
 		var called bool
 		h := &handler{
 			svc: &mock.Service{
-				SendMessageFunc: func(m *birdbroker.Message) error {
+				SendMessageFunc: func(m *birdbroker.Message) (*birdbroker.Record, error) {
 					called = true
-					return birdbroker.ClientError{Reason: "oops"}
+					return nil, birdbroker.ClientError{Reason: "oops"}
 				},
 			},
 		}
@@ -150,9 +254,9 @@ func TestSendMessage(t *testing.T) {
 		var called bool
 		h := &handler{
 			svc: &mock.Service{
-				SendMessageFunc: func(m *birdbroker.Message) error {
+				SendMessageFunc: func(m *birdbroker.Message) (*birdbroker.Record, error) {
 					called = true
-					return errors.New("oops")
+					return nil, errors.New("oops")
 				},
 			},
 		}
@@ -174,3 +278,252 @@ func TestSendMessage(t *testing.T) {
 		}
 	})
 }
+
+func TestGetMessage(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		h := &handler{
+			svc: &mock.Service{
+				GetMessageFunc: func(id string) (*birdbroker.Record, error) {
+					if id != "abc123" {
+						t.Errorf("Got %q, expected abc123", id)
+					}
+					return &birdbroker.Record{
+						ID:            "abc123",
+						Status:        birdbroker.StatusSent,
+						MessageBirdID: "mb-1",
+					}, nil
+				},
+			},
+		}
+		h.withRoutes()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/messages/abc123", nil)
+
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Got %d, expected 200", rec.Code)
+		}
+		var res birdbroker.Record
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatalf("encoding/json: Decoder.Decode: %s", err)
+		}
+		if res.Status != birdbroker.StatusSent {
+			t.Errorf("Got %q, expected sent", res.Status)
+		}
+		if res.MessageBirdID != "mb-1" {
+			t.Errorf("Got %q, expected mb-1", res.MessageBirdID)
+		}
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		h := &handler{
+			svc: &mock.Service{
+				GetMessageFunc: func(id string) (*birdbroker.Record, error) {
+					return nil, birdbroker.ErrNotFound
+				},
+			},
+		}
+		h.withRoutes()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/messages/nope", nil)
+
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Got %d, expected 404", rec.Code)
+		}
+	})
+}
+
+func TestCancelMessage(t *testing.T) {
+	tt := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"OK", nil, http.StatusOK},
+		{"Not found", birdbroker.ErrNotFound, http.StatusNotFound},
+		{"Already sent", birdbroker.ErrConflict, http.StatusConflict},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &handler{
+				svc: &mock.Service{
+					CancelMessageFunc: func(id string) (*birdbroker.Record, error) {
+						if id != "abc123" {
+							t.Errorf("Got %q, expected abc123", id)
+						}
+						if tc.err != nil {
+							return nil, fmt.Errorf("wrapped: %w", tc.err)
+						}
+						return &birdbroker.Record{
+							ID:     "abc123",
+							Status: birdbroker.StatusCancelled,
+						}, nil
+					},
+				},
+			}
+			h.withRoutes()
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodDelete, "/messages/abc123", nil)
+
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.code {
+				t.Errorf("Got %d, expected %d", rec.Code, tc.code)
+			}
+		})
+	}
+}
+
+// signRequest signs r like MessageBird does, using signing key key.
+func signRequest(r *http.Request, key string, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	bh := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s", ts, r.URL.Query().Encode(), bh[:])
+
+	r.Header.Set("MessageBird-Request-Timestamp", ts)
+	r.Header.Set("MessageBird-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func TestMessageBirdStatus(t *testing.T) {
+	const target = "/webhooks/messagebird/status?id=mb-1&reference=abc123&recipient=31612345678&status=delivered&statusDatetime=2019-10-01T12:00:00%2B00:00"
+
+	t.Run("OK", func(t *testing.T) {
+		var called bool
+		h := NewHandler(&mock.Service{
+			UpdateDeliveryStatusFunc: func(dr *birdbroker.DeliveryReport) error {
+				called = true
+
+				if dr.MessageID != "abc123" {
+					t.Errorf("Got %q, expected abc123", dr.MessageID)
+				}
+				if dr.MessageBirdID != "mb-1" {
+					t.Errorf("Got %q, expected mb-1", dr.MessageBirdID)
+				}
+				if dr.Recipient != "31612345678" {
+					t.Errorf("Got %q, expected 31612345678", dr.Recipient)
+				}
+				if dr.Status != "delivered" {
+					t.Errorf("Got %q, expected delivered", dr.Status)
+				}
+				return nil
+			},
+		}, WithSigningKey("secret"))
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		signRequest(req, "secret", nil)
+
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Got %d, expected 200", rec.Code)
+		}
+		if !called {
+			t.Errorf("Got false, expected true")
+		}
+	})
+
+	t.Run("Invalid signature", func(t *testing.T) {
+		h := NewHandler(&mock.Service{
+			UpdateDeliveryStatusFunc: func(dr *birdbroker.DeliveryReport) error {
+				t.Fatalf("Must never be called")
+				return nil
+			},
+		}, WithSigningKey("secret"))
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		signRequest(req, "wrong", nil)
+
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Got %d, expected 401", rec.Code)
+		}
+	})
+
+	t.Run("Unknown message", func(t *testing.T) {
+		h := NewHandler(&mock.Service{
+			UpdateDeliveryStatusFunc: func(dr *birdbroker.DeliveryReport) error {
+				return birdbroker.ErrNotFound
+			},
+		}, WithSigningKey("secret"))
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		signRequest(req, "secret", nil)
+
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Got %d, expected 200", rec.Code)
+		}
+	})
+
+	t.Run("Disabled without signing key", func(t *testing.T) {
+		h := NewHandler(&mock.Service{})
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		signRequest(req, "", nil)
+
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Got %d, expected 404", rec.Code)
+		}
+	})
+}
+
+func TestSendMessages(t *testing.T) {
+	t.Run("Partial success", func(t *testing.T) {
+		h := NewHandler(&mock.Service{
+			SendMessagesFunc: func(ms []*birdbroker.Message) []birdbroker.BatchResult {
+				if len(ms) != 2 {
+					t.Fatalf("Got %d, expected 2", len(ms))
+				}
+				if ms[1].Recipient != "31687654321" {
+					t.Errorf("Got %q, expected 31687654321", ms[1].Recipient)
+				}
+				return []birdbroker.BatchResult{
+					{ID: "abc", Status: birdbroker.StatusQueued},
+					{Error: "Missing body"},
+				}
+			},
+		})
+
+		rec := httptest.NewRecorder()
+		rr := strings.NewReader(`[
+	{"body": "Hello", "originator": "Foo", "recipient": "31612345678"},
+	{"originator": "Foo", "recipient": "31687654321"}
+]`)
+		req := httptest.NewRequest(http.MethodPost, "/messages/batch", rr)
+
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Got %d, expected 200", rec.Code)
+		}
+		const expected = `{"results":[{"id":"abc","status":"queued"},{"error":"Missing body"}]}`
+		if b := rec.Body.String(); b != expected {
+			t.Errorf("Got %q, expected %q", b, expected)
+		}
+	})
+
+	t.Run("Empty batch", func(t *testing.T) {
+		h := NewHandler(&mock.Service{
+			SendMessagesFunc: func(ms []*birdbroker.Message) []birdbroker.BatchResult {
+				t.Fatalf("Must never be called")
+				return nil
+			},
+		})
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/messages/batch", strings.NewReader("[]"))
+
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Got %d, expected 400", rec.Code)
+		}
+	})
+}
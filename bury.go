@@ -0,0 +1,32 @@
+package birdbroker
+
+import "time"
+
+// BuryReason classifies why a job was buried.
+type BuryReason string
+
+const (
+	// BuryDecodeError is set for jobs with a body that could not be decoded.
+	BuryDecodeError BuryReason = "decode_error"
+	// BuryPermanentError is set for jobs that failed in a way retrying can't
+	// fix, such as a message MessageBird rejected.
+	BuryPermanentError BuryReason = "permanent_error"
+	// BuryMaxAttempts is set for jobs that kept failing until they ran out
+	// of attempts.
+	BuryMaxAttempts BuryReason = "max_attempts"
+	// BuryNoStats is set for failed jobs that could not be retried, as their
+	// statistics, and so where to put them back, could not be retrieved.
+	BuryNoStats BuryReason = "no_stats"
+)
+
+// BuryRecord tells why a job was buried.
+type BuryRecord struct {
+	JobID uint64 `json:"job_id"`
+	Tube  string `json:"tube,omitempty"`
+	// MessageID identifies the message the job held, if it is known.
+	MessageID string     `json:"message_id,omitempty"`
+	Reason    BuryReason `json:"reason"`
+	// Error is the text of the last error the job failed with.
+	Error    string    `json:"error"`
+	BuriedAt time.Time `json:"buried_at"`
+}
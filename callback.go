@@ -0,0 +1,18 @@
+package birdbroker
+
+import "time"
+
+// Event describes a status transition of a message.
+type Event struct {
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id"`
+	Status    Status    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Callback is an event that is to be delivered to URL.
+type Callback struct {
+	URL   string `json:"url"`
+	Event Event  `json:"event"`
+}
@@ -0,0 +1,190 @@
+package callback
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/epels/birdbroker-go"
+)
+
+type client struct {
+	secret     string
+	allowed    []*net.IPNet
+	httpClient *http.Client
+}
+
+// ErrForbiddenAddress is returned when a callback URL resolves to an address
+// callbacks are not delivered to, such as a loopback or private address.
+// Callback URLs are chosen by callers, who must not be able to reach internal
+// services this way.
+var ErrForbiddenAddress = errors.New("forbidden callback address")
+
+// forbiddenNetworks holds the networks callbacks are not delivered to, unless
+// allowed through WithAllowedNetworks.
+var forbiddenNetworks = mustParseNetworks(
+	"0.0.0.0/8",          // "This" network.
+	"10.0.0.0/8",         // Private.
+	"100.64.0.0/10",      // Carrier-grade NAT.
+	"127.0.0.0/8",        // Loopback.
+	"169.254.0.0/16",     // Link-local, including cloud metadata services.
+	"172.16.0.0/12",      // Private.
+	"192.168.0.0/16",     // Private.
+	"198.18.0.0/15",      // Benchmarking.
+	"224.0.0.0/4",        // Multicast.
+	"240.0.0.0/4",        // Reserved.
+	"255.255.255.255/32", // Broadcast.
+	"::/128",             // Unspecified.
+	"::1/128",            // Loopback.
+	"fc00::/7",           // Unique local.
+	"fe80::/10",          // Link-local.
+	"ff00::/8",           // Multicast.
+)
+
+// ClientOption configures a client created by NewClient.
+type ClientOption func(c *client)
+
+// WithAllowedNetworks allows delivering callbacks to addresses in nets, even
+// if these are loopback, link-local or private addresses.
+func WithAllowedNetworks(nets ...*net.IPNet) ClientOption {
+	return func(c *client) {
+		c.allowed = append(c.allowed, nets...)
+	}
+}
+
+// NewClient creates a client that delivers callbacks signed with secret. It
+// refuses to connect to loopback, link-local and private addresses, unless
+// allowed through WithAllowedNetworks.
+func NewClient(secret string, opts ...ClientOption) *client {
+	c := &client{secret: secret}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// Check the address that is actually dialed, so names resolving to a
+	// forbidden address, and redirects to one, are refused as well.
+	d := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: c.control,
+	}
+	c.httpClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         d.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	return c
+}
+
+// control refuses connections to forbidden addresses.
+func (c *client) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("net: SplitHostPort: %s", err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	if containsIP(c.allowed, ip) || !containsIP(forbiddenNetworks, ip) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+}
+
+// ParseNetworks parses a comma-separated list of networks in CIDR notation,
+// like "10.1.0.0/16,192.168.1.0/24".
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("net: ParseCIDR: %s", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	nets, err := ParseNetworks(strings.Join(cidrs, ","))
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusError is returned when a callback URL responds with a status code
+// other than 2xx.
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code (%d) from callback URL %s", e.StatusCode, e.URL)
+}
+
+// Temporary reports whether delivering the same callback again may succeed.
+func (e *StatusError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// Deliver posts the event of cb to its URL as JSON, signed with the secret of
+// c.
+func (c *client) Deliver(ctx context.Context, cb *birdbroker.Callback) error {
+	b, err := json.Marshal(cb.Event)
+	if err != nil {
+		return fmt.Errorf("encoding/json: Marshal: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cb.URL, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("net/http: NewRequestWithContext: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(c.secret, time.Now(), b))
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("net/http: Client.Do: %w", err)
+	}
+	defer func() {
+		// Just close the body: relying on status code.
+		if err := res.Body.Close(); err != nil {
+			log.Printf("%T: Close: %s", res.Body, err)
+		}
+	}()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &StatusError{URL: cb.URL, StatusCode: res.StatusCode}
+	}
+	return nil
+}
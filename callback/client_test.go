@@ -0,0 +1,152 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/epels/birdbroker-go"
+)
+
+// loopback is allowed, so callbacks can be delivered to test servers.
+var loopback = mustParseNetworks("127.0.0.0/8")[0]
+
+func TestDeliver(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		var called bool
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatalf("io/ioutil: ReadAll: %s", err)
+			}
+			if err := Verify("secret", r.Header.Get(SignatureHeader), b, time.Minute); err != nil {
+				t.Errorf("Verify: %s", err)
+			}
+
+			var e birdbroker.Event
+			if err := json.Unmarshal(b, &e); err != nil {
+				t.Fatalf("encoding/json: Unmarshal: %s", err)
+			}
+			if e.MessageID != "abc" {
+				t.Errorf("Got %q, expected abc", e.MessageID)
+			}
+			if e.Status != birdbroker.StatusDelivered {
+				t.Errorf("Got %q, expected delivered", e.Status)
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer ts.Close()
+
+		c := NewClient("secret", WithAllowedNetworks(loopback))
+		err := c.Deliver(context.Background(), &birdbroker.Callback{
+			URL: ts.URL,
+			Event: birdbroker.Event{
+				MessageID: "abc",
+				Status:    birdbroker.StatusDelivered,
+			},
+		})
+		if err != nil {
+			t.Errorf("Deliver: %s", err)
+		}
+		if !called {
+			t.Errorf("Got false, expected true")
+		}
+	})
+
+	t.Run("Bad response", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusGone)
+		}))
+		defer ts.Close()
+
+		c := NewClient("secret", WithAllowedNetworks(loopback))
+		err := c.Deliver(context.Background(), &birdbroker.Callback{URL: ts.URL})
+
+		var se *StatusError
+		if !errors.As(err, &se) {
+			t.Fatalf("Got %T, expected *StatusError", err)
+		}
+		if se.Temporary() {
+			t.Errorf("Got true, expected false")
+		}
+	})
+	t.Run("Forbidden addresses", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Must never be called")
+		}))
+		defer ts.Close()
+
+		_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("net: SplitHostPort: %s", err)
+		}
+
+		c := NewClient("secret", WithAllowedNetworks(mustParseNetworks("10.0.0.0/8")...))
+		for _, u := range []string{
+			ts.URL,
+			"http://localhost:" + port,
+			"http://169.254.169.254/latest/meta-data/",
+			"http://192.168.1.1/",
+			"http://[::1]:80/",
+			"http://[::ffff:172.16.0.1]/",
+		} {
+			err := c.Deliver(context.Background(), &birdbroker.Callback{URL: u})
+			if !errors.Is(err, ErrForbiddenAddress) {
+				t.Errorf("Got %v, expected ErrForbiddenAddress for %s", err, u)
+			}
+		}
+	})
+}
+
+func TestControl(t *testing.T) {
+	c := NewClient("secret", WithAllowedNetworks(mustParseNetworks("10.1.0.0/16")...))
+	tt := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"10.1.2.3:80", true},
+		{"10.2.0.1:80", false},
+		{"127.0.0.1:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"198.18.0.1:80", false},
+		{"224.0.0.1:80", false},
+		{"240.0.0.1:80", false},
+		{"255.255.255.255:80", false},
+		{"[ff02::1]:80", false},
+	}
+	for _, tc := range tt {
+		err := c.control("tcp", tc.address, nil)
+		if allowed := err == nil; allowed != tc.allowed {
+			t.Errorf("Got %v, expected allowed to be %t for %s", err, tc.allowed, tc.address)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"abc"}`)
+
+	if err := Verify("secret", Sign("secret", time.Now(), body), body, time.Minute); err != nil {
+		t.Errorf("Verify: %s", err)
+	}
+	if err := Verify("other", Sign("secret", time.Now(), body), body, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Got %v, expected ErrInvalidSignature", err)
+	}
+	if err := Verify("secret", Sign("secret", time.Now().Add(-time.Hour), body), body, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Got %v, expected ErrInvalidSignature", err)
+	}
+	if err := Verify("secret", "garbage", body, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Got %v, expected ErrInvalidSignature", err)
+	}
+}
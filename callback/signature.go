@@ -0,0 +1,64 @@
+package callback
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader is the header that holds the signature of a callback.
+const SignatureHeader = "Birdbroker-Signature"
+
+// ErrInvalidSignature is returned by Verify for signatures that do not match.
+var ErrInvalidSignature = errors.New("invalid callback signature")
+
+// Sign returns the signature header value for a callback with body body, sent
+// at t. It has the form "t=<unix timestamp>,v1=<hex HMAC-SHA256>", where the
+// HMAC is calculated over the timestamp, a dot and the body.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac(secret, ts, body)))
+}
+
+// Verify checks the signature header value sig of a callback with body body.
+// Receivers should use it to reject callbacks that were not sent by
+// birdbroker, or that were sent longer than maxAge ago.
+func Verify(secret, sig string, body []byte, maxAge time.Duration) error {
+	var ts, v1 string
+	for _, part := range strings.Split(sig, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			v1 = kv[1]
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if time.Since(time.Unix(unix, 0)) > maxAge {
+		return ErrInvalidSignature
+	}
+	got, err := hex.DecodeString(v1)
+	if err != nil || !hmac.Equal(got, mac(secret, ts, body)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func mac(secret, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%s.%s", ts, body)
+	return h.Sum(nil)
+}
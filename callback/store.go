@@ -0,0 +1,97 @@
+package callback
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/epels/birdbroker-go"
+)
+
+type recordStore interface {
+	Create(ctx context.Context, r *birdbroker.Record) error
+	Get(ctx context.Context, id string) (*birdbroker.Record, error)
+	Update(ctx context.Context, id string, fn func(r *birdbroker.Record) error) error
+}
+
+type sender interface {
+	SendCallback(ctx context.Context, cb *birdbroker.Callback) error
+}
+
+type notifyingStore struct {
+	recordStore
+
+	snd        sender
+	defaultURL string
+}
+
+// NewStore wraps st, so that a callback is queued on snd for every status
+// transition of a record. Records without a callback URL of their own are
+// reported to defaultURL, unless it is empty.
+func NewStore(st recordStore, snd sender, defaultURL string) *notifyingStore {
+	return &notifyingStore{
+		recordStore: st,
+		snd:         snd,
+		defaultURL:  defaultURL,
+	}
+}
+
+func (s *notifyingStore) Create(ctx context.Context, r *birdbroker.Record) error {
+	if err := s.recordStore.Create(ctx, r); err != nil {
+		return err
+	}
+	s.notify(ctx, r)
+	return nil
+}
+
+func (s *notifyingStore) Update(ctx context.Context, id string, fn func(r *birdbroker.Record) error) error {
+	var before birdbroker.Status
+	var after birdbroker.Record
+	err := s.recordStore.Update(ctx, id, func(r *birdbroker.Record) error {
+		before = r.Status
+		if err := fn(r); err != nil {
+			return err
+		}
+		after = *r
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if after.Status != before {
+		s.notify(ctx, &after)
+	}
+	return nil
+}
+
+// notify queues a callback for the current status of r. Failing to do so is
+// logged, but does not fail the status transition itself.
+func (s *notifyingStore) notify(ctx context.Context, r *birdbroker.Record) {
+	u := r.CallbackURL
+	if u == "" {
+		u = s.defaultURL
+	}
+	if u == "" {
+		return
+	}
+
+	id, err := birdbroker.NewID()
+	if err != nil {
+		log.Printf("birdbroker: NewID: %s", err)
+		return
+	}
+	err = s.snd.SendCallback(ctx, &birdbroker.Callback{
+		URL: u,
+		Event: birdbroker.Event{
+			ID:        id,
+			MessageID: r.ID,
+			Status:    r.Status,
+			Error:     r.Error,
+			Timestamp: time.Now(),
+		},
+	})
+	if err != nil {
+		log.Printf("%T: SendCallback: %s", s.snd, err)
+	}
+}
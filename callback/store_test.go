@@ -0,0 +1,104 @@
+package callback
+
+import (
+	"context"
+	"testing"
+
+	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/internal/mock"
+)
+
+func TestStore(t *testing.T) {
+	newStore := func(r *birdbroker.Record, sent *[]birdbroker.Callback, defaultURL string) *notifyingStore {
+		return NewStore(&mock.Store{
+			CreateFunc: func(cr *birdbroker.Record) error {
+				*r = *cr
+				return nil
+			},
+			UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+				return fn(r)
+			},
+		}, &mock.CallbackSender{
+			SendCallbackFunc: func(cb *birdbroker.Callback) error {
+				*sent = append(*sent, *cb)
+				return nil
+			},
+		}, defaultURL)
+	}
+
+	t.Run("Notifies of transitions", func(t *testing.T) {
+		var r birdbroker.Record
+		var sent []birdbroker.Callback
+		s := newStore(&r, &sent, "")
+
+		ctx := context.Background()
+		err := s.Create(ctx, &birdbroker.Record{
+			ID:          "abc",
+			Status:      birdbroker.StatusAccepted,
+			CallbackURL: "https://example.com/hook",
+		})
+		if err != nil {
+			t.Fatalf("Create: %s", err)
+		}
+		err = s.Update(ctx, "abc", func(r *birdbroker.Record) error {
+			r.Status = birdbroker.StatusSent
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Update: %s", err)
+		}
+		// Not a transition: must not be reported.
+		err = s.Update(ctx, "abc", func(r *birdbroker.Record) error {
+			r.MessageBirdID = "mb-1"
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Update: %s", err)
+		}
+
+		if len(sent) != 2 {
+			t.Fatalf("Got %d, expected 2", len(sent))
+		}
+		if sent[0].Event.Status != birdbroker.StatusAccepted {
+			t.Errorf("Got %q, expected accepted", sent[0].Event.Status)
+		}
+		if sent[1].Event.Status != birdbroker.StatusSent {
+			t.Errorf("Got %q, expected sent", sent[1].Event.Status)
+		}
+		if sent[1].URL != "https://example.com/hook" {
+			t.Errorf("Got %q, expected https://example.com/hook", sent[1].URL)
+		}
+		if sent[0].Event.ID == sent[1].Event.ID {
+			t.Errorf("Got duplicate event ID %q", sent[0].Event.ID)
+		}
+	})
+
+	t.Run("Default URL", func(t *testing.T) {
+		var r birdbroker.Record
+		var sent []birdbroker.Callback
+		s := newStore(&r, &sent, "https://example.com/default")
+
+		if err := s.Create(context.Background(), &birdbroker.Record{ID: "abc"}); err != nil {
+			t.Fatalf("Create: %s", err)
+		}
+		if len(sent) != 1 {
+			t.Fatalf("Got %d, expected 1", len(sent))
+		}
+		if sent[0].URL != "https://example.com/default" {
+			t.Errorf("Got %q, expected https://example.com/default", sent[0].URL)
+		}
+	})
+
+	t.Run("Without URL", func(t *testing.T) {
+		var r birdbroker.Record
+		var sent []birdbroker.Callback
+		s := newStore(&r, &sent, "")
+
+		if err := s.Create(context.Background(), &birdbroker.Record{ID: "abc"}); err != nil {
+			t.Fatalf("Create: %s", err)
+		}
+		if len(sent) != 0 {
+			t.Errorf("Got %d, expected 0", len(sent))
+		}
+	})
+}
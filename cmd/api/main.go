@@ -6,31 +6,63 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
-	"github.com/beanstalkd/go-beanstalk"
-
 	"github.com/epels/birdbroker-go/api"
+	"github.com/epels/birdbroker-go/callback"
 	"github.com/epels/birdbroker-go/queue"
 	"github.com/epels/birdbroker-go/service"
+	"github.com/epels/birdbroker-go/store"
 )
 
+// callbackTube is the tube callbacks are queued on.
+const callbackTube = "birdbroker-callbacks"
+
 func main() {
-	bsAddr := mustGetenv("BEANSTALK_ADDR")
-	conn, err := beanstalk.DialTimeout("tcp", bsAddr, 10*time.Second)
+	conn, cbConn, withTubes, closeQueue := openQueue()
+	defer closeQueue()
+
+	ds, err := store.NewDir(mustGetenv("STORE_DIR"))
 	if err != nil {
-		log.Fatalf("beanstalk: DialTimeout: %s", err)
+		log.Fatalf("store: NewDir: %s", err)
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Printf("beanstalk: Conn.Close: %s", err)
-		}
-	}()
+	cbSnd := queue.NewCallbackSender(cbConn)
+	st := callback.NewStore(ds, cbSnd, os.Getenv("CALLBACK_URL"))
 
-	mq := queue.NewSender(conn)
-	svc := service.New(mq)
-	a := api.NewHandler(svc)
+	// Messages are put in the default tube, unless TUBE_ROUTING selects a
+	// tube per priority class or originator. Workers must then be told to
+	// consume these tubes through TUBES.
+	var sndOpts []queue.SenderOption
+	prefix := os.Getenv("TUBE_PREFIX")
+	if prefix == "" {
+		prefix = "birdbroker"
+	}
+	switch routing := os.Getenv("TUBE_ROUTING"); routing {
+	case "":
+	case "priority":
+		sndOpts = append(sndOpts, withTubes(queue.ByPriority(prefix)))
+	case "originator":
+		sndOpts = append(sndOpts, withTubes(queue.ByOriginator(prefix)))
+	default:
+		log.Fatalf("Invalid tube routing %q", routing)
+	}
+	mq := queue.NewSender(conn, sndOpts...)
+	svcOpts := []service.Option{service.WithKeyStore(ds)}
+	if v := os.Getenv("IDEMPOTENCY_KEY_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid duration environment variable %q: %s", "IDEMPOTENCY_KEY_RETENTION", err)
+		}
+		svcOpts = append(svcOpts, service.WithKeyRetention(d))
+	}
+	svc := service.New(mq, st, svcOpts...)
+	var opts []api.Option
+	if key := os.Getenv("MESSAGEBIRD_SIGNING_KEY"); key != "" {
+		opts = append(opts, api.WithSigningKey(key))
+	}
+	a := api.NewHandler(svc, opts...)
 
 	httpAddr := mustGetenv("HTTP_ADDR")
 	s := http.Server{
@@ -64,6 +96,54 @@ func main() {
 	}
 }
 
+// queueConn puts jobs on the queue, and deletes the jobs of cancelled
+// messages.
+type queueConn interface {
+	producer
+	Delete(id uint64) error
+}
+
+type producer interface {
+	Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error)
+}
+
+// openQueue opens the log file at QUEUE_LOG as the queue if it is set, so no
+// beanstalkd is needed when the workers run on the same host, or connects to
+// the beanstalkd at BEANSTALK_ADDR otherwise. It returns the connection to
+// put messages on, the one to put callbacks on, a function routing messages
+// to tubes, and a function closing the queue.
+func openQueue() (queueConn, producer, func(f queue.TubeFunc) queue.SenderOption, func()) {
+	if path := os.Getenv("QUEUE_LOG"); path != "" {
+		q, err := queue.OpenLog(path)
+		if err != nil {
+			log.Fatalf("queue: OpenLog: %s", err)
+		}
+		withTubes := func(f queue.TubeFunc) queue.SenderOption {
+			return queue.WithTubes(q, f)
+		}
+		return q, q.Tube(callbackTube), withTubes, func() {
+			if err := q.Close(); err != nil {
+				log.Printf("queue: Log.Close: %s", err)
+			}
+		}
+	}
+
+	// HTTP handlers put jobs concurrently, so they share a pool of
+	// connections rather than queueing up behind a single one.
+	p, err := queue.DialPool(mustGetenv("BEANSTALK_ADDR"), queue.WithPoolSize(getenvInt("BEANSTALK_POOL_SIZE", 4)))
+	if err != nil {
+		log.Fatalf("queue: DialPool: %s", err)
+	}
+	withTubes := func(f queue.TubeFunc) queue.SenderOption {
+		return queue.WithTubes(p, f)
+	}
+	return p, p.Tube(callbackTube), withTubes, func() {
+		if err := p.Close(); err != nil {
+			log.Printf("queue: Pool.Close: %s", err)
+		}
+	}
+}
+
 func mustGetenv(key string) string {
 	val := os.Getenv(key)
 	if val == "" {
@@ -71,3 +151,15 @@ func mustGetenv(key string) string {
 	}
 	return val
 }
+
+func getenvInt(key string, def int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		log.Fatalf("Invalid integer environment variable %q: %s", key, err)
+	}
+	return n
+}
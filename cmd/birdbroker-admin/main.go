@@ -0,0 +1,310 @@
+// Command birdbroker-admin inspects the jobs the workers buried, and kicks
+// them back to the ready queue or deletes them.
+//
+// Usage:
+//
+//	birdbroker-admin [flags] list [-limit n]
+//	birdbroker-admin [flags] show (next | id...)
+//	birdbroker-admin [flags] kick (-all | id...)
+//	birdbroker-admin [flags] delete id...
+//
+// The queue is the log file at QUEUE_LOG, unless -log is given, or else the
+// beanstalkd at BEANSTALK_ADDR, unless -addr is given. Why jobs were buried is
+// looked up in the store the workers use, which is taken from STORE_DIR,
+// unless -store is given.
+//
+// Beanstalkd can't list buried jobs, so list goes by the bury records in the
+// store, and requires one. Jobs buried without a record are not listed, but
+// can still be shown and kicked with show next and kick -all.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go/queue"
+	"github.com/epels/birdbroker-go/store"
+)
+
+const usage = `Usage: birdbroker-admin [flags] command [args]
+
+Commands:
+  list [-limit n]     list the buried jobs in the tube, newest first
+  show (next | id...) show buried jobs, or the one that is kicked next
+  kick (-all | id...) kick buried jobs back to the ready queue
+  delete id...        delete buried jobs
+
+Flags:
+`
+
+func main() {
+	log.SetFlags(0)
+
+	addr := flag.String("addr", os.Getenv("BEANSTALK_ADDR"), "beanstalkd address")
+	logPath := flag.String("log", os.Getenv("QUEUE_LOG"), "log file of the queue, used instead of beanstalkd")
+	tube := flag.String("tube", "default", "tube to inspect")
+	dir := flag.String("store", os.Getenv("STORE_DIR"), "directory of the store holding bury records")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	conn, closeConn := openQueue(*logPath, *addr)
+	defer closeConn()
+	var opts []queue.AdminOption
+	if *dir != "" {
+		ds, err := store.NewDir(*dir)
+		if err != nil {
+			log.Fatalf("store: NewDir: %s", err)
+		}
+		opts = append(opts, queue.WithBuryRecords(ds))
+	}
+	a := queue.NewAdmin(conn, opts...)
+
+	var err error
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "list":
+		err = list(a, *tube, args)
+	case "show":
+		err = show(a, *tube, args)
+	case "kick":
+		err = kick(a, *tube, args)
+	case "delete":
+		err = del(a, args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s: %s", cmd, err)
+	}
+}
+
+func list(a admin, tube string, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	limit := fs.Int("limit", 100, "maximum number of jobs to list, or 0 for all")
+	fs.Parse(args)
+
+	jobs, err := a.Buried(tube, *limit)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		fmt.Printf("No buried jobs in tube %q\n", tube)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tAGE\tBURIES\tRELEASES\tMESSAGE ID\tREASON")
+	for _, j := range jobs {
+		reason := "-"
+		if j.Bury != nil {
+			reason = string(j.Bury.Reason)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t%s\n", j.ID, j.Age(), j.Buries(), j.Releases(), messageID(j), reason)
+	}
+	return tw.Flush()
+}
+
+func show(a admin, tube string, args []string) error {
+	if len(args) == 1 && args[0] == "next" {
+		j, err := a.Next(tube)
+		if err != nil {
+			return err
+		}
+		if j == nil {
+			fmt.Printf("No buried jobs in tube %q\n", tube)
+			return nil
+		}
+		printJob(os.Stdout, j)
+		return nil
+	}
+
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		j, err := a.Job(id)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		printJob(os.Stdout, j)
+	}
+	return nil
+}
+
+func kick(a admin, tube string, args []string) error {
+	fs := flag.NewFlagSet("kick", flag.ExitOnError)
+	all := fs.Bool("all", false, "kick all buried jobs in the tube")
+	fs.Parse(args)
+
+	if *all {
+		n, err := a.KickAll(tube)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Kicked %d jobs in tube %q\n", n, tube)
+		return nil
+	}
+	ids, err := parseIDs(fs.Args())
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := a.Kick(id); err != nil {
+			return err
+		}
+		fmt.Printf("Kicked job %d\n", id)
+	}
+	return nil
+}
+
+func del(a admin, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := a.Delete(id); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted job %d\n", id)
+	}
+	return nil
+}
+
+type admin interface {
+	Buried(tube string, limit int) ([]*queue.BuriedJob, error)
+	Delete(id uint64) error
+	Job(id uint64) (*queue.BuriedJob, error)
+	Kick(id uint64) error
+	KickAll(tube string) (int, error)
+	Next(tube string) (*queue.BuriedJob, error)
+}
+
+type adminConn interface {
+	Delete(id uint64) error
+	KickJob(id uint64) error
+	Peek(id uint64) ([]byte, error)
+	PeekBuried(tube string) (uint64, []byte, error)
+	StatsJob(id uint64) (map[string]string, error)
+	StatsTube(tube string) (map[string]string, error)
+}
+
+// openQueue opens the log file at logPath as the queue if it is set, or
+// connects to the beanstalkd at addr otherwise. It returns the connection to
+// administer the queue through, and a function closing it.
+func openQueue(logPath, addr string) (adminConn, func()) {
+	if logPath != "" {
+		q, err := queue.OpenLog(logPath)
+		if err != nil {
+			log.Fatalf("queue: OpenLog: %s", err)
+		}
+		return q, func() { q.Close() }
+	}
+
+	if addr == "" {
+		log.Fatal("Missing queue: set QUEUE_LOG or -log, or BEANSTALK_ADDR or -addr")
+	}
+	conn, err := beanstalk.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		log.Fatalf("beanstalk: DialTimeout: %s", err)
+	}
+	return queue.NewBeanstalkAdminConn(conn), func() { conn.Close() }
+}
+
+// printJob writes why j was buried, its stats and its decoded envelope to w.
+func printJob(w io.Writer, j *queue.BuriedJob) {
+	fmt.Fprintf(w, "Job %d in tube %q\n", j.ID, j.Tube)
+	if j.Bury != nil {
+		fmt.Fprintf(w, "\nBuried at %s (%s):\n  %s\n", j.Bury.BuriedAt.Format(time.RFC3339), j.Bury.Reason, j.Bury.Error)
+	}
+
+	keys := make([]string, 0, len(j.Stats))
+	for k := range j.Stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nStats:")
+	for _, k := range keys {
+		fmt.Fprintf(tw, "  %s\t%s\n", k, j.Stats[k])
+	}
+
+	if j.Envelope == nil {
+		fmt.Fprintf(tw, "\nBody (%s):\n%s\n", j.DecodeErr, j.Body)
+		tw.Flush()
+		return
+	}
+	fmt.Fprintf(tw, "\nEnvelope version:\t%d\n", j.Envelope.Version)
+	keys = keys[:0]
+	for k := range j.Envelope.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(tw, "\nHeaders:")
+	for _, k := range keys {
+		fmt.Fprintf(tw, "  %s\t%s\n", k, j.Envelope.Headers[k])
+	}
+	tw.Flush()
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, j.Envelope.Payload, "", "  "); err != nil {
+		buf.Reset()
+		buf.Write(j.Envelope.Payload)
+	}
+	fmt.Fprintf(w, "\nPayload:\n%s\n", buf.Bytes())
+}
+
+func messageID(j *queue.BuriedJob) string {
+	if j.Bury != nil && j.Bury.MessageID != "" {
+		return j.Bury.MessageID
+	}
+	if j.Envelope == nil {
+		return "-"
+	}
+	if id := j.Envelope.Headers[queue.HeaderMessageID]; id != "" {
+		return id
+	}
+	var m struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(j.Envelope.Payload, &m); err != nil || m.ID == "" {
+		return "-"
+	}
+	return m.ID
+}
+
+func parseIDs(args []string) ([]uint64, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no job IDs given")
+	}
+	ids := make([]uint64, len(args))
+	for i, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job ID %q", arg)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
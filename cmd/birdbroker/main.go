@@ -0,0 +1,157 @@
+// Command birdbroker runs birdbroker.
+//
+// Usage:
+//
+//	birdbroker dev [-http addr]
+//
+// The dev command runs the API and the worker in a single process, on a
+// queue and a store that are kept in memory, so no beanstalkd is needed.
+// Everything queued is lost when it exits. Messages are sent with the access
+// key in MESSAGEBIRD_ACCESS_KEY, and to the MessageBird API at
+// MESSAGEBIRD_BASE_URL if set. Callbacks are signed with CALLBACK_SECRET,
+// which is required like in production, so clients verify them the same way
+// in development. They are only delivered to loopback, link-local and private
+// addresses in the networks listed in CALLBACK_ALLOWED_NETWORKS (e.g.
+// "127.0.0.0/8").
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/epels/birdbroker-go/api"
+	"github.com/epels/birdbroker-go/callback"
+	"github.com/epels/birdbroker-go/messagebird"
+	"github.com/epels/birdbroker-go/queue"
+	"github.com/epels/birdbroker-go/service"
+	"github.com/epels/birdbroker-go/store"
+	"github.com/epels/birdbroker-go/worker"
+)
+
+const usage = `Usage: birdbroker command [flags]
+
+Commands:
+  dev   run the API and the worker in one process, on an in-memory queue
+`
+
+// callbackTube is the tube callbacks are queued on.
+const callbackTube = "birdbroker-callbacks"
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "dev":
+		dev(args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func dev(args []string) {
+	fs := flag.NewFlagSet("dev", flag.ExitOnError)
+	httpAddr := fs.String("http", getenv("HTTP_ADDR", "localhost:8080"), "address to serve the API on")
+	fs.Parse(args)
+
+	q := queue.NewMemory()
+	ms := store.NewMemory()
+	cbSnd := queue.NewCallbackSender(q.Tube(callbackTube))
+	st := callback.NewStore(ms, cbSnd, os.Getenv("CALLBACK_URL"))
+
+	svc := service.New(queue.NewSender(q), st, service.WithKeyStore(ms))
+	var apiOpts []api.Option
+	if key := os.Getenv("MESSAGEBIRD_SIGNING_KEY"); key != "" {
+		apiOpts = append(apiOpts, api.WithSigningKey(key))
+	}
+	s := http.Server{
+		Addr:         *httpAddr,
+		Handler:      api.NewHandler(svc, apiOpts...),
+		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+
+	var mbOpts []messagebird.Option
+	if u := os.Getenv("MESSAGEBIRD_BASE_URL"); u != "" {
+		mbOpts = append(mbOpts, messagebird.WithBaseURL(u))
+	}
+	if u := os.Getenv("MESSAGEBIRD_REPORT_URL"); u != "" {
+		mbOpts = append(mbOpts, messagebird.WithReportURL(u))
+	}
+	h := worker.NewHandler(messagebird.NewClient(mustGetenv("MESSAGEBIRD_ACCESS_KEY"), mbOpts...), st)
+	c := queue.NewConsumer(q.Conn(), h, queue.WithBuryStore(ms))
+	allowed, err := callback.ParseNetworks(os.Getenv("CALLBACK_ALLOWED_NETWORKS"))
+	if err != nil {
+		log.Fatalf("Invalid CALLBACK_ALLOWED_NETWORKS: %s", err)
+	}
+	cbh := worker.NewCallbackHandler(callback.NewClient(mustGetenv("CALLBACK_SECRET"), callback.WithAllowedNetworks(allowed...)))
+	cbc := queue.NewCallbackConsumer(q.Conn(callbackTube), cbh, queue.WithBuryStore(ms))
+
+	errCh := make(chan error, 3)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		log.Printf("Starting HTTP server on %q", *httpAddr)
+		errCh <- s.ListenAndServe()
+	}()
+	go func() {
+		log.Printf("Starting job handler")
+		errCh <- c.ListenAndServe()
+	}()
+	go func() {
+		log.Printf("Starting callback handler")
+		errCh <- cbc.ListenAndServe()
+	}()
+
+	select {
+	case err = <-errCh:
+		log.Printf("Exiting with error: %s", err)
+	case sig := <-sigCh:
+		log.Printf("Exiting with signal: %s", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Stop accepting messages before draining the jobs in flight.
+	if err = s.Shutdown(ctx); err != nil {
+		log.Printf("net/http: Server.Shutdown: %s", err)
+	}
+	if err = c.Shutdown(ctx); err != nil {
+		log.Printf("queue: Consumer.Shutdown: %s", err)
+	}
+	if err = cbc.Shutdown(ctx); err != nil {
+		log.Fatalf("queue: Consumer.Shutdown: %s", err)
+	}
+}
+
+func getenv(key, def string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return def
+}
+
+func mustGetenv(key string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		log.Fatalf("Missing mandatory environment variable %q", key)
+	}
+	return val
+}
@@ -2,61 +2,82 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/beanstalkd/go-beanstalk"
-
-	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/callback"
 	"github.com/epels/birdbroker-go/messagebird"
 	"github.com/epels/birdbroker-go/queue"
+	"github.com/epels/birdbroker-go/store"
+	"github.com/epels/birdbroker-go/worker"
 )
 
-type handler struct {
-	snd sender
-}
+// callbackTube is the tube callbacks are queued on.
+const callbackTube = "birdbroker-callbacks"
 
-type sender interface {
-	SendMessage(ctx context.Context, m *birdbroker.Message) error
-}
+func main() {
+	// Every tube is consumed on a connection of its own, so a worker pool
+	// can be dedicated to a traffic class by running it with TUBES set to
+	// the tubes of that class only.
+	tubes := parseTubes(os.Getenv("TUBES"))
+	conns, cbConn, cbProducer, closeQueue := openQueue(tubes)
+	defer closeQueue()
 
-func (c *handler) ServeJob(ctx context.Context, m *birdbroker.Message) error {
-	if err := c.snd.SendMessage(ctx, m); err != nil {
-		return fmt.Errorf("%T: SendMessage: %s", c.snd, err)
+	ds, err := store.NewDir(mustGetenv("STORE_DIR"))
+	if err != nil {
+		log.Fatalf("store: NewDir: %s", err)
 	}
-	return nil
-}
+	cbSnd := queue.NewCallbackSender(cbProducer)
+	st := callback.NewStore(ds, cbSnd, os.Getenv("CALLBACK_URL"))
 
-func main() {
 	ak := mustGetenv("MESSAGEBIRD_ACCESS_KEY")
-	h := handler{
-		snd: messagebird.NewClient(ak),
+	var opts []messagebird.Option
+	if u := os.Getenv("MESSAGEBIRD_BASE_URL"); u != "" {
+		opts = append(opts, messagebird.WithBaseURL(u))
 	}
+	if u := os.Getenv("MESSAGEBIRD_REPORT_URL"); u != "" {
+		opts = append(opts, messagebird.WithReportURL(u))
+	}
+	h := worker.NewHandler(messagebird.NewClient(ak, opts...), st)
+	c := queue.NewConsumer(consumerConn(tubes, conns), h,
+		queue.WithConcurrency(getenvInt("CONCURRENCY", 10)), queue.WithBuryStore(ds))
 
-	bsAddr := mustGetenv("BEANSTALK_ADDR")
-	conn, err := beanstalk.DialTimeout("tcp", bsAddr, 10*time.Second)
+	allowed, err := callback.ParseNetworks(os.Getenv("CALLBACK_ALLOWED_NETWORKS"))
 	if err != nil {
-		log.Fatalf("beanstalk: DialTimeout: %s", err)
+		log.Fatalf("Invalid CALLBACK_ALLOWED_NETWORKS: %s", err)
+	}
+	cbh := worker.NewCallbackHandler(callback.NewClient(mustGetenv("CALLBACK_SECRET"), callback.WithAllowedNetworks(allowed...)))
+	cbc := queue.NewCallbackConsumer(cbConn, cbh,
+		queue.WithConcurrency(getenvInt("CALLBACK_CONCURRENCY", 10)), queue.WithBuryStore(ds))
+
+	if addr := os.Getenv("STATUS_ADDR"); addr != "" {
+		go func() {
+			log.Printf("Starting status server on %q", addr)
+			if err := http.ListenAndServe(addr, statusHandler(c)); err != nil {
+				log.Printf("net/http: ListenAndServe: %s", err)
+			}
+		}()
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Printf("beanstalk: Conn.Close: %s", err)
-		}
-	}()
-	c := queue.NewConsumer(conn, &h)
 
-	errCh := make(chan error, 1)
+	errCh := make(chan error, 2)
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		log.Printf("Starting Beanstalk job handler")
+		log.Printf("Starting job handler")
 		errCh <- c.ListenAndServe()
 	}()
+	go func() {
+		log.Printf("Starting callback handler")
+		errCh <- cbc.ListenAndServe()
+	}()
 
 	select {
 	case err = <-errCh:
@@ -69,10 +90,179 @@ func main() {
 	defer cancel()
 
 	if err = c.Shutdown(ctx); err != nil {
+		log.Printf("queue: Consumer.Shutdown: %s", err)
+	}
+	if err = cbc.Shutdown(ctx); err != nil {
 		log.Fatalf("queue: Consumer.Shutdown: %s", err)
 	}
 }
 
+type producer interface {
+	Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error)
+}
+
+// openQueue opens the log file at QUEUE_LOG as the queue if it is set, so no
+// beanstalkd is needed when the API runs on the same host, or connects to
+// the beanstalkd at BEANSTALK_ADDR otherwise. It returns a connection per
+// tube, the connection to consume callbacks on and the one to put them on,
+// and a function closing the queue.
+func openQueue(tubes []tube) ([]reserver, reserver, producer, func()) {
+	conns := make([]reserver, len(tubes))
+	if path := os.Getenv("QUEUE_LOG"); path != "" {
+		q, err := queue.OpenLog(path)
+		if err != nil {
+			log.Fatalf("queue: OpenLog: %s", err)
+		}
+		for i, tube := range tubes {
+			conns[i] = q.Conn(tube.name)
+		}
+		return conns, q.Conn(callbackTube), q.Tube(callbackTube), func() {
+			if err := q.Close(); err != nil {
+				log.Printf("queue: Log.Close: %s", err)
+			}
+		}
+	}
+
+	bsAddr := mustGetenv("BEANSTALK_ADDR")
+	var closers []conn
+	for i, tube := range tubes {
+		conn := mustDial(bsAddr, queue.WithWatch(tube.name))
+		closers = append(closers, conn)
+		conns[i] = conn
+	}
+	// Callbacks are consumed on a connection of their own, as Reserve blocks
+	// the connection it is called on.
+	cbConn := mustDial(bsAddr, queue.WithUse(callbackTube), queue.WithWatch(callbackTube))
+	closers = append(closers, cbConn)
+	return conns, cbConn, cbConn, func() {
+		for _, c := range closers {
+			closeConn(c)
+		}
+	}
+}
+
+// conn is a connection to beanstalkd that reconnects when it breaks.
+type conn interface {
+	reserver
+	producer
+	Close() error
+}
+
+func mustDial(addr string, opts ...queue.ConnOption) conn {
+	conn, err := queue.Dial(addr, opts...)
+	if err != nil {
+		log.Fatalf("queue: Dial: %s", err)
+	}
+	return conn
+}
+
+func closeConn(c conn) {
+	if err := c.Close(); err != nil {
+		log.Printf("queue: Conn.Close: %s", err)
+	}
+}
+
+type pool interface {
+	Concurrency() int
+	InFlight() int
+	Utilization() float64
+}
+
+// statusHandler reports the utilization of the worker pool p.
+func statusHandler(p pool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(struct {
+			Concurrency int     `json:"concurrency"`
+			InFlight    int     `json:"in_flight"`
+			Utilization float64 `json:"utilization"`
+		}{
+			Concurrency: p.Concurrency(),
+			InFlight:    p.InFlight(),
+			Utilization: p.Utilization(),
+		})
+		if err != nil {
+			log.Printf("encoding/json: Marshal: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err = w.Write(b); err != nil {
+			log.Printf("%T: Write: %s", w, err)
+		}
+	})
+}
+
+type tube struct {
+	name   string
+	weight int
+}
+
+// parseTubes parses a list of tubes to consume, like "otp:10,bulk:1". The
+// weight of a tube is optional, and defaults to 1. If s is empty, only the
+// default tube is consumed.
+func parseTubes(s string) []tube {
+	if s == "" {
+		return []tube{{name: "default", weight: 1}}
+	}
+
+	var tubes []tube
+	for _, f := range strings.Split(s, ",") {
+		t := tube{name: f, weight: 1}
+		if i := strings.LastIndex(f, ":"); i != -1 {
+			w, err := strconv.Atoi(f[i+1:])
+			if err != nil {
+				log.Fatalf("Invalid weight for tube %q: %s", f, err)
+			}
+			t.name, t.weight = f[:i], w
+		}
+		tubes = append(tubes, t)
+	}
+	return tubes
+}
+
+type reserver interface {
+	Bury(id uint64, pri uint32) error
+	Delete(id uint64) error
+	Release(id uint64, pri uint32, delay time.Duration) error
+	Reserve(timeout time.Duration) (id uint64, body []byte, err error)
+	StatsJob(id uint64) (map[string]string, error)
+}
+
+// consumerConn combines the connections to tubes according to the strategy
+// set by TUBE_STRATEGY: "weighted" (the default) or "strict", in which case
+// tubes are consumed in the order they are listed.
+func consumerConn(tubes []tube, conns []reserver) reserver {
+	if len(conns) == 1 {
+		return conns[0]
+	}
+
+	wcs := make([]queue.WeightedConn, len(conns))
+	for i, conn := range conns {
+		wcs[i] = queue.WeightedConn{Conn: conn, Weight: tubes[i].weight}
+	}
+	switch strategy := os.Getenv("TUBE_STRATEGY"); strategy {
+	case "", "weighted":
+		return queue.NewWeighted(wcs...)
+	case "strict":
+		return queue.NewStrict(wcs...)
+	default:
+		log.Fatalf("Invalid tube strategy %q", strategy)
+		return nil
+	}
+}
+
+func getenvInt(key string, def int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		log.Fatalf("Invalid integer environment variable %q: %s", key, err)
+	}
+	return n
+}
+
 func mustGetenv(key string) string {
 	val := os.Getenv(key)
 	if val == "" {
@@ -1,5 +1,18 @@
 package birdbroker
 
+import "errors"
+
+// ErrNotFound is returned when a requested resource does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when a request conflicts with the current state of
+// a resource.
+var ErrConflict = errors.New("conflict")
+
+// ErrKeyReused is returned when an idempotency key is used again for a
+// request with a different payload.
+var ErrKeyReused = errors.New("idempotency key was used for a different request")
+
 type ClientError struct {
 	Reason string
 }
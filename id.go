@@ -0,0 +1,16 @@
+package birdbroker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// NewID returns a random, URL-safe identifier.
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("crypto/rand: Read: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
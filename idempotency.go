@@ -0,0 +1,20 @@
+package birdbroker
+
+import "time"
+
+// IdempotencyKey relates a key chosen by the caller to the message that was
+// accepted with it, so a retried request does not send the message twice.
+type IdempotencyKey struct {
+	Key string `json:"key"`
+	// Fingerprint identifies the payload of the request the key was first
+	// used with.
+	Fingerprint string    `json:"fingerprint"`
+	MessageID   string    `json:"message_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Expired reports whether k can no longer be used to look up its message at
+// time t.
+func (k *IdempotencyKey) Expired(t time.Time) bool {
+	return !t.Before(k.ExpiresAt)
+}
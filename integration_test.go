@@ -0,0 +1,343 @@
+package birdbroker_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/api"
+	"github.com/epels/birdbroker-go/callback"
+	"github.com/epels/birdbroker-go/internal/beanstalkd"
+	"github.com/epels/birdbroker-go/internal/mock"
+	"github.com/epels/birdbroker-go/messagebird"
+	"github.com/epels/birdbroker-go/queue"
+	"github.com/epels/birdbroker-go/service"
+	"github.com/epels/birdbroker-go/store"
+	"github.com/epels/birdbroker-go/worker"
+)
+
+const (
+	callbackSecret = "s3cr3t"
+	callbackTube   = "birdbroker-callbacks"
+
+	// rejectedOriginator makes the fake MessageBird API reject a message.
+	rejectedOriginator = "Rejected"
+)
+
+// messageBirdStub is a fake MessageBird API that accepts every message, unless
+// it is sent by rejectedOriginator.
+type messageBirdStub struct {
+	mu   sync.Mutex
+	sent []string // The bodies of the accepted messages.
+}
+
+func (mb *messageBirdStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Body       string `json:"body"`
+		Originator string `json:"originator"`
+		Recipients string `json:"recipients"`
+		Reference  string `json:"reference"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if data.Originator == rejectedOriginator {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"errors":[{"code":9,"description":"no (correct) recipients found","parameter":"recipient"}]}`))
+		return
+	}
+
+	mb.mu.Lock()
+	mb.sent = append(mb.sent, data.Body)
+	mb.mu.Unlock()
+
+	m := messagebird.Message{
+		ID:         "mb-" + data.Reference,
+		Body:       data.Body,
+		Originator: data.Originator,
+		Reference:  data.Reference,
+	}
+	for _, rcpt := range strings.Split(data.Recipients, ",") {
+		var n int64
+		json.Unmarshal([]byte(rcpt), &n)
+		m.Recipients.Items = append(m.Recipients.Items, messagebird.Recipient{Recipient: n, Status: "sent"})
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+func (mb *messageBirdStub) bodies() []string {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return append([]string(nil), mb.sent...)
+}
+
+// TestPipeline sends messages through the API, a fake beanstalkd and the
+// worker, to a fake MessageBird API.
+func TestPipeline(t *testing.T) {
+	srv, err := beanstalkd.NewServer()
+	if err != nil {
+		t.Fatalf("beanstalkd: NewServer: %s", err)
+	}
+	defer srv.Close()
+
+	mb := &messageBirdStub{}
+	mbSrv := httptest.NewServer(mb)
+	defer mbSrv.Close()
+
+	// The callback receiver verifies the signature of every event.
+	events := make(chan birdbroker.Event, 100)
+	cbSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := callback.Verify(callbackSecret, r.Header.Get(callback.SignatureHeader), b, time.Minute); err != nil {
+			t.Errorf("Got %v, expected a valid signature", err)
+		}
+		var e birdbroker.Event
+		if err := json.Unmarshal(b, &e); err != nil {
+			t.Errorf("encoding/json: Unmarshal: %s", err)
+		}
+		events <- e
+	}))
+	defer cbSrv.Close()
+
+	// The API puts jobs through a pool, as cmd/api does.
+	pool, err := queue.DialPool(srv.Addr())
+	if err != nil {
+		t.Fatalf("queue: DialPool: %s", err)
+	}
+	defer pool.Close()
+	ms := store.NewMemory()
+	st := callback.NewStore(ms, queue.NewCallbackSender(pool.Tube(callbackTube)), "")
+	svc := service.New(queue.NewSender(pool), st, service.WithKeyStore(ms))
+	apiSrv := httptest.NewServer(api.NewHandler(svc))
+	defer apiSrv.Close()
+
+	// The workers reserve jobs on connections of their own, as cmd/worker
+	// does.
+	conn, err := queue.Dial(srv.Addr())
+	if err != nil {
+		t.Fatalf("queue: Dial: %s", err)
+	}
+	defer conn.Close()
+	cbConn, err := queue.Dial(srv.Addr(), queue.WithUse(callbackTube), queue.WithWatch(callbackTube))
+	if err != nil {
+		t.Fatalf("queue: Dial: %s", err)
+	}
+	defer cbConn.Close()
+
+	h := worker.NewHandler(messagebird.NewClient("test_key", messagebird.WithBaseURL(mbSrv.URL)), st)
+	c := queue.NewConsumer(conn, h, queue.WithBuryStore(ms), queue.WithReserveTimeout(100*time.Millisecond))
+	// The callback receiver runs on the loopback interface, which callbacks
+	// are only delivered to when allowed.
+	loopback, err := callback.ParseNetworks("127.0.0.0/8")
+	if err != nil {
+		t.Fatalf("callback: ParseNetworks: %s", err)
+	}
+	cbh := worker.NewCallbackHandler(callback.NewClient(callbackSecret, callback.WithAllowedNetworks(loopback...)))
+	cbc := queue.NewCallbackConsumer(cbConn, cbh, queue.WithReserveTimeout(100*time.Millisecond))
+	for _, c := range []interface{ ListenAndServe() error }{c, cbc} {
+		go c.ListenAndServe()
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %s", err)
+		}
+		if err := cbc.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %s", err)
+		}
+	}()
+
+	t.Run("Sends messages", func(t *testing.T) {
+		rec := postMessage(t, apiSrv.URL, &birdbroker.Message{
+			Body:        "Hello",
+			Originator:  "Birdbroker",
+			Recipient:   "31612345678",
+			CallbackURL: cbSrv.URL,
+		})
+		rec = waitForStatus(t, apiSrv.URL, rec.ID, birdbroker.StatusSent)
+		if rec.MessageBirdID != "mb-"+rec.ID {
+			t.Errorf("Got %q, expected %q", rec.MessageBirdID, "mb-"+rec.ID)
+		}
+		if got := mb.bodies(); len(got) != 1 || got[0] != "Hello" {
+			t.Errorf("Got %q, expected [Hello]", got)
+		}
+
+		// Every status transition is called back, ending with sent.
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.MessageID != rec.ID {
+					t.Errorf("Got %q, expected %q", e.MessageID, rec.ID)
+				}
+				if e.Status != birdbroker.StatusSent {
+					continue
+				}
+			case <-timeout:
+				t.Fatalf("Got no callback, expected status %s", birdbroker.StatusSent)
+			}
+			break
+		}
+	})
+
+	t.Run("Buries rejected messages", func(t *testing.T) {
+		rec := postMessage(t, apiSrv.URL, &birdbroker.Message{
+			Body:       "Hello",
+			Originator: rejectedOriginator,
+			Recipient:  "31612345678",
+		})
+		rec = waitForStatus(t, apiSrv.URL, rec.ID, birdbroker.StatusBuried)
+		if rec.Bury == nil || rec.Bury.Reason != birdbroker.BuryPermanentError {
+			t.Errorf("Got %+v, expected a bury record for a permanent error", rec.Bury)
+		}
+
+		// The buried job can be inspected through the admin.
+		bc, err := beanstalk.Dial("tcp", srv.Addr())
+		if err != nil {
+			t.Fatalf("beanstalk: Dial: %s", err)
+		}
+		defer bc.Close()
+		jobs, err := queue.NewAdmin(queue.NewBeanstalkAdminConn(bc), queue.WithBuryRecords(ms)).Buried("default", 0)
+		if err != nil {
+			t.Fatalf("Buried: %s", err)
+		}
+		if len(jobs) != 1 || jobs[0].ID != rec.JobID {
+			t.Errorf("Got %+v, expected job %d", jobs, rec.JobID)
+		}
+	})
+}
+
+// TestCancelWhileSending cancels messages while a worker picks them up, with
+// the API and the worker each using a store of their own on a shared
+// directory, as cmd/api and cmd/worker do. A message is either cancelled or
+// sent, never both.
+func TestCancelWhileSending(t *testing.T) {
+	ctx := context.Background()
+	path, err := ioutil.TempDir("", "birdbroker-store")
+	if err != nil {
+		t.Fatalf("io/ioutil: TempDir: %s", err)
+	}
+	defer os.RemoveAll(path)
+	apiStore, err := store.NewDir(path)
+	if err != nil {
+		t.Fatalf("store: NewDir: %s", err)
+	}
+	defer apiStore.Close()
+	workerStore, err := store.NewDir(path)
+	if err != nil {
+		t.Fatalf("store: NewDir: %s", err)
+	}
+	defer workerStore.Close()
+
+	var mu sync.Mutex
+	sent := make(map[string]bool)
+	svc := service.New(&mock.Sender{
+		CancelFunc: func(id uint64) error { return nil },
+	}, apiStore)
+	h := worker.NewHandler(&mock.MessageBird{
+		SendMessageFunc: func(m *birdbroker.Message) ([]*messagebird.Message, error) {
+			mu.Lock()
+			sent[m.ID] = true
+			mu.Unlock()
+			return nil, nil
+		},
+	}, workerStore)
+
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("msg-%d", i)
+		if err := apiStore.Create(ctx, &birdbroker.Record{ID: id, Status: birdbroker.StatusQueued}); err != nil {
+			t.Fatalf("Create: %s", err)
+		}
+
+		var wg sync.WaitGroup
+		var cancelErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, cancelErr = svc.CancelMessage(ctx, id)
+		}()
+		go func() {
+			defer wg.Done()
+			if err := h.ServeJob(ctx, &birdbroker.Message{ID: id, Recipient: "31612345678"}); err != nil {
+				t.Errorf("ServeJob: %s", err)
+			}
+		}()
+		wg.Wait()
+
+		mu.Lock()
+		wasSent := sent[id]
+		mu.Unlock()
+		switch {
+		case cancelErr == nil && wasSent:
+			t.Errorf("Message %s: got sent, expected cancelled message not to be sent", id)
+		case cancelErr != nil && !errors.Is(cancelErr, birdbroker.ErrConflict):
+			t.Errorf("Message %s: got %v, expected nil or ErrConflict", id, cancelErr)
+		case cancelErr != nil && !wasSent:
+			t.Errorf("Message %s: got not sent, expected message that can't be cancelled to be sent", id)
+		}
+	}
+}
+
+// postMessage sends m through the API at baseURL, and returns the record
+// created for it.
+func postMessage(t *testing.T, baseURL string, m *birdbroker.Message) *birdbroker.Record {
+	t.Helper()
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("encoding/json: Marshal: %s", err)
+	}
+	res, err := http.Post(baseURL+"/messages", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("net/http: Post: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Got %d, expected %d", res.StatusCode, http.StatusCreated)
+	}
+
+	var rec birdbroker.Record
+	if err := json.NewDecoder(res.Body).Decode(&rec); err != nil {
+		t.Fatalf("encoding/json: Decoder.Decode: %s", err)
+	}
+	return &rec
+}
+
+// waitForStatus polls the API at baseURL until the message identified by id
+// has status s, and returns its record.
+func waitForStatus(t *testing.T, baseURL, id string, s birdbroker.Status) *birdbroker.Record {
+	t.Helper()
+	var rec birdbroker.Record
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		res, err := http.Get(baseURL + "/messages/" + id)
+		if err != nil {
+			t.Fatalf("net/http: Get: %s", err)
+		}
+		err = json.NewDecoder(res.Body).Decode(&rec)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("encoding/json: Decoder.Decode: %s", err)
+		}
+		if rec.Status == s {
+			return &rec
+		}
+	}
+	t.Fatalf("Got status %s, expected %s", rec.Status, s)
+	return nil
+}
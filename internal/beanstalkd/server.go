@@ -0,0 +1,586 @@
+// Package beanstalkd runs a fake beanstalkd in-process, so tests can exercise
+// the beanstalk protocol through go-beanstalk without a beanstalkd daemon.
+//
+// It implements the commands birdbroker uses: put, use, reserve,
+// reserve-with-timeout, release, bury, delete, touch, watch, ignore, kick,
+// kick-job, peek, peek-ready, peek-delayed, peek-buried, stats, stats-job,
+// stats-tube, list-tubes and quit. Like beanstalkd, it releases the jobs a
+// connection reserved when the connection closes.
+package beanstalkd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/epels/birdbroker-go/internal/jobs"
+)
+
+// maxJobSize is the largest job body accepted, like beanstalkd's default.
+const maxJobSize = 65535
+
+// Server is a fake beanstalkd listening on localhost.
+type Server struct {
+	ln     net.Listener
+	stopCh chan struct{}  // Closed by Close.
+	wg     sync.WaitGroup // Tracks the goroutines serving connections.
+
+	mu       sync.Mutex // Guards the fields below.
+	jobs     jobs.Set
+	lastID   uint64
+	lastConn uint64
+	conns    map[*conn]bool
+	wake     chan struct{} // Closed when a job may have become ready.
+}
+
+// conn is a client connection to the server.
+type conn struct {
+	s  *Server
+	id string // Identifies the connection as the owner of reserved jobs.
+	nc net.Conn
+	r  *bufio.Reader
+
+	// The tubes used and watched are only changed by the goroutine serving
+	// the connection, while holding s.mu: other connections read them.
+	use   string
+	watch map[string]bool
+}
+
+// NewServer starts a server on a random port of localhost.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("net: Listen: %s", err)
+	}
+	s := &Server{
+		ln:     ln,
+		stopCh: make(chan struct{}),
+		jobs:   make(jobs.Set),
+		conns:  make(map[*conn]bool),
+		wake:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server, and closes all connections to it.
+func (s *Server) Close() error {
+	close(s.stopCh)
+	err := s.ln.Close()
+
+	s.mu.Lock()
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{
+			s:     s,
+			nc:    nc,
+			r:     bufio.NewReader(nc),
+			use:   "default",
+			watch: map[string]bool{"default": true},
+		}
+		s.mu.Lock()
+		s.lastConn++
+		c.id = strconv.FormatUint(s.lastConn, 10)
+		s.conns[c] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go c.serve()
+	}
+}
+
+// serve handles the commands on c until it is closed, and then releases the
+// jobs it reserved.
+func (c *conn) serve() {
+	defer c.s.wg.Done()
+	defer func() {
+		c.nc.Close()
+
+		c.s.mu.Lock()
+		defer c.s.mu.Unlock()
+		delete(c.s.conns, c)
+		c.s.jobs.Unreserve(c.id)
+		c.s.notify()
+	}()
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			if !c.reply("BAD_FORMAT") {
+				return
+			}
+			continue
+		}
+		if f[0] == "quit" {
+			return
+		}
+		if !c.handle(f[0], f[1:]) {
+			return
+		}
+	}
+}
+
+// handle runs the command cmd with arguments args, and reports whether the
+// connection is still usable.
+func (c *conn) handle(cmd string, args []string) bool {
+	switch cmd {
+	case "put":
+		return c.put(args)
+	case "use":
+		if len(args) != 1 {
+			return c.reply("BAD_FORMAT")
+		}
+		c.s.mu.Lock()
+		c.use = args[0]
+		c.s.mu.Unlock()
+		return c.reply("USING " + args[0])
+	case "watch":
+		if len(args) != 1 {
+			return c.reply("BAD_FORMAT")
+		}
+		c.s.mu.Lock()
+		c.watch[args[0]] = true
+		n := len(c.watch)
+		c.s.mu.Unlock()
+		return c.reply(fmt.Sprintf("WATCHING %d", n))
+	case "ignore":
+		if len(args) != 1 {
+			return c.reply("BAD_FORMAT")
+		}
+		c.s.mu.Lock()
+		if c.watch[args[0]] && len(c.watch) == 1 {
+			c.s.mu.Unlock()
+			return c.reply("NOT_IGNORED")
+		}
+		delete(c.watch, args[0])
+		n := len(c.watch)
+		c.s.mu.Unlock()
+		return c.reply(fmt.Sprintf("WATCHING %d", n))
+	case "reserve":
+		return c.reserve(-1)
+	case "reserve-with-timeout":
+		n, ok := parseInts(args, 1)
+		if !ok {
+			return c.reply("BAD_FORMAT")
+		}
+		return c.reserve(time.Duration(n[0]) * time.Second)
+	case "release":
+		n, ok := parseInts(args, 3)
+		if !ok {
+			return c.reply("BAD_FORMAT")
+		}
+		return c.reply(c.withReserved(uint64(n[0]), "RELEASED", func(j *jobs.Job, now time.Time) {
+			j.Release(uint32(n[1]), time.Duration(n[2])*time.Second, now)
+		}))
+	case "bury":
+		n, ok := parseInts(args, 2)
+		if !ok {
+			return c.reply("BAD_FORMAT")
+		}
+		return c.reply(c.withReserved(uint64(n[0]), "BURIED", func(j *jobs.Job, now time.Time) {
+			j.Bury(uint32(n[1]))
+		}))
+	case "touch":
+		n, ok := parseInts(args, 1)
+		if !ok {
+			return c.reply("BAD_FORMAT")
+		}
+		return c.reply(c.withReserved(uint64(n[0]), "TOUCHED", func(j *jobs.Job, now time.Time) {
+			j.Touch(now)
+		}))
+	case "delete":
+		n, ok := parseInts(args, 1)
+		if !ok {
+			return c.reply("BAD_FORMAT")
+		}
+		return c.reply(c.delete(uint64(n[0])))
+	case "kick":
+		n, ok := parseInts(args, 1)
+		if !ok {
+			return c.reply("BAD_FORMAT")
+		}
+		return c.reply(fmt.Sprintf("KICKED %d", c.kick(int(n[0]))))
+	case "kick-job":
+		n, ok := parseInts(args, 1)
+		if !ok {
+			return c.reply("BAD_FORMAT")
+		}
+		return c.reply(c.kickJob(uint64(n[0])))
+	case "peek":
+		n, ok := parseInts(args, 1)
+		if !ok {
+			return c.reply("BAD_FORMAT")
+		}
+		return c.peek(func(js jobs.Set) *jobs.Job { return js[uint64(n[0])] })
+	case "peek-ready":
+		return c.peek(func(js jobs.Set) *jobs.Job { return js.First(c.use, jobs.StateReady) })
+	case "peek-delayed":
+		return c.peek(func(js jobs.Set) *jobs.Job { return js.First(c.use, jobs.StateDelayed) })
+	case "peek-buried":
+		return c.peek(func(js jobs.Set) *jobs.Job { return js.First(c.use, jobs.StateBuried) })
+	case "stats":
+		return c.replyYAML(c.s.stats(""))
+	case "stats-job":
+		n, ok := parseInts(args, 1)
+		if !ok {
+			return c.reply("BAD_FORMAT")
+		}
+		stats := c.s.jobStats(uint64(n[0]))
+		if stats == nil {
+			return c.reply("NOT_FOUND")
+		}
+		return c.replyYAML(stats)
+	case "stats-tube":
+		if len(args) != 1 {
+			return c.reply("BAD_FORMAT")
+		}
+		stats := c.s.stats(args[0])
+		if stats == nil {
+			return c.reply("NOT_FOUND")
+		}
+		return c.replyYAML(stats)
+	case "list-tubes":
+		var b bytes.Buffer
+		b.WriteString("---\n")
+		for _, tube := range c.s.tubes() {
+			fmt.Fprintf(&b, "- %s\n", tube)
+		}
+		return c.replyBody("OK", b.Bytes())
+	default:
+		return c.reply("UNKNOWN_COMMAND")
+	}
+}
+
+func (c *conn) put(args []string) bool {
+	n, ok := parseInts(args, 4)
+	if !ok {
+		return c.reply("BAD_FORMAT")
+	}
+	size := int(n[3])
+	if size > maxJobSize {
+		// The body is not read, so the connection can't be used anymore.
+		c.reply("JOB_TOO_BIG")
+		return false
+	}
+	body := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return false
+	}
+	if !bytes.HasSuffix(body, []byte("\r\n")) {
+		return c.reply("EXPECTED_CRLF")
+	}
+
+	s := c.s
+	s.mu.Lock()
+	s.lastID++
+	id := s.lastID
+	delay, ttr := time.Duration(n[1])*time.Second, time.Duration(n[2])*time.Second
+	s.jobs[id] = jobs.New(id, c.use, body[:size], uint32(n[0]), delay, ttr, time.Now())
+	s.notify()
+	s.mu.Unlock()
+
+	return c.reply(fmt.Sprintf("INSERTED %d", id))
+}
+
+// reserve reserves a job from the watched tubes, waiting at most timeout for
+// one to become ready, or indefinitely if timeout is negative.
+func (c *conn) reserve(timeout time.Duration) bool {
+	s := c.s
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		next := s.jobs.Tick(now)
+		if j := s.jobs.Take(c.id, c.watched(), now); j != nil {
+			id, body := j.ID, j.Body
+			s.mu.Unlock()
+			return c.replyBody(fmt.Sprintf("RESERVED %d", id), body)
+		}
+		wake := s.wake
+		s.mu.Unlock()
+
+		if timeout >= 0 && !now.Before(deadline) {
+			return c.reply("TIMED_OUT")
+		}
+		// Wait for a job to be put or released, for the deadline, or for
+		// the next delayed or reserved job to become ready.
+		var wait <-chan time.Time
+		var d time.Duration = -1
+		if timeout >= 0 {
+			d = deadline.Sub(now)
+		}
+		if !next.IsZero() && (d < 0 || next.Sub(now) < d) {
+			d = next.Sub(now)
+		}
+		var t *time.Timer
+		if d >= 0 {
+			t = time.NewTimer(d)
+			wait = t.C
+		}
+		select {
+		case <-wake:
+		case <-wait:
+		case <-s.stopCh:
+		}
+		if t != nil {
+			t.Stop()
+		}
+		select {
+		case <-s.stopCh:
+			return false
+		default:
+		}
+	}
+}
+
+// withReserved calls fn with the job identified by id if it is reserved by
+// c, and returns ok. It returns NOT_FOUND otherwise.
+func (c *conn) withReserved(id uint64, ok string, fn func(j *jobs.Job, now time.Time)) string {
+	s := c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.jobs.Tick(now)
+	j := s.jobs.ReservedBy(c.id, id)
+	if j == nil {
+		return "NOT_FOUND"
+	}
+	fn(j, now)
+	s.notify()
+	return ok
+}
+
+func (c *conn) delete(id uint64) string {
+	s := c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs.Tick(time.Now())
+	if !s.jobs.Deletable(c.id, id) {
+		return "NOT_FOUND"
+	}
+	delete(s.jobs, id)
+	return "DELETED"
+}
+
+// kick moves at most bound jobs in the used tube to the ready queue: buried
+// jobs if there are any, and delayed jobs otherwise.
+func (c *conn) kick(bound int) int {
+	s := c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs.Tick(time.Now())
+	var kicked int
+	for _, state := range []string{jobs.StateBuried, jobs.StateDelayed} {
+		for _, j := range s.jobs.Sorted() {
+			if kicked == bound {
+				break
+			}
+			if j.Tube == c.use && j.State == state {
+				j.Kick()
+				kicked++
+			}
+		}
+		if kicked > 0 {
+			break
+		}
+	}
+	s.notify()
+	return kicked
+}
+
+func (c *conn) kickJob(id uint64) string {
+	s := c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs.Tick(time.Now())
+	j, ok := s.jobs[id]
+	if !ok || (j.State != jobs.StateBuried && j.State != jobs.StateDelayed) {
+		return "NOT_FOUND"
+	}
+	j.Kick()
+	s.notify()
+	return "KICKED"
+}
+
+// peek replies with the job find returns, if any.
+func (c *conn) peek(find func(js jobs.Set) *jobs.Job) bool {
+	s := c.s
+	s.mu.Lock()
+	s.jobs.Tick(time.Now())
+	j := find(s.jobs)
+	s.mu.Unlock()
+
+	if j == nil {
+		return c.reply("NOT_FOUND")
+	}
+	return c.replyBody(fmt.Sprintf("FOUND %d", j.ID), j.Body)
+}
+
+// watched returns the names of the tubes c watches.
+func (c *conn) watched() []string {
+	tubes := make([]string, 0, len(c.watch))
+	for tube := range c.watch {
+		tubes = append(tubes, tube)
+	}
+	return tubes
+}
+
+func (c *conn) reply(line string) bool {
+	_, err := io.WriteString(c.nc, line+"\r\n")
+	return err == nil
+}
+
+func (c *conn) replyBody(line string, body []byte) bool {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %d\r\n", line, len(body))
+	b.Write(body)
+	b.WriteString("\r\n")
+	_, err := c.nc.Write(b.Bytes())
+	return err == nil
+}
+
+func (c *conn) replyYAML(stats map[string]string) bool {
+	keys := make([]string, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString("---\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s: %s\n", k, stats[k])
+	}
+	return c.replyBody("OK", b.Bytes())
+}
+
+// notify wakes up the connections waiting for a job. The caller must hold
+// s.mu.
+func (s *Server) notify() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+func (s *Server) jobStats(id uint64) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.jobs.Tick(now)
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	stats := j.Stats(now)
+	stats["file"] = "0"
+	return stats
+}
+
+// stats counts the jobs in tube, or in all tubes if tube is empty. It returns
+// nil if tube does not exist.
+func (s *Server) stats(tube string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs.Tick(time.Now())
+	stats, total := s.jobs.Counts(tube)
+	if tube != "" && total == 0 && !s.known(tube) {
+		return nil
+	}
+	if tube != "" {
+		stats["name"] = tube
+	} else {
+		stats["current-connections"] = strconv.Itoa(len(s.conns))
+		stats["total-jobs"] = strconv.FormatUint(s.lastID, 10)
+	}
+	return stats
+}
+
+// tubes returns the names of the tubes that hold jobs, or are used or
+// watched by a connection.
+func (s *Server) tubes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := map[string]bool{"default": true}
+	for _, j := range s.jobs {
+		set[j.Tube] = true
+	}
+	for c := range s.conns {
+		set[c.use] = true
+		for tube := range c.watch {
+			set[tube] = true
+		}
+	}
+	tubes := make([]string, 0, len(set))
+	for tube := range set {
+		tubes = append(tubes, tube)
+	}
+	sort.Strings(tubes)
+	return tubes
+}
+
+// known reports whether a connection uses or watches tube. The caller must
+// hold s.mu.
+func (s *Server) known(tube string) bool {
+	if tube == "default" {
+		return true
+	}
+	for c := range s.conns {
+		if c.use == tube || c.watch[tube] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseInts parses args as n non-negative integers.
+func parseInts(args []string, n int) ([]int64, bool) {
+	if len(args) != n {
+		return nil, false
+	}
+	ints := make([]int64, n)
+	for i, arg := range args {
+		v, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || v < 0 {
+			return nil, false
+		}
+		ints[i] = v
+	}
+	return ints, true
+}
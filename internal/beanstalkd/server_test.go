@@ -0,0 +1,172 @@
+package beanstalkd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+)
+
+func TestServer(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	defer s.Close()
+
+	dial := func(t *testing.T) *beanstalk.Conn {
+		t.Helper()
+		c, err := beanstalk.Dial("tcp", s.Addr())
+		if err != nil {
+			t.Fatalf("beanstalk: Dial: %s", err)
+		}
+		return c
+	}
+
+	t.Run("Releases jobs on disconnect", func(t *testing.T) {
+		c := dial(t)
+		defer c.Close()
+		tube := &beanstalk.Tube{Conn: c, Name: "disconnect"}
+		id, _ := tube.Put([]byte("Hello"), 0, 0, time.Minute)
+
+		other := dial(t)
+		ts := beanstalk.NewTubeSet(other, "disconnect")
+		if _, _, err := ts.Reserve(0); err != nil {
+			t.Fatalf("Reserve: %s", err)
+		}
+		other.Close()
+
+		ts = beanstalk.NewTubeSet(c, "disconnect")
+		if got, _, err := ts.Reserve(time.Second); err != nil || got != id {
+			t.Errorf("Got %d (%v), expected %d", got, err, id)
+		}
+	})
+
+	t.Run("Kicks buried jobs before delayed ones", func(t *testing.T) {
+		c := dial(t)
+		defer c.Close()
+		tube := &beanstalk.Tube{Conn: c, Name: "kick"}
+		delayed, _ := tube.Put([]byte("delayed"), 0, time.Hour, time.Minute)
+		buried, _ := tube.Put([]byte("buried"), 0, 0, time.Minute)
+		ts := beanstalk.NewTubeSet(c, "kick")
+		if _, _, err := ts.Reserve(0); err != nil {
+			t.Fatalf("Reserve: %s", err)
+		}
+		if err := c.Bury(buried, 0); err != nil {
+			t.Fatalf("Bury: %s", err)
+		}
+
+		for _, want := range []uint64{buried, delayed} {
+			if n, err := tube.Kick(10); err != nil || n != 1 {
+				t.Fatalf("Got %d (%v), expected 1", n, err)
+			}
+			if id, _, err := ts.Reserve(0); err != nil || id != want {
+				t.Errorf("Got %d (%v), expected %d", id, err, want)
+			}
+		}
+	})
+
+	t.Run("Peeks", func(t *testing.T) {
+		c := dial(t)
+		defer c.Close()
+		tube := &beanstalk.Tube{Conn: c, Name: "peek"}
+		if _, _, err := tube.PeekReady(); !isNotFound(err) {
+			t.Errorf("Got %v, expected %v", err, beanstalk.ErrNotFound)
+		}
+		ready, _ := tube.Put([]byte("ready"), 0, 0, time.Minute)
+		delayed, _ := tube.Put([]byte("delayed"), 0, time.Hour, time.Minute)
+
+		tests := []struct {
+			name string
+			peek func() (uint64, []byte, error)
+			id   uint64
+			body string
+		}{
+			{"peek", func() (uint64, []byte, error) { b, err := c.Peek(delayed); return delayed, b, err }, delayed, "delayed"},
+			{"peek-ready", tube.PeekReady, ready, "ready"},
+			{"peek-delayed", tube.PeekDelayed, delayed, "delayed"},
+		}
+		for _, tc := range tests {
+			if id, b, err := tc.peek(); err != nil || id != tc.id || string(b) != tc.body {
+				t.Errorf("%s: Got %d %q (%v), expected %d %q", tc.name, id, b, err, tc.id, tc.body)
+			}
+		}
+		if _, _, err := tube.PeekBuried(); !isNotFound(err) {
+			t.Errorf("Got %v, expected %v", err, beanstalk.ErrNotFound)
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		c := dial(t)
+		defer c.Close()
+		tube := &beanstalk.Tube{Conn: c, Name: "stats"}
+		tube.Put([]byte("ready"), 0, 0, time.Minute)
+		tube.Put([]byte("delayed"), 0, time.Hour, time.Minute)
+
+		stats, err := tube.Stats()
+		if err != nil {
+			t.Fatalf("Stats: %s", err)
+		}
+		if stats["name"] != "stats" || stats["current-jobs-ready"] != "1" || stats["current-jobs-delayed"] != "1" {
+			t.Errorf("Got %v, expected 1 ready and 1 delayed job in stats", stats)
+		}
+		if _, err := c.Stats(); err != nil {
+			t.Errorf("Got %v, expected server stats", err)
+		}
+		if _, err := (&beanstalk.Tube{Conn: c, Name: "unknown"}).Stats(); !isNotFound(err) {
+			t.Errorf("Got %v, expected %v", err, beanstalk.ErrNotFound)
+		}
+
+		tubes, err := c.ListTubes()
+		if err != nil {
+			t.Fatalf("ListTubes: %s", err)
+		}
+		if !contains(tubes, "default") || !contains(tubes, "stats") {
+			t.Errorf("Got %v, expected default and stats", tubes)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		nc, err := net.Dial("tcp", s.Addr())
+		if err != nil {
+			t.Fatalf("net: Dial: %s", err)
+		}
+		defer nc.Close()
+		r := bufio.NewReader(nc)
+
+		tests := []struct {
+			cmd, want string
+		}{
+			{"frobnicate\r\n", "UNKNOWN_COMMAND\r\n"},
+			{"put 0 0 1\r\n", "BAD_FORMAT\r\n"},
+			{"put 0 0 1 3\r\nHello", "EXPECTED_CRLF\r\n"},
+			{"delete 1000\r\n", "NOT_FOUND\r\n"},
+			{"ignore default\r\n", "NOT_IGNORED\r\n"},
+		}
+		for _, tc := range tests {
+			fmt.Fprint(nc, tc.cmd)
+			if got, err := r.ReadString('\n'); err != nil || got != tc.want {
+				t.Errorf("%q: Got %q (%v), expected %q", tc.cmd, got, err, tc.want)
+			}
+		}
+	})
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotFound reports whether err is beanstalk.ErrNotFound, which the
+// ConnError of go-beanstalk doesn't unwrap to.
+func isNotFound(err error) bool {
+	ce, ok := err.(beanstalk.ConnError)
+	return ok && ce.Err == beanstalk.ErrNotFound
+}
@@ -0,0 +1,264 @@
+// Package jobs models the jobs of a queue the way beanstalkd does: jobs are
+// put in tubes with a priority, a delay and a time to run, and move between
+// the ready, delayed, reserved and buried states.
+//
+// It is shared by the queues that are not backed by beanstalkd, and by the
+// fake beanstalkd the tests run against, so they all follow the same rules.
+// None of its types are safe for concurrent use: callers hold a lock of their
+// own while using them.
+package jobs
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// MinTTR is the shortest time a job can be reserved for, like in beanstalkd.
+const MinTTR = time.Second
+
+// urgentPri is the priority below which ready jobs count as urgent in stats,
+// like in beanstalkd.
+const urgentPri = 1024
+
+// States of a job, named like in beanstalkd.
+const (
+	StateReady    = "ready"
+	StateDelayed  = "delayed"
+	StateReserved = "reserved"
+	StateBuried   = "buried"
+)
+
+// Job is a job in a queue. Its methods move it between states like beanstalkd
+// does.
+type Job struct {
+	ID      uint64
+	Tube    string
+	Body    []byte
+	Pri     uint32
+	Delay   time.Duration
+	TTR     time.Duration
+	Created time.Time
+
+	State string
+	Until time.Time // When a delayed or reserved job becomes ready.
+	Owner string    // The connection that reserved the job.
+
+	Reserves, Timeouts, Releases, Buries, Kicks int
+}
+
+// New creates a job put in tube at now. It is delayed if delay is positive,
+// and ready otherwise.
+func New(id uint64, tube string, body []byte, pri uint32, delay, ttr time.Duration, now time.Time) *Job {
+	if ttr < MinTTR {
+		ttr = MinTTR
+	}
+	j := &Job{
+		ID:      id,
+		Tube:    tube,
+		Body:    append([]byte(nil), body...),
+		Pri:     pri,
+		Delay:   delay,
+		TTR:     ttr,
+		Created: now,
+		State:   StateReady,
+	}
+	if delay > 0 {
+		j.State, j.Until = StateDelayed, now.Add(delay)
+	}
+	return j
+}
+
+// Reserve reserves j for owner until its time to run passed.
+func (j *Job) Reserve(owner string, now time.Time) {
+	j.State, j.Owner, j.Until = StateReserved, owner, now.Add(j.TTR)
+	j.Reserves++
+}
+
+// Release makes the reserved job j ready again with priority pri, or delayed
+// if delay is positive.
+func (j *Job) Release(pri uint32, delay time.Duration, now time.Time) {
+	j.Owner, j.Pri, j.Delay = "", pri, delay
+	j.State = StateReady
+	if delay > 0 {
+		j.State, j.Until = StateDelayed, now.Add(delay)
+	}
+	j.Releases++
+}
+
+// Bury buries the reserved job j with priority pri.
+func (j *Job) Bury(pri uint32) {
+	j.State, j.Owner, j.Pri = StateBuried, "", pri
+	j.Buries++
+}
+
+// Touch gives the reserved job j its full time to run again.
+func (j *Job) Touch(now time.Time) {
+	j.Until = now.Add(j.TTR)
+}
+
+// Kick makes the buried or delayed job j ready.
+func (j *Job) Kick() {
+	j.State = StateReady
+	j.Kicks++
+}
+
+// Stats returns the statistics of j at now, with the keys beanstalkd uses.
+func (j *Job) Stats(now time.Time) map[string]string {
+	var left time.Duration
+	if j.State == StateDelayed || j.State == StateReserved {
+		left = j.Until.Sub(now)
+	}
+	return map[string]string{
+		"id":        strconv.FormatUint(j.ID, 10),
+		"tube":      j.Tube,
+		"state":     j.State,
+		"pri":       strconv.FormatUint(uint64(j.Pri), 10),
+		"age":       seconds(now.Sub(j.Created)),
+		"delay":     seconds(j.Delay),
+		"ttr":       seconds(j.TTR),
+		"time-left": seconds(left),
+		"reserves":  strconv.Itoa(j.Reserves),
+		"timeouts":  strconv.Itoa(j.Timeouts),
+		"releases":  strconv.Itoa(j.Releases),
+		"buries":    strconv.Itoa(j.Buries),
+		"kicks":     strconv.Itoa(j.Kicks),
+	}
+}
+
+// Set holds the jobs of a queue by ID.
+type Set map[uint64]*Job
+
+// Tick makes the delayed jobs that are due, and the reserved jobs that ran
+// out of time, ready again. It returns when the next job becomes ready, or
+// the zero time if no job is waiting.
+func (s Set) Tick(now time.Time) time.Time {
+	var next time.Time
+	for _, j := range s {
+		if j.State != StateDelayed && j.State != StateReserved {
+			continue
+		}
+		if !now.Before(j.Until) {
+			if j.State == StateReserved {
+				j.Timeouts++
+			}
+			j.State, j.Owner = StateReady, ""
+			continue
+		}
+		if next.IsZero() || j.Until.Before(next) {
+			next = j.Until
+		}
+	}
+	return next
+}
+
+// Next returns the most urgent ready job in tubes: the one with the lowest
+// priority value, and then the lowest ID. It returns nil if no job is ready.
+func (s Set) Next(tubes []string) *Job {
+	var best *Job
+	for _, j := range s {
+		if j.State != StateReady || !contains(tubes, j.Tube) {
+			continue
+		}
+		if best == nil || j.Pri < best.Pri || (j.Pri == best.Pri && j.ID < best.ID) {
+			best = j
+		}
+	}
+	return best
+}
+
+// Take reserves the most urgent ready job in tubes for owner.
+func (s Set) Take(owner string, tubes []string, now time.Time) *Job {
+	j := s.Next(tubes)
+	if j != nil {
+		j.Reserve(owner, now)
+	}
+	return j
+}
+
+// ReservedBy returns the job identified by id if it is reserved by owner, or
+// nil otherwise.
+func (s Set) ReservedBy(owner string, id uint64) *Job {
+	j, ok := s[id]
+	if !ok || j.State != StateReserved || j.Owner != owner {
+		return nil
+	}
+	return j
+}
+
+// Deletable reports whether owner may delete the job identified by id: it
+// must exist, and not be reserved by another owner.
+func (s Set) Deletable(owner string, id uint64) bool {
+	j, ok := s[id]
+	return ok && (j.State != StateReserved || j.Owner == owner)
+}
+
+// Unreserve makes the jobs reserved by owner ready again, as happens when the
+// connection that reserved them closes.
+func (s Set) Unreserve(owner string) {
+	for _, j := range s {
+		if j.State == StateReserved && j.Owner == owner {
+			j.State, j.Owner = StateReady, ""
+		}
+	}
+}
+
+// First returns the job with the lowest ID in tube that is in state, or nil
+// if there is none. This is the job beanstalkd peeks at, and kicks first.
+func (s Set) First(tube, state string) *Job {
+	var first *Job
+	for _, j := range s {
+		if j.Tube == tube && j.State == state && (first == nil || j.ID < first.ID) {
+			first = j
+		}
+	}
+	return first
+}
+
+// Sorted returns the jobs ordered by ID.
+func (s Set) Sorted() []*Job {
+	js := make([]*Job, 0, len(s))
+	for _, j := range s {
+		js = append(js, j)
+	}
+	sort.Slice(js, func(a, b int) bool { return js[a].ID < js[b].ID })
+	return js
+}
+
+// Counts returns how many jobs tube holds in every state, with the keys
+// beanstalkd uses in stats-tube, or of all tubes if tube is empty. It also
+// returns the total number of jobs counted.
+func (s Set) Counts(tube string) (map[string]string, int) {
+	counts := make(map[string]int)
+	var total int
+	for _, j := range s {
+		if tube != "" && j.Tube != tube {
+			continue
+		}
+		counts[j.State]++
+		if j.State == StateReady && j.Pri < urgentPri {
+			counts["urgent"]++
+		}
+		total++
+	}
+	return map[string]string{
+		"current-jobs-urgent":   strconv.Itoa(counts["urgent"]),
+		"current-jobs-ready":    strconv.Itoa(counts[StateReady]),
+		"current-jobs-reserved": strconv.Itoa(counts[StateReserved]),
+		"current-jobs-delayed":  strconv.Itoa(counts[StateDelayed]),
+		"current-jobs-buried":   strconv.Itoa(counts[StateBuried]),
+	}, total
+}
+
+func contains(ss []string, s string) bool {
+	for _, cur := range ss {
+		if cur == s {
+			return true
+		}
+	}
+	return false
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(d / time.Second))
+}
@@ -0,0 +1,104 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSet(t *testing.T) {
+	now := time.Now()
+	newSet := func() Set {
+		return Set{
+			1: New(1, "a", []byte("one"), 10, 0, time.Minute, now),
+			2: New(2, "a", []byte("two"), 5, 0, time.Minute, now),
+			3: New(3, "a", []byte("three"), 5, time.Minute, time.Minute, now),
+			4: New(4, "b", []byte("four"), 2000, 0, time.Minute, now),
+		}
+	}
+
+	t.Run("Take", func(t *testing.T) {
+		s := newSet()
+		if j := s.Take("c1", []string{"a"}, now); j == nil || j.ID != 2 {
+			t.Fatalf("Got %+v, expected job 2", j)
+		}
+		if j := s.Take("c1", []string{"a"}, now); j == nil || j.ID != 1 {
+			t.Fatalf("Got %+v, expected job 1", j)
+		}
+		if j := s.Take("c1", []string{"a"}, now); j != nil {
+			t.Errorf("Got %+v, expected no job as job 3 is delayed", j)
+		}
+		if s.ReservedBy("c2", 1) != nil || s.Deletable("c2", 1) {
+			t.Error("Expected job 1 to be reserved by another owner")
+		}
+	})
+
+	t.Run("Tick", func(t *testing.T) {
+		s := newSet()
+		s.Take("c1", []string{"a"}, now)
+
+		if next := s.Tick(now); !next.Equal(now.Add(time.Minute)) {
+			t.Errorf("Got %s, expected a minute from now", next)
+		}
+		s.Tick(now.Add(time.Minute))
+		if s[2].State != StateReady || s[2].Timeouts != 1 {
+			t.Errorf("Got %+v, expected reserved job 2 to time out", s[2])
+		}
+		if s[3].State != StateReady {
+			t.Errorf("Got %+v, expected delayed job 3 to be ready", s[3])
+		}
+	})
+
+	t.Run("Unreserve", func(t *testing.T) {
+		s := newSet()
+		s.Take("c1", []string{"a"}, now)
+		s.Take("c2", []string{"a"}, now)
+
+		s.Unreserve("c1")
+		if s[2].State != StateReady || s[2].Owner != "" {
+			t.Errorf("Got %+v, expected job 2 to be ready", s[2])
+		}
+		if s.ReservedBy("c2", 1) == nil {
+			t.Error("Expected job 1 to stay reserved by c2")
+		}
+	})
+
+	t.Run("First", func(t *testing.T) {
+		s := newSet()
+		s[2].Reserve("c1", now)
+		s[2].Bury(0)
+		s[1].Reserve("c1", now)
+		s[1].Bury(0)
+
+		if j := s.First("a", StateBuried); j == nil || j.ID != 1 {
+			t.Errorf("Got %+v, expected job 1", j)
+		}
+		if j := s.First("b", StateBuried); j != nil {
+			t.Errorf("Got %+v, expected no job", j)
+		}
+	})
+
+	t.Run("Counts", func(t *testing.T) {
+		s := newSet()
+		s.Take("c1", []string{"a"}, now)
+
+		counts, total := s.Counts("a")
+		want := map[string]string{
+			"current-jobs-urgent":   "1",
+			"current-jobs-ready":    "1",
+			"current-jobs-reserved": "1",
+			"current-jobs-delayed":  "1",
+			"current-jobs-buried":   "0",
+		}
+		for k, v := range want {
+			if counts[k] != v {
+				t.Errorf("Got %s %q, expected %q", k, counts[k], v)
+			}
+		}
+		if total != 3 {
+			t.Errorf("Got %d jobs, expected 3", total)
+		}
+		if _, total := s.Counts(""); total != 4 {
+			t.Errorf("Got %d jobs in all tubes, expected 4", total)
+		}
+	})
+}
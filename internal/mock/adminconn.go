@@ -0,0 +1,34 @@
+package mock
+
+type AdminConn struct {
+	DeleteFunc     func(id uint64) error
+	KickJobFunc    func(id uint64) error
+	PeekFunc       func(id uint64) ([]byte, error)
+	PeekBuriedFunc func(tube string) (uint64, []byte, error)
+	StatsJobFunc   func(id uint64) (map[string]string, error)
+	StatsTubeFunc  func(tube string) (map[string]string, error)
+}
+
+func (c *AdminConn) Delete(id uint64) error {
+	return c.DeleteFunc(id)
+}
+
+func (c *AdminConn) KickJob(id uint64) error {
+	return c.KickJobFunc(id)
+}
+
+func (c *AdminConn) Peek(id uint64) ([]byte, error) {
+	return c.PeekFunc(id)
+}
+
+func (c *AdminConn) PeekBuried(tube string) (uint64, []byte, error) {
+	return c.PeekBuriedFunc(tube)
+}
+
+func (c *AdminConn) StatsJob(id uint64) (map[string]string, error) {
+	return c.StatsJobFunc(id)
+}
+
+func (c *AdminConn) StatsTube(tube string) (map[string]string, error) {
+	return c.StatsTubeFunc(tube)
+}
@@ -0,0 +1,15 @@
+package mock
+
+import (
+	"context"
+
+	"github.com/epels/birdbroker-go"
+)
+
+type CallbackSender struct {
+	SendCallbackFunc func(cb *birdbroker.Callback) error
+}
+
+func (s *CallbackSender) SendCallback(ctx context.Context, cb *birdbroker.Callback) error {
+	return s.SendCallbackFunc(cb)
+}
@@ -3,10 +3,11 @@ package mock
 import "time"
 
 type ConsumerConn struct {
-	BuryFunc    func(id uint64, pri uint32) error
-	DeleteFunc  func(id uint64) error
-	ReleaseFunc func(id uint64, pri uint32, delay time.Duration) error
-	ReserveFunc func(timeout time.Duration) (id uint64, body []byte, err error)
+	BuryFunc     func(id uint64, pri uint32) error
+	DeleteFunc   func(id uint64) error
+	ReleaseFunc  func(id uint64, pri uint32, delay time.Duration) error
+	ReserveFunc  func(timeout time.Duration) (id uint64, body []byte, err error)
+	StatsJobFunc func(id uint64) (map[string]string, error)
 }
 
 func (c *ConsumerConn) Bury(id uint64, pri uint32) error {
@@ -24,3 +25,7 @@ func (c *ConsumerConn) Release(id uint64, pri uint32, delay time.Duration) error
 func (c *ConsumerConn) Reserve(timeout time.Duration) (id uint64, body []byte, err error) {
 	return c.ReserveFunc(timeout)
 }
+
+func (c *ConsumerConn) StatsJob(id uint64) (map[string]string, error) {
+	return c.StatsJobFunc(id)
+}
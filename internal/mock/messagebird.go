@@ -0,0 +1,16 @@
+package mock
+
+import (
+	"context"
+
+	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/messagebird"
+)
+
+type MessageBird struct {
+	SendMessageFunc func(m *birdbroker.Message) ([]*messagebird.Message, error)
+}
+
+func (mb *MessageBird) SendMessage(ctx context.Context, m *birdbroker.Message) ([]*messagebird.Message, error) {
+	return mb.SendMessageFunc(m)
+}
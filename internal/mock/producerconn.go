@@ -3,7 +3,12 @@ package mock
 import "time"
 
 type ProducerConn struct {
-	PutFunc func(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error)
+	DeleteFunc func(id uint64) error
+	PutFunc    func(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error)
+}
+
+func (c *ProducerConn) Delete(id uint64) error {
+	return c.DeleteFunc(id)
 }
 
 func (c *ProducerConn) Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
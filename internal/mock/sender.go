@@ -7,9 +7,19 @@ import (
 )
 
 type Sender struct {
-	SendFunc func(m *birdbroker.Message) error
+	CancelFunc    func(id uint64) error
+	SendFunc      func(m *birdbroker.Message) (uint64, error)
+	SendBatchFunc func(ms []*birdbroker.Message) ([]uint64, []error)
 }
 
-func (s *Sender) Send(ctx context.Context, m *birdbroker.Message) error {
+func (s *Sender) Cancel(ctx context.Context, id uint64) error {
+	return s.CancelFunc(id)
+}
+
+func (s *Sender) Send(ctx context.Context, m *birdbroker.Message) (uint64, error) {
 	return s.SendFunc(m)
 }
+
+func (s *Sender) SendBatch(ctx context.Context, ms []*birdbroker.Message) ([]uint64, []error) {
+	return s.SendBatchFunc(ms)
+}
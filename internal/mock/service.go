@@ -7,9 +7,36 @@ import (
 )
 
 type Service struct {
-	SendMessageFunc func(*birdbroker.Message) error
+	CancelMessageFunc func(id string) (*birdbroker.Record, error)
+	GetMessageFunc    func(id string) (*birdbroker.Record, error)
+	SendMessageFunc   func(*birdbroker.Message) (*birdbroker.Record, error)
+	SendMessagesFunc  func(ms []*birdbroker.Message) []birdbroker.BatchResult
+
+	SendMessageIdempotentFunc func(key string, m *birdbroker.Message) (*birdbroker.Record, error)
+
+	UpdateDeliveryStatusFunc func(dr *birdbroker.DeliveryReport) error
+}
+
+func (s *Service) CancelMessage(ctx context.Context, id string) (*birdbroker.Record, error) {
+	return s.CancelMessageFunc(id)
+}
+
+func (s *Service) GetMessage(ctx context.Context, id string) (*birdbroker.Record, error) {
+	return s.GetMessageFunc(id)
 }
 
-func (s *Service) SendMessage(ctx context.Context, m *birdbroker.Message) error {
+func (s *Service) SendMessage(ctx context.Context, m *birdbroker.Message) (*birdbroker.Record, error) {
 	return s.SendMessageFunc(m)
 }
+
+func (s *Service) UpdateDeliveryStatus(ctx context.Context, dr *birdbroker.DeliveryReport) error {
+	return s.UpdateDeliveryStatusFunc(dr)
+}
+
+func (s *Service) SendMessages(ctx context.Context, ms []*birdbroker.Message) []birdbroker.BatchResult {
+	return s.SendMessagesFunc(ms)
+}
+
+func (s *Service) SendMessageIdempotent(ctx context.Context, key string, m *birdbroker.Message) (*birdbroker.Record, error) {
+	return s.SendMessageIdempotentFunc(key, m)
+}
@@ -0,0 +1,61 @@
+package mock
+
+import (
+	"context"
+
+	"github.com/epels/birdbroker-go"
+)
+
+type Store struct {
+	CreateFunc func(r *birdbroker.Record) error
+	GetFunc    func(id string) (*birdbroker.Record, error)
+	UpdateFunc func(id string, fn func(r *birdbroker.Record) error) error
+}
+
+func (s *Store) Create(ctx context.Context, r *birdbroker.Record) error {
+	return s.CreateFunc(r)
+}
+
+func (s *Store) Get(ctx context.Context, id string) (*birdbroker.Record, error) {
+	return s.GetFunc(id)
+}
+
+func (s *Store) Update(ctx context.Context, id string, fn func(r *birdbroker.Record) error) error {
+	return s.UpdateFunc(id, fn)
+}
+
+type KeyStore struct {
+	PutKeyFunc    func(k *birdbroker.IdempotencyKey) (*birdbroker.IdempotencyKey, error)
+	DeleteKeyFunc func(key string) error
+}
+
+func (s *KeyStore) PutKey(ctx context.Context, k *birdbroker.IdempotencyKey) (*birdbroker.IdempotencyKey, error) {
+	return s.PutKeyFunc(k)
+}
+
+func (s *KeyStore) DeleteKey(ctx context.Context, key string) error {
+	return s.DeleteKeyFunc(key)
+}
+
+type BuryStore struct {
+	DeleteBuryRecordFunc func(tube string, jobID uint64) error
+	GetBuryRecordFunc    func(tube string, jobID uint64) (*birdbroker.BuryRecord, error)
+	ListBuryRecordsFunc  func(tube string) ([]*birdbroker.BuryRecord, error)
+	PutBuryRecordFunc    func(br *birdbroker.BuryRecord) error
+}
+
+func (s *BuryStore) DeleteBuryRecord(ctx context.Context, tube string, jobID uint64) error {
+	return s.DeleteBuryRecordFunc(tube, jobID)
+}
+
+func (s *BuryStore) GetBuryRecord(ctx context.Context, tube string, jobID uint64) (*birdbroker.BuryRecord, error) {
+	return s.GetBuryRecordFunc(tube, jobID)
+}
+
+func (s *BuryStore) ListBuryRecords(ctx context.Context, tube string) ([]*birdbroker.BuryRecord, error) {
+	return s.ListBuryRecordsFunc(tube)
+}
+
+func (s *BuryStore) PutBuryRecord(ctx context.Context, br *birdbroker.BuryRecord) error {
+	return s.PutBuryRecordFunc(br)
+}
@@ -1,23 +1,104 @@
 package birdbroker
 
 import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
+// Priority tells how urgent a message is. Messages with a higher priority
+// are sent before those with a lower one.
+type Priority string
+
+const (
+	// PriorityOTP is for one-time passwords and other messages that are
+	// useless if they arrive late.
+	PriorityOTP Priority = "otp"
+	// PriorityTransactional is for messages triggered by an action of the
+	// recipient. It is the default.
+	PriorityTransactional Priority = "transactional"
+	// PriorityBulk is for marketing and other mass messaging.
+	PriorityBulk Priority = "bulk"
+)
+
 type Message struct {
-	Body       string
-	Originator string
-	Recipient  string
+	// ID is assigned when a message is accepted. Any ID set by the caller
+	// is overwritten.
+	ID         string `json:"id,omitempty"`
+	Body       string `json:"body"`
+	Originator string `json:"originator"`
+	Recipient  string `json:"recipient,omitempty"`
+
+	// Recipients lists more recipients of the message. It may be combined
+	// with Recipient.
+	Recipients []string `json:"recipients,omitempty"`
+
+	Priority Priority `json:"priority,omitempty"`
+
+	// ScheduledAt is the time the message is to be sent at. If not set, it
+	// is sent right away.
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+
+	// CallbackURL is notified of every status transition of the message, if
+	// set.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// MaxRecipients is the maximum number of recipients of a single message.
+const MaxRecipients = 1000
+
+// MaxScheduleHorizon is how far ahead a message can be scheduled.
+const MaxScheduleHorizon = 30 * 24 * time.Hour
+
+// AllRecipients returns Recipient and Recipients combined, without
+// duplicates.
+func (m *Message) AllRecipients() []string {
+	rs := make([]string, 0, len(m.Recipients)+1)
+	seen := make(map[string]bool, len(m.Recipients)+1)
+	for _, r := range append([]string{m.Recipient}, m.Recipients...) {
+		if r == "" || seen[NormalizeRecipient(r)] {
+			continue
+		}
+		seen[NormalizeRecipient(r)] = true
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// NormalizeRecipient strips the formatting from the phone number r, such as
+// a leading plus sign or spaces, so it can be compared to the recipients
+// MessageBird reports.
+func NormalizeRecipient(r string) string {
+	return strings.Map(func(c rune) rune {
+		switch c {
+		case '+', ' ', '-', '(', ')':
+			return -1
+		}
+		return c
+	}, r)
 }
 
 func (m *Message) Validate() error {
 	if m.Body == "" {
 		return ClientError{Reason: "Missing body"}
 	}
-	if rc := utf8.RuneCountInString(m.Recipient); rc < 1 || rc > 15 {
+	if m.Recipient == "" && len(m.Recipients) == 0 {
+		return ClientError{Reason: "Missing recipient"}
+	}
+	if utf8.RuneCountInString(m.Recipient) > 15 {
 		return ClientError{Reason: "Recipient length must be 1-15 chars"}
 	}
+	for _, r := range m.Recipients {
+		if rc := utf8.RuneCountInString(r); rc < 1 || rc > 15 {
+			return ClientError{Reason: "Recipient length must be 1-15 chars"}
+		}
+	}
+	if len(m.AllRecipients()) > MaxRecipients {
+		return ClientError{Reason: fmt.Sprintf("Message must not have more than %d recipients", MaxRecipients)}
+	}
 	if !isNumeric(m.Originator) {
 		if rc := utf8.RuneCountInString(m.Originator); rc > 11 {
 			return ClientError{Reason: "Alphanumeric originator must not be <11 chars"}
@@ -26,6 +107,26 @@ func (m *Message) Validate() error {
 	if m.Originator == "" {
 		return ClientError{Reason: "Missing originator"}
 	}
+	switch m.Priority {
+	case "", PriorityOTP, PriorityTransactional, PriorityBulk:
+	default:
+		return ClientError{Reason: "Priority must be one of otp, transactional or bulk"}
+	}
+	if m.ScheduledAt != nil {
+		now := time.Now()
+		if m.ScheduledAt.Before(now) {
+			return ClientError{Reason: "Scheduled time must not be in the past"}
+		}
+		if m.ScheduledAt.After(now.Add(MaxScheduleHorizon)) {
+			return ClientError{Reason: fmt.Sprintf("Scheduled time must be within %d days", MaxScheduleHorizon/(24*time.Hour))}
+		}
+	}
+	if m.CallbackURL != "" {
+		u, err := url.Parse(m.CallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ClientError{Reason: "Callback URL must be an absolute HTTP(S) URL"}
+		}
+	}
 	return nil
 }
 
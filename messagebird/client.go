@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/epels/birdbroker-go"
@@ -15,61 +16,206 @@ import (
 
 const defaultBaseURL = "https://rest.messagebird.com"
 
+const (
+	defaultTimeout   = 5 * time.Second
+	defaultUserAgent = "birdbroker-go"
+)
+
 type client struct {
-	accessKey, baseURL string
-	httpClient         *http.Client
+	accessKey, baseURL, reportURL, userAgent string
+	httpClient                               *http.Client
+}
+
+// Option configures a client created by NewClient.
+type Option func(o *options)
+
+type options struct {
+	baseURL, reportURL, userAgent string
+	httpClient                    *http.Client
+	timeout                       time.Duration
+	transport                     http.RoundTripper
+}
+
+// WithBaseURL sets the URL the MessageBird API is reached at, for instance to
+// use a regional endpoint or a local stub.
+func WithBaseURL(u string) Option {
+	return func(o *options) {
+		o.baseURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to make requests. It is not
+// modified: WithTimeout and WithTransport apply to a copy.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = hc
+	}
+}
+
+// WithReportURL sets the URL MessageBird sends status reports for every
+// message to, overriding the URL configured for the account.
+func WithReportURL(u string) Option {
+	return func(o *options) {
+		o.reportURL = u
+	}
+}
+
+// WithTimeout sets the time limit for requests, including reading the
+// response body.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithTransport sets the transport used to make requests.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = rt
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every request.
+func WithUserAgent(ua string) Option {
+	return func(o *options) {
+		o.userAgent = ua
+	}
 }
 
 // NewClient creates a new MessageBird client with access key ak.
-func NewClient(ak string) *client {
-	return &client{
-		accessKey: ak,
+func NewClient(ak string, opts ...Option) *client {
+	o := options{
 		baseURL:   defaultBaseURL,
-		httpClient: &http.Client{
-			Timeout: 5 * time.Second,
-		},
+		userAgent: defaultUserAgent,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var hc http.Client
+	if o.httpClient != nil {
+		hc = *o.httpClient
+	} else {
+		hc.Timeout = defaultTimeout
+	}
+	if o.timeout != 0 {
+		hc.Timeout = o.timeout
+	}
+	if o.transport != nil {
+		hc.Transport = o.transport
+	}
+
+	return &client{
+		accessKey:  ak,
+		baseURL:    o.baseURL,
+		reportURL:  o.reportURL,
+		userAgent:  o.userAgent,
+		httpClient: &hc,
+	}
+}
+
+// maxRecipients is the maximum number of recipients MessageBird accepts in a
+// single request.
+const maxRecipients = 50
+
+// SendMessage sends m through the MessageBird API, and returns the message
+// resources that were created. The recipients of m are split into requests
+// of at most 50 recipients, each creating a message resource of its own.
+//
+// If a request fails, SendMessage stops and returns the resources created so
+// far along with the error, so the caller knows which recipients the message
+// was sent to.
+func (c *client) SendMessage(ctx context.Context, m *birdbroker.Message) ([]*Message, error) {
+	rs := m.AllRecipients()
+	mbms := make([]*Message, 0, (len(rs)+maxRecipients-1)/maxRecipients)
+	for len(rs) > 0 {
+		n := len(rs)
+		if n > maxRecipients {
+			n = maxRecipients
+		}
+		mbm, err := c.sendMessage(ctx, m, rs[:n])
+		if err != nil {
+			return mbms, err
+		}
+		mbms = append(mbms, mbm)
+		rs = rs[n:]
 	}
+	return mbms, nil
 }
 
-func (c *client) SendMessage(ctx context.Context, m *birdbroker.Message) error {
+// sendMessage sends m to recipients rs in a single request.
+func (c *client) sendMessage(ctx context.Context, m *birdbroker.Message, rs []string) (*Message, error) {
+	// Our message ID is passed as reference, so status reports can be
+	// related to the message they are about.
 	data := struct {
 		Body       string `json:"body"`
 		Originator string `json:"originator"`
 		Recipients string `json:"recipients"`
+		Reference  string `json:"reference,omitempty"`
+		ReportURL  string `json:"reportUrl,omitempty"`
+		// ScheduledDatetime is set for messages that are still to be sent
+		// in the future: MessageBird holds on to these until then.
+		ScheduledDatetime string `json:"scheduledDatetime,omitempty"`
 	}{
 		Body:       m.Body,
 		Originator: m.Originator,
-		Recipients: m.Recipient,
+		Recipients: strings.Join(rs, ","),
+		Reference:  m.ID,
+		ReportURL:  c.reportURL,
+	}
+	if m.ScheduledAt != nil && m.ScheduledAt.After(time.Now()) {
+		data.ScheduledDatetime = m.ScheduledAt.Format(time.RFC3339)
 	}
 	b, err := json.Marshal(data)
 	if err != nil {
-		return fmt.Errorf("encoding/json: Marshal: %s", err)
+		return nil, fmt.Errorf("encoding/json: Marshal: %s", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/messages", bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/messages", bytes.NewReader(b))
 	if err != nil {
-		return fmt.Errorf("net/http: NewRequest: %s", err)
+		return nil, fmt.Errorf("net/http: NewRequestWithContext: %s", err)
 	}
 	req.Header.Set("Authorization", "AccessKey "+c.accessKey)
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
 
 	res, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("net/http: Client.Do: %s", err)
+		return nil, fmt.Errorf("net/http: Client.Do: %w", err)
 	}
 	defer func() {
-		// Just close the body: relying on status code for now.
 		if err := res.Body.Close(); err != nil {
 			log.Printf("%T: Close: %s", res.Body, err)
 		}
 	}()
 
 	if res.StatusCode != http.StatusCreated {
-		b, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			log.Printf("io/ioutil: ReadAll: %s", err)
-		}
-		return fmt.Errorf("unexpected status code (%d) from MessageBird API with error: %s", res.StatusCode, b)
+		return nil, newAPIError(res)
+	}
+
+	var mbm Message
+	if err := json.NewDecoder(res.Body).Decode(&mbm); err != nil {
+		return nil, fmt.Errorf("encoding/json: Decoder.Decode: %s", err)
+	}
+	return &mbm, nil
+}
+
+// newAPIError creates an APIError from the error response res. A body that
+// can't be decoded is logged, as it still has some diagnostic value.
+func newAPIError(res *http.Response) *APIError {
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("io/ioutil: ReadAll: %s", err)
+	}
+
+	var data struct {
+		Errors []ErrorDetail `json:"errors"`
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		log.Printf("Undecodable error response from MessageBird API: %s", b)
+	}
+	return &APIError{
+		StatusCode: res.StatusCode,
+		Errors:     data.Errors,
 	}
-	return nil
 }
@@ -3,9 +3,14 @@ package messagebird
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/epels/birdbroker-go"
 )
@@ -16,19 +21,32 @@ func TestSendMessage(t *testing.T) {
 		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			called = true
 
-			w.WriteHeader(http.StatusForbidden)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"errors":[{"code":10,"description":"no (correct) recipients found","parameter":"recipients"}]}`))
 		}))
 
-		c := NewClient("")
-		c.baseURL = ts.URL
+		c := NewClient("", WithBaseURL(ts.URL))
 
-		err := c.SendMessage(context.Background(), &birdbroker.Message{
+		_, err := c.SendMessage(context.Background(), &birdbroker.Message{
 			Body:       "Hello",
 			Originator: "Foo Inc",
 			Recipient:  "31612345678",
 		})
-		if err == nil {
-			t.Errorf("Got nil, expected error")
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("Got %T, expected *APIError", err)
+		}
+		if apiErr.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("Got %d, expected 422", apiErr.StatusCode)
+		}
+		if len(apiErr.Errors) != 1 {
+			t.Fatalf("Got %d, expected 1", len(apiErr.Errors))
+		}
+		if d := apiErr.Errors[0]; d.Code != CodeInvalidParams || d.Parameter != "recipients" {
+			t.Errorf("Got %+v, expected code 10 for parameter recipients", d)
+		}
+		if apiErr.Temporary() {
+			t.Errorf("Got true, expected false")
 		}
 		if !called {
 			t.Errorf("Got false, expected true")
@@ -46,6 +64,9 @@ func TestSendMessage(t *testing.T) {
 			if auth := r.Header.Get("Authorization"); auth != "AccessKey Secret" {
 				t.Errorf("Got %q, expected AccessKey Secret", auth)
 			}
+			if ua := r.Header.Get("User-Agent"); ua != "test/1.0" {
+				t.Errorf("Got %q, expected test/1.0", ua)
+			}
 			if r.Method != http.MethodPost {
 				t.Errorf("Got %q, expected POST", r.Method)
 			}
@@ -57,6 +78,8 @@ func TestSendMessage(t *testing.T) {
 				Body       string
 				Originator string
 				Recipients string
+				Reference  string
+				ReportURL  string
 			}
 			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 				t.Fatalf("encoding/json: Decoder.Decode: %s", err)
@@ -70,23 +93,214 @@ func TestSendMessage(t *testing.T) {
 			if data.Recipients != "31612345678" {
 				t.Errorf("Got %q, expected 31612345678", data.Recipients[0])
 			}
+			if data.Reference != "abc123" {
+				t.Errorf("Got %q, expected abc123", data.Reference)
+			}
+			if data.ReportURL != "https://example.com/status" {
+				t.Errorf("Got %q, expected https://example.com/status", data.ReportURL)
+			}
 
 			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{
+	"id": "mb-1",
+	"href": "https://rest.messagebird.com/messages/mb-1",
+	"direction": "mt",
+	"type": "sms",
+	"originator": "Foo Inc",
+	"body": "Hello",
+	"createdDatetime": "2019-10-01T12:00:00+00:00",
+	"recipients": {
+		"totalCount": 1,
+		"totalSentCount": 1,
+		"totalDeliveredCount": 0,
+		"totalDeliveryFailedCount": 0,
+		"items": [
+			{
+				"recipient": 31612345678,
+				"status": "sent",
+				"statusDatetime": "2019-10-01T12:00:00+00:00",
+				"messagePartCount": 1
+			}
+		]
+	}
+}`))
 		}))
 
-		c := NewClient("Secret")
-		c.baseURL = ts.URL
+		c := NewClient("Secret",
+			WithBaseURL(ts.URL+"/"),
+			WithReportURL("https://example.com/status"),
+			WithUserAgent("test/1.0"),
+		)
 
-		err := c.SendMessage(context.Background(), &birdbroker.Message{
+		mbms, err := c.SendMessage(context.Background(), &birdbroker.Message{
+			ID:         "abc123",
 			Body:       "Hello",
 			Originator: "Foo Inc",
 			Recipient:  "31612345678",
 		})
 		if err != nil {
-			t.Errorf("Client: Send: %s", err)
+			t.Fatalf("Client: Send: %s", err)
+		}
+		if len(mbms) != 1 {
+			t.Fatalf("Got %d, expected 1", len(mbms))
+		}
+		mbm := mbms[0]
+		if mbm.ID != "mb-1" {
+			t.Errorf("Got %q, expected mb-1", mbm.ID)
+		}
+		if mbm.CreatedDatetime == nil || mbm.CreatedDatetime.Year() != 2019 {
+			t.Errorf("Got %v, expected 2019-10-01T12:00:00Z", mbm.CreatedDatetime)
+		}
+		if mbm.Recipients.TotalSentCount != 1 {
+			t.Errorf("Got %d, expected 1", mbm.Recipients.TotalSentCount)
+		}
+		if len(mbm.Recipients.Items) != 1 {
+			t.Fatalf("Got %d, expected 1", len(mbm.Recipients.Items))
+		}
+		if r := mbm.Recipients.Items[0]; r.Recipient != 31612345678 || r.Status != "sent" {
+			t.Errorf("Got %+v, expected 31612345678 with status sent", r)
 		}
 		if !called {
 			t.Errorf("Got false, expected true")
 		}
 	})
 }
+
+func TestSendMessageChunks(t *testing.T) {
+	var calls []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			Recipients string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Fatalf("encoding/json: Decoder.Decode: %s", err)
+		}
+		calls = append(calls, data.Recipients)
+
+		if len(calls) == 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id":"mb-%d"}`, len(calls))
+	}))
+	defer ts.Close()
+
+	rs := make([]string, 120)
+	for i := range rs {
+		rs[i] = strconv.Itoa(31600000000 + i)
+	}
+	c := NewClient("", WithBaseURL(ts.URL))
+
+	mbms, err := c.SendMessage(context.Background(), &birdbroker.Message{
+		Body:       "Hello",
+		Originator: "Foo Inc",
+		Recipients: rs,
+	})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Got %T, expected *APIError", err)
+	}
+	if len(calls) != 3 {
+		t.Fatalf("Got %d, expected 3", len(calls))
+	}
+	if exp := strings.Join(rs[:50], ","); calls[0] != exp {
+		t.Errorf("Got %q, expected %q", calls[0], exp)
+	}
+	if exp := strings.Join(rs[50:100], ","); calls[1] != exp {
+		t.Errorf("Got %q, expected %q", calls[1], exp)
+	}
+	if exp := strings.Join(rs[100:], ","); calls[2] != exp {
+		t.Errorf("Got %q, expected %q", calls[2], exp)
+	}
+	// The resources created before the failure are returned.
+	if len(mbms) != 2 {
+		t.Fatalf("Got %d, expected 2", len(mbms))
+	}
+	if mbms[0].ID != "mb-1" || mbms[1].ID != "mb-2" {
+		t.Errorf("Got %q and %q, expected mb-1 and mb-2", mbms[0].ID, mbms[1].ID)
+	}
+}
+
+func TestSendMessageScheduled(t *testing.T) {
+	at := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	var scheduled string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			ScheduledDatetime string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Fatalf("encoding/json: Decoder.Decode: %s", err)
+		}
+		scheduled = data.ScheduledDatetime
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"mb-1"}`))
+	}))
+	defer ts.Close()
+
+	c := NewClient("", WithBaseURL(ts.URL))
+
+	_, err := c.SendMessage(context.Background(), &birdbroker.Message{
+		Body:        "Hello",
+		Originator:  "Foo Inc",
+		Recipient:   "31612345678",
+		ScheduledAt: &at,
+	})
+	if err != nil {
+		t.Fatalf("SendMessage: %s", err)
+	}
+	if exp := at.Format(time.RFC3339); scheduled != exp {
+		t.Errorf("Got %q, expected %q", scheduled, exp)
+	}
+}
+
+func TestSendMessageContext(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	c := NewClient("", WithBaseURL(ts.URL))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.SendMessage(ctx, &birdbroker.Message{
+		Body:       "Hello",
+		Originator: "Foo Inc",
+		Recipient:  "31612345678",
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Got %v, expected context.Canceled", err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		c := NewClient("Secret")
+		if c.baseURL != defaultBaseURL {
+			t.Errorf("Got %q, expected %q", c.baseURL, defaultBaseURL)
+		}
+		if c.httpClient.Timeout != defaultTimeout {
+			t.Errorf("Got %s, expected %s", c.httpClient.Timeout, defaultTimeout)
+		}
+	})
+
+	t.Run("Custom HTTP client", func(t *testing.T) {
+		hc := &http.Client{Timeout: time.Minute}
+		tr := &http.Transport{}
+		c := NewClient("Secret", WithHTTPClient(hc), WithTimeout(time.Second), WithTransport(tr))
+
+		if c.httpClient.Timeout != time.Second {
+			t.Errorf("Got %s, expected 1s", c.httpClient.Timeout)
+		}
+		if c.httpClient.Transport != tr {
+			t.Errorf("Got %v, expected custom transport", c.httpClient.Transport)
+		}
+		if hc.Timeout != time.Minute {
+			t.Errorf("Got %s, expected HTTP client to be left untouched", hc.Timeout)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package messagebird
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error codes returned by the MessageBird API, see
+// https://developers.messagebird.com/api/#errors.
+const (
+	CodeRequestNotAllowed   = 2
+	CodeMissingParams       = 9
+	CodeInvalidParams       = 10
+	CodeNotFound            = 20
+	CodeBadRequest          = 21
+	CodeNotEnoughBalance    = 25
+	CodeAPINotFound         = 98
+	CodeInternalServerError = 99
+)
+
+// ErrorDetail is a single error reported by the MessageBird API.
+type ErrorDetail struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+	Parameter   string `json:"parameter"`
+}
+
+// APIError is returned when the MessageBird API responds with an unexpected
+// status code. Errors holds the details from the response body, if any.
+type APIError struct {
+	StatusCode int
+	Errors     []ErrorDetail
+}
+
+func (e *APIError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("unexpected status code (%d) from MessageBird API", e.StatusCode)
+	}
+
+	details := make([]string, len(e.Errors))
+	for i, d := range e.Errors {
+		if d.Parameter != "" {
+			details[i] = fmt.Sprintf("%s (code %d, parameter %s)", d.Description, d.Code, d.Parameter)
+		} else {
+			details[i] = fmt.Sprintf("%s (code %d)", d.Description, d.Code)
+		}
+	}
+	return fmt.Sprintf("unexpected status code (%d) from MessageBird API with error: %s", e.StatusCode, strings.Join(details, "; "))
+}
+
+// Temporary reports whether sending the same request again may succeed. This
+// holds for server errors and rate limiting, but also for errors that are
+// resolved by an operator rather than by changing the message, such as an
+// invalid access key or an insufficient balance.
+func (e *APIError) Temporary() bool {
+	if e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden {
+		return true
+	}
+	for _, d := range e.Errors {
+		switch d.Code {
+		case CodeRequestNotAllowed, CodeNotEnoughBalance, CodeInternalServerError:
+			return true
+		}
+	}
+	return false
+}
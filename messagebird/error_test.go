@@ -0,0 +1,62 @@
+package messagebird
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAPIError(t *testing.T) {
+	tt := []struct {
+		name      string
+		err       APIError
+		temporary bool
+	}{
+		{
+			"Invalid recipient",
+			APIError{
+				StatusCode: http.StatusUnprocessableEntity,
+				Errors: []ErrorDetail{
+					{Code: CodeInvalidParams, Description: "no (correct) recipients found", Parameter: "recipients"},
+				},
+			},
+			false,
+		},
+		{
+			"Service unavailable",
+			APIError{StatusCode: http.StatusServiceUnavailable},
+			true,
+		},
+		{
+			"Rate limited",
+			APIError{StatusCode: http.StatusTooManyRequests},
+			true,
+		},
+		{
+			"Invalid access key",
+			APIError{
+				StatusCode: http.StatusUnauthorized,
+				Errors: []ErrorDetail{
+					{Code: CodeRequestNotAllowed, Description: "Request not allowed (incorrect access_key)"},
+				},
+			},
+			true,
+		},
+		{
+			"Not enough balance",
+			APIError{
+				StatusCode: http.StatusPaymentRequired,
+				Errors: []ErrorDetail{
+					{Code: CodeNotEnoughBalance, Description: "Not enough balance"},
+				},
+			},
+			true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tmp := tc.err.Temporary(); tmp != tc.temporary {
+				t.Errorf("Got %t, expected %t", tmp, tc.temporary)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package messagebird
+
+import "time"
+
+// Message is the message resource returned by the MessageBird API, see
+// https://developers.messagebird.com/api/sms-messaging/#the-message-object.
+type Message struct {
+	ID                string     `json:"id"`
+	Href              string     `json:"href"`
+	Direction         string     `json:"direction"`
+	Type              string     `json:"type"`
+	Originator        string     `json:"originator"`
+	Body              string     `json:"body"`
+	Reference         string     `json:"reference"`
+	Validity          *int       `json:"validity"`
+	Gateway           int        `json:"gateway"`
+	DataCoding        string     `json:"datacoding"`
+	MClass            int        `json:"mclass"`
+	ScheduledDatetime *time.Time `json:"scheduledDatetime"`
+	CreatedDatetime   *time.Time `json:"createdDatetime"`
+	Recipients        Recipients `json:"recipients"`
+}
+
+// Recipients summarizes the recipients of a message.
+type Recipients struct {
+	TotalCount               int         `json:"totalCount"`
+	TotalSentCount           int         `json:"totalSentCount"`
+	TotalDeliveredCount      int         `json:"totalDeliveredCount"`
+	TotalDeliveryFailedCount int         `json:"totalDeliveryFailedCount"`
+	Items                    []Recipient `json:"items"`
+}
+
+// Recipient is the status of a message for a single recipient.
+type Recipient struct {
+	Recipient        int64      `json:"recipient"`
+	Status           string     `json:"status"`
+	StatusDatetime   *time.Time `json:"statusDatetime"`
+	MessagePartCount int        `json:"messagePartCount"`
+	Price            *Price     `json:"price,omitempty"`
+}
+
+// Price is the cost of sending a message to a single recipient. It is only
+// reported for some accounts.
+type Price struct {
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+}
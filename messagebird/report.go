@@ -0,0 +1,58 @@
+package messagebird
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Statuses reported for a recipient of a message.
+const (
+	StatusScheduled      = "scheduled"
+	StatusSent           = "sent"
+	StatusBuffered       = "buffered"
+	StatusDelivered      = "delivered"
+	StatusExpired        = "expired"
+	StatusDeliveryFailed = "delivery_failed"
+)
+
+// StatusReport is sent by MessageBird when the status of a message changes
+// for one of its recipients.
+type StatusReport struct {
+	// ID is the MessageBird message ID.
+	ID string
+	// Reference is the client reference the message was sent with.
+	Reference      string
+	Recipient      string
+	Status         string
+	StatusDatetime time.Time
+	StatusReason   string
+}
+
+// ParseStatusReport reads a status report from the query string or form
+// values of r.
+func ParseStatusReport(r *http.Request) (*StatusReport, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("%T: ParseForm: %s", r, err)
+	}
+
+	sr := StatusReport{
+		ID:           r.Form.Get("id"),
+		Reference:    r.Form.Get("reference"),
+		Recipient:    r.Form.Get("recipient"),
+		Status:       r.Form.Get("status"),
+		StatusReason: r.Form.Get("statusReason"),
+	}
+	if sr.ID == "" || sr.Recipient == "" || sr.Status == "" {
+		return nil, fmt.Errorf("status report is missing id, recipient or status")
+	}
+
+	if dt := r.Form.Get("statusDatetime"); dt != "" {
+		t, err := time.Parse(time.RFC3339, dt)
+		if err != nil {
+			return nil, fmt.Errorf("time: Parse: %s", err)
+		}
+		sr.StatusDatetime = t
+	}
+	return &sr, nil
+}
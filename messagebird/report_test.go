@@ -0,0 +1,37 @@
+package messagebird
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseStatusReport(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/status?id=mb-1&reference=abc&recipient=31612345678&status=delivered&statusDatetime=2019-10-01T12:00:00%2B00:00", nil)
+
+		sr, err := ParseStatusReport(r)
+		if err != nil {
+			t.Fatalf("ParseStatusReport: %s", err)
+		}
+		if sr.ID != "mb-1" {
+			t.Errorf("Got %q, expected mb-1", sr.ID)
+		}
+		if sr.Reference != "abc" {
+			t.Errorf("Got %q, expected abc", sr.Reference)
+		}
+		if sr.Status != StatusDelivered {
+			t.Errorf("Got %q, expected delivered", sr.Status)
+		}
+		if sr.StatusDatetime.Year() != 2019 {
+			t.Errorf("Got %s, expected 2019-10-01T12:00:00Z", sr.StatusDatetime)
+		}
+	})
+
+	t.Run("Missing fields", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/status?id=mb-1", nil)
+		if _, err := ParseStatusReport(r); err == nil {
+			t.Errorf("Got nil, expected error")
+		}
+	})
+}
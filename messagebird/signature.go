@@ -0,0 +1,71 @@
+package messagebird
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	signatureHeader = "MessageBird-Signature"
+	timestampHeader = "MessageBird-Request-Timestamp"
+
+	// maxSignatureAge bounds how old a signed request may be, to limit
+	// replays.
+	maxSignatureAge = 5 * time.Minute
+)
+
+// ErrInvalidSignature is returned when a request does not carry a valid
+// MessageBird signature.
+var ErrInvalidSignature = errors.New("invalid MessageBird request signature")
+
+// VerifySignature checks that r was signed by MessageBird with signing key
+// key, and was signed recently. The body of r is read, but replaced so it can
+// be read again by the caller.
+//
+// See https://developers.messagebird.com/api/#verifying-http-requests.
+func VerifySignature(r *http.Request, key string) error {
+	sig, err := base64.StdEncoding.DecodeString(r.Header.Get(signatureHeader))
+	if err != nil || len(sig) == 0 {
+		return ErrInvalidSignature
+	}
+
+	ts := r.Header.Get(timestampHeader)
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		return ErrInvalidSignature
+	}
+
+	var body []byte
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return fmt.Errorf("io/ioutil: ReadAll: %s", err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	if !hmac.Equal(sig, sign(key, ts, r.URL.Query().Encode(), body)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// sign calculates the signature of a request with timestamp ts, query string
+// query and body body.
+func sign(key, ts, query string, body []byte) []byte {
+	bh := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s", ts, query, bh[:])
+	return mac.Sum(nil)
+}
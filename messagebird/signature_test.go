@@ -0,0 +1,62 @@
+package messagebird
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	newRequest := func(key string, ts time.Time, body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/status?status=delivered&id=abc", strings.NewReader(body))
+
+		unix := strconv.FormatInt(ts.Unix(), 10)
+		sig := sign(key, unix, "id=abc&status=delivered", []byte(body))
+		r.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(sig))
+		r.Header.Set(timestampHeader, unix)
+		return r
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		r := newRequest("secret", time.Now(), "hello")
+		if err := VerifySignature(r, "secret"); err != nil {
+			t.Fatalf("VerifySignature: %s", err)
+		}
+
+		// The body must still be readable.
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("io/ioutil: ReadAll: %s", err)
+		}
+		if string(b) != "hello" {
+			t.Errorf("Got %q, expected hello", b)
+		}
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		r := newRequest("other", time.Now(), "hello")
+		if err := VerifySignature(r, "secret"); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Got %v, expected ErrInvalidSignature", err)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		r := newRequest("secret", time.Now().Add(-time.Hour), "hello")
+		if err := VerifySignature(r, "secret"); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Got %v, expected ErrInvalidSignature", err)
+		}
+	})
+
+	t.Run("Missing headers", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if err := VerifySignature(r, "secret"); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Got %v, expected ErrInvalidSignature", err)
+		}
+	})
+}
@@ -0,0 +1,341 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go"
+)
+
+// ErrNotBuried is returned when an operation on buried jobs is attempted on a
+// job that is not buried.
+var ErrNotBuried = errors.New("job is not buried")
+
+// ErrNoBuryRecords is returned when buried jobs are listed by an admin that
+// was not given bury records through WithBuryRecords.
+var ErrNoBuryRecords = errors.New("listing buried jobs requires bury records")
+
+// BuriedJob is a buried job, along with the stats beanstalkd keeps for it.
+type BuriedJob struct {
+	ID    uint64
+	Tube  string
+	Stats map[string]string
+	Body  []byte
+
+	// Envelope holds the decoded body, or nil if it could not be decoded.
+	// DecodeErr tells why in that case.
+	Envelope  *Envelope
+	DecodeErr error
+
+	// Bury tells why the job was buried, if this was recorded.
+	Bury *birdbroker.BuryRecord
+}
+
+// Age returns how long ago the job was put.
+func (j *BuriedJob) Age() time.Duration {
+	return statsSeconds(j.Stats, "age")
+}
+
+// staleRecord reports whether br was recorded before j was put, so it belongs
+// to an earlier job with the same ID: job IDs start over when
+// beanstalkd loses its jobs. A second of slack covers the rounding of age.
+func (j *BuriedJob) staleRecord(br *birdbroker.BuryRecord) bool {
+	if _, ok := j.Stats["age"]; !ok {
+		return false
+	}
+	return br.BuriedAt.Before(time.Now().Add(-j.Age() - time.Second))
+}
+
+// Buries returns how many times the job was buried.
+func (j *BuriedJob) Buries() int {
+	n, _ := strconv.Atoi(j.Stats["buries"])
+	return n
+}
+
+// Releases returns how many times the job was released.
+func (j *BuriedJob) Releases() int {
+	n, _ := strconv.Atoi(j.Stats["releases"])
+	return n
+}
+
+type adminConn interface {
+	Delete(id uint64) error
+	KickJob(id uint64) error
+	Peek(id uint64) ([]byte, error)
+	StatsJob(id uint64) (map[string]string, error)
+
+	// PeekBuried returns the buried job in tube that is kicked first.
+	PeekBuried(tube string) (uint64, []byte, error)
+	// StatsTube returns the stats of tube.
+	StatsTube(tube string) (map[string]string, error)
+}
+
+type admin struct {
+	conn   adminConn
+	buried buryRecords
+}
+
+// AdminOption configures an admin created by NewAdmin.
+type AdminOption func(a *admin)
+
+// WithBuryRecords makes the admin look up why jobs were buried in s, which
+// consumers store these in through WithBuryStore. Records of jobs the admin
+// kicks or deletes are deleted from s.
+func WithBuryRecords(s buryRecords) AdminOption {
+	return func(a *admin) {
+		a.buried = s
+	}
+}
+
+type buryRecords interface {
+	GetBuryRecord(ctx context.Context, tube string, jobID uint64) (*birdbroker.BuryRecord, error)
+	// ListBuryRecords returns the bury records of the jobs in tube, most
+	// recently buried first.
+	ListBuryRecords(ctx context.Context, tube string) ([]*birdbroker.BuryRecord, error)
+	DeleteBuryRecord(ctx context.Context, tube string, jobID uint64) error
+}
+
+// NewAdmin creates an admin that inspects, kicks and deletes buried jobs
+// through c: a beanstalk connection wrapped by NewBeanstalkAdminConn, or a log
+// queue.
+func NewAdmin(c adminConn, opts ...AdminOption) *admin {
+	a := &admin{conn: c}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Buried returns the buried jobs in tube, most recently buried first. At most
+// limit jobs are returned, unless limit is 0 or less.
+//
+// Beanstalkd can only peek at the first buried job of a tube, so Buried goes
+// by the bury records the consumers stored, and checks with the queue that
+// each of their jobs is still buried. Jobs buried without a record, such as
+// those buried while the store was unavailable, are not listed. Records of
+// jobs that no longer exist are deleted.
+func (a *admin) Buried(tube string, limit int) ([]*BuriedJob, error) {
+	if a.buried == nil {
+		return nil, ErrNoBuryRecords
+	}
+	brs, err := a.buried.ListBuryRecords(context.Background(), tube)
+	if err != nil {
+		return nil, fmt.Errorf("%T: ListBuryRecords: %s", a.buried, err)
+	}
+
+	var jobs []*BuriedJob
+	for _, br := range brs {
+		if limit > 0 && len(jobs) == limit {
+			break
+		}
+		stats, err := a.conn.StatsJob(br.JobID)
+		if err != nil {
+			if isNotFound(err) {
+				a.forget(tube, br.JobID)
+				continue
+			}
+			return nil, fmt.Errorf("%T: StatsJob: %s", a.conn, err)
+		}
+		if stats["state"] != "buried" || stats["tube"] != tube {
+			continue
+		}
+		j, err := a.job(br.JobID, stats)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if j.Bury == nil {
+			// The record belongs to an earlier job with the same ID.
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// Job returns the buried job identified by id.
+func (a *admin) Job(id uint64) (*BuriedJob, error) {
+	stats, err := a.buriedStats(id)
+	if err != nil {
+		return nil, err
+	}
+	return a.job(id, stats)
+}
+
+// Next returns the buried job in tube that is kicked first, or nil if tube
+// holds no buried jobs.
+func (a *admin) Next(tube string) (*BuriedJob, error) {
+	id, _, err := a.conn.PeekBuried(tube)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%T: PeekBuried: %s", a.conn, err)
+	}
+	return a.Job(id)
+}
+
+// Kick moves the buried job identified by id back to the ready queue.
+func (a *admin) Kick(id uint64) error {
+	stats, err := a.buriedStats(id)
+	if err != nil {
+		return err
+	}
+	if err := a.conn.KickJob(id); err != nil {
+		return fmt.Errorf("%T: KickJob: %s", a.conn, err)
+	}
+	a.forget(stats["tube"], id)
+	return nil
+}
+
+// KickAll moves all buried jobs in tube back to the ready queue, and returns
+// how many were kicked.
+func (a *admin) KickAll(tube string) (int, error) {
+	ts, err := a.conn.StatsTube(tube)
+	if err != nil {
+		if isNotFound(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("%T: StatsTube: %s", a.conn, err)
+	}
+	n, _ := strconv.Atoi(ts["current-jobs-buried"])
+
+	// Jobs are kicked one by one, rather than with kick, so their bury
+	// records can be deleted.
+	var kicked int
+	for kicked < n {
+		id, _, err := a.conn.PeekBuried(tube)
+		if err != nil {
+			if isNotFound(err) {
+				break
+			}
+			return kicked, fmt.Errorf("%T: PeekBuried: %s", a.conn, err)
+		}
+		if err := a.conn.KickJob(id); err != nil {
+			return kicked, fmt.Errorf("%T: KickJob: %s", a.conn, err)
+		}
+		a.forget(tube, id)
+		kicked++
+	}
+	return kicked, nil
+}
+
+// Delete deletes the buried job identified by id.
+func (a *admin) Delete(id uint64) error {
+	stats, err := a.buriedStats(id)
+	if err != nil {
+		return err
+	}
+	if err := a.conn.Delete(id); err != nil {
+		return fmt.Errorf("%T: Delete: %s", a.conn, err)
+	}
+	a.forget(stats["tube"], id)
+	return nil
+}
+
+// forget deletes the bury record of the job identified by id in tube, once it
+// was kicked or deleted. Failing to do so only leaves a stale record behind,
+// which job ignores, so this is not reported to the caller.
+func (a *admin) forget(tube string, id uint64) {
+	if a.buried == nil {
+		return
+	}
+	if err := a.buried.DeleteBuryRecord(context.Background(), tube, id); err != nil {
+		log.Printf("%T: DeleteBuryRecord: %s", a.buried, err)
+	}
+}
+
+// buriedStats returns the stats of the job identified by id, or ErrNotBuried
+// if it is not buried.
+func (a *admin) buriedStats(id uint64) (map[string]string, error) {
+	stats, err := a.conn.StatsJob(id)
+	if err != nil {
+		return nil, fmt.Errorf("%T: StatsJob: %w", a.conn, err)
+	}
+	if stats["state"] != "buried" {
+		return nil, fmt.Errorf("job %d: %w", id, ErrNotBuried)
+	}
+	return stats, nil
+}
+
+func (a *admin) job(id uint64, stats map[string]string) (*BuriedJob, error) {
+	b, err := a.conn.Peek(id)
+	if err != nil {
+		return nil, fmt.Errorf("%T: Peek: %w", a.conn, err)
+	}
+	j := &BuriedJob{ID: id, Tube: stats["tube"], Stats: stats, Body: b}
+	j.Envelope, j.DecodeErr = DecodeEnvelope(b)
+	if a.buried != nil {
+		br, err := a.buried.GetBuryRecord(context.Background(), j.Tube, id)
+		switch {
+		case err == nil:
+			if !j.staleRecord(br) {
+				j.Bury = br
+			}
+		case !errors.Is(err, birdbroker.ErrNotFound):
+			return nil, fmt.Errorf("%T: GetBuryRecord: %s", a.buried, err)
+		}
+	}
+	return j, nil
+}
+
+// beanstalkAdmin implements adminConn on top of a beanstalk connection.
+type beanstalkAdmin struct {
+	c *beanstalk.Conn
+}
+
+// NewBeanstalkAdminConn returns a connection for NewAdmin that inspects, kicks
+// and deletes the buried jobs of beanstalkd through c.
+func NewBeanstalkAdminConn(c *beanstalk.Conn) *beanstalkAdmin {
+	return &beanstalkAdmin{c: c}
+}
+
+func (ba *beanstalkAdmin) Delete(id uint64) error {
+	return ba.c.Delete(id)
+}
+
+func (ba *beanstalkAdmin) KickJob(id uint64) error {
+	return ba.c.KickJob(id)
+}
+
+func (ba *beanstalkAdmin) Peek(id uint64) ([]byte, error) {
+	return ba.c.Peek(id)
+}
+
+func (ba *beanstalkAdmin) StatsJob(id uint64) (map[string]string, error) {
+	return ba.c.StatsJob(id)
+}
+
+func (ba *beanstalkAdmin) PeekBuried(tube string) (uint64, []byte, error) {
+	t := &beanstalk.Tube{Conn: ba.c, Name: tube}
+	return t.PeekBuried()
+}
+
+func (ba *beanstalkAdmin) StatsTube(tube string) (map[string]string, error) {
+	t := &beanstalk.Tube{Conn: ba.c, Name: tube}
+	return t.Stats()
+}
+
+func isNotFound(err error) bool {
+	if errors.Is(err, beanstalk.ErrNotFound) {
+		return true
+	}
+	var ce beanstalk.ConnError
+	return errors.As(err, &ce) && ce.Err == beanstalk.ErrNotFound
+}
+
+func statsSeconds(stats map[string]string, key string) time.Duration {
+	n, err := strconv.Atoi(stats[key])
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,303 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/internal/mock"
+)
+
+// newAdminConn returns a connection to a server holding jobs, keyed by ID. Jobs
+// that are kicked or deleted through it are removed from jobs.
+func newAdminConn(jobs map[uint64]map[string]string) *mock.AdminConn {
+	notFound := beanstalk.ConnError{Op: "stats-job", Err: beanstalk.ErrNotFound}
+	return &mock.AdminConn{
+		DeleteFunc: func(id uint64) error {
+			delete(jobs, id)
+			return nil
+		},
+		KickJobFunc: func(id uint64) error {
+			delete(jobs, id)
+			return nil
+		},
+		PeekFunc: func(id uint64) ([]byte, error) {
+			if _, ok := jobs[id]; !ok {
+				return nil, notFound
+			}
+			return []byte(fmt.Sprintf(`{"v":1,"headers":{"message-id":"m%d"},"payload":{}}`, id)), nil
+		},
+		PeekBuriedFunc: func(tube string) (uint64, []byte, error) {
+			var first uint64
+			for id, stats := range jobs {
+				if stats["tube"] == tube && stats["state"] == "buried" && (first == 0 || id < first) {
+					first = id
+				}
+			}
+			if first == 0 {
+				return 0, nil, beanstalk.ConnError{Op: "peek-buried", Err: beanstalk.ErrNotFound}
+			}
+			return first, nil, nil
+		},
+		StatsJobFunc: func(id uint64) (map[string]string, error) {
+			stats, ok := jobs[id]
+			if !ok {
+				return nil, notFound
+			}
+			return stats, nil
+		},
+		StatsTubeFunc: func(tube string) (map[string]string, error) {
+			var n int
+			for _, stats := range jobs {
+				if stats["tube"] == tube && stats["state"] == "buried" {
+					n++
+				}
+			}
+			return map[string]string{"current-jobs-buried": fmt.Sprint(n)}, nil
+		},
+	}
+}
+
+// newBuryStore returns a store holding records, keyed by tube and job ID.
+// Records deleted through it are removed from records.
+func newBuryStore(records map[string]*birdbroker.BuryRecord) *mock.BuryStore {
+	return &mock.BuryStore{
+		DeleteBuryRecordFunc: func(tube string, jobID uint64) error {
+			delete(records, fmt.Sprintf("%s/%d", tube, jobID))
+			return nil
+		},
+		GetBuryRecordFunc: func(tube string, jobID uint64) (*birdbroker.BuryRecord, error) {
+			br, ok := records[fmt.Sprintf("%s/%d", tube, jobID)]
+			if !ok {
+				return nil, birdbroker.ErrNotFound
+			}
+			return br, nil
+		},
+		ListBuryRecordsFunc: func(tube string) ([]*birdbroker.BuryRecord, error) {
+			var brs []*birdbroker.BuryRecord
+			for _, br := range records {
+				if br.Tube == tube {
+					brs = append(brs, br)
+				}
+			}
+			sort.Slice(brs, func(i, j int) bool { return brs[i].BuriedAt.After(brs[j].BuriedAt) })
+			return brs, nil
+		},
+	}
+}
+
+func testRecords() map[string]*birdbroker.BuryRecord {
+	return map[string]*birdbroker.BuryRecord{
+		"default/2": {JobID: 2, Tube: "default", Reason: birdbroker.BuryDecodeError, BuriedAt: time.Now().Add(-time.Second)},
+		"default/7": {JobID: 7, Tube: "default", Reason: birdbroker.BuryMaxAttempts, BuriedAt: time.Now()},
+		"other/4":   {JobID: 4, Tube: "other", Reason: birdbroker.BuryPermanentError, BuriedAt: time.Now()},
+	}
+}
+
+func testJobs() map[uint64]map[string]string {
+	return map[uint64]map[string]string{
+		2: {"tube": "default", "state": "buried", "buries": "1", "age": "60"},
+		4: {"tube": "other", "state": "buried"},
+		5: {"tube": "default", "state": "ready"},
+		7: {"tube": "default", "state": "buried", "buries": "2"},
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	t.Run("Buried", func(t *testing.T) {
+		a := &admin{conn: newAdminConn(testJobs()), buried: newBuryStore(testRecords())}
+
+		jobs, err := a.Buried("default", 0)
+		if err != nil {
+			t.Fatalf("Buried: %s", err)
+		}
+		if len(jobs) != 2 || jobs[0].ID != 7 || jobs[1].ID != 2 {
+			t.Fatalf("Got %v, expected jobs 7 and 2", jobs)
+		}
+		if jobs[0].Buries() != 2 {
+			t.Errorf("Got %d buries, expected 2", jobs[0].Buries())
+		}
+		if jobs[1].Age().Seconds() != 60 {
+			t.Errorf("Got age %s, expected 1m0s", jobs[1].Age())
+		}
+		if jobs[0].Envelope == nil || jobs[0].Envelope.Headers[HeaderMessageID] != "m7" {
+			t.Errorf("Got envelope %v (%v), expected message-id m7", jobs[0].Envelope, jobs[0].DecodeErr)
+		}
+		if jobs[0].Bury == nil || jobs[0].Bury.Reason != birdbroker.BuryMaxAttempts {
+			t.Errorf("Got bury record %v, expected reason %q", jobs[0].Bury, birdbroker.BuryMaxAttempts)
+		}
+	})
+
+	t.Run("Buried limit", func(t *testing.T) {
+		a := &admin{conn: newAdminConn(testJobs()), buried: newBuryStore(testRecords())}
+
+		jobs, err := a.Buried("default", 1)
+		if err != nil {
+			t.Fatalf("Buried: %s", err)
+		}
+		if len(jobs) != 1 || jobs[0].ID != 7 {
+			t.Fatalf("Got %v, expected job 7", jobs)
+		}
+	})
+
+	t.Run("Buried none", func(t *testing.T) {
+		a := &admin{conn: newAdminConn(testJobs()), buried: newBuryStore(testRecords())}
+
+		jobs, err := a.Buried("empty", 0)
+		if err != nil {
+			t.Fatalf("Buried: %s", err)
+		}
+		if len(jobs) != 0 {
+			t.Errorf("Got %v, expected no jobs", jobs)
+		}
+	})
+
+	t.Run("Buried without records", func(t *testing.T) {
+		a := &admin{conn: newAdminConn(testJobs())}
+
+		if _, err := a.Buried("default", 0); !errors.Is(err, ErrNoBuryRecords) {
+			t.Errorf("Got %v, expected ErrNoBuryRecords", err)
+		}
+	})
+
+	t.Run("Buried outdated records", func(t *testing.T) {
+		records := testRecords()
+		// Job 5 was kicked without the admin, and job 9 deleted.
+		records["default/5"] = &birdbroker.BuryRecord{JobID: 5, Tube: "default", BuriedAt: time.Now()}
+		records["default/9"] = &birdbroker.BuryRecord{JobID: 9, Tube: "default", BuriedAt: time.Now()}
+		a := &admin{conn: newAdminConn(testJobs()), buried: newBuryStore(records)}
+
+		jobs, err := a.Buried("default", 0)
+		if err != nil {
+			t.Fatalf("Buried: %s", err)
+		}
+		if len(jobs) != 2 || jobs[0].ID != 7 || jobs[1].ID != 2 {
+			t.Fatalf("Got %v, expected jobs 7 and 2", jobs)
+		}
+		if _, ok := records["default/9"]; ok {
+			t.Error("Expected the record of deleted job 9 to be deleted")
+		}
+		if _, ok := records["default/5"]; !ok {
+			t.Error("Expected the record of existing job 5 to be kept")
+		}
+	})
+
+	t.Run("Next", func(t *testing.T) {
+		a := &admin{conn: newAdminConn(testJobs())}
+
+		j, err := a.Next("default")
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+		if j == nil || j.ID != 2 {
+			t.Fatalf("Got %v, expected job 2", j)
+		}
+		if j, err = a.Next("empty"); err != nil || j != nil {
+			t.Errorf("Got %v and %v, expected no job", j, err)
+		}
+	})
+
+	t.Run("Bury record", func(t *testing.T) {
+		records := testRecords()
+		delete(records, "default/2")
+		a := &admin{conn: newAdminConn(testJobs()), buried: newBuryStore(records)}
+
+		j, err := a.Job(7)
+		if err != nil {
+			t.Fatalf("Job: %s", err)
+		}
+		if j.Bury == nil || j.Bury.Reason != birdbroker.BuryMaxAttempts {
+			t.Errorf("Got %+v, expected reason %q", j.Bury, birdbroker.BuryMaxAttempts)
+		}
+		if j, err = a.Job(2); err != nil || j.Bury != nil {
+			t.Errorf("Got %+v (%v), expected no bury record", j, err)
+		}
+	})
+
+	t.Run("Stale bury record", func(t *testing.T) {
+		records := testRecords()
+		// Job 2 was put a minute ago, so this record is of an earlier job
+		// with the same ID.
+		records["default/2"].BuriedAt = time.Now().Add(-time.Hour)
+		a := &admin{conn: newAdminConn(testJobs()), buried: newBuryStore(records)}
+
+		j, err := a.Job(2)
+		if err != nil {
+			t.Fatalf("Job: %s", err)
+		}
+		if j.Bury != nil {
+			t.Errorf("Got %+v, expected no bury record", j.Bury)
+		}
+	})
+
+	t.Run("Job not buried", func(t *testing.T) {
+		a := &admin{conn: newAdminConn(testJobs())}
+
+		if _, err := a.Job(5); !errors.Is(err, ErrNotBuried) {
+			t.Errorf("Got %v, expected ErrNotBuried", err)
+		}
+	})
+
+	t.Run("Kick", func(t *testing.T) {
+		jobs, records := testJobs(), testRecords()
+		a := &admin{conn: newAdminConn(jobs), buried: newBuryStore(records)}
+
+		if err := a.Kick(2); err != nil {
+			t.Fatalf("Kick: %s", err)
+		}
+		if _, ok := jobs[2]; ok {
+			t.Error("Expected job 2 to be kicked")
+		}
+		if _, ok := records["default/2"]; ok {
+			t.Error("Expected the bury record of job 2 to be deleted")
+		}
+		if err := a.Kick(5); !errors.Is(err, ErrNotBuried) {
+			t.Errorf("Got %v, expected ErrNotBuried", err)
+		}
+	})
+
+	t.Run("KickAll", func(t *testing.T) {
+		jobs, records := testJobs(), testRecords()
+		a := &admin{conn: newAdminConn(jobs), buried: newBuryStore(records)}
+
+		n, err := a.KickAll("default")
+		if err != nil {
+			t.Fatalf("KickAll: %s", err)
+		}
+		if n != 2 {
+			t.Errorf("Got %d, expected 2", n)
+		}
+		if _, ok := jobs[4]; !ok {
+			t.Error("Expected job 4 in another tube to be left alone")
+		}
+		if len(records) != 1 || records["other/4"] == nil {
+			t.Errorf("Got %v, expected only the bury record of job 4 to be left", records)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		jobs, records := testJobs(), testRecords()
+		a := &admin{conn: newAdminConn(jobs), buried: newBuryStore(records)}
+
+		if err := a.Delete(7); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		if _, ok := jobs[7]; ok {
+			t.Error("Expected job 7 to be deleted")
+		}
+		if _, ok := records["default/7"]; ok {
+			t.Error("Expected the bury record of job 7 to be deleted")
+		}
+		if err := a.Delete(5); !errors.Is(err, ErrNotBuried) {
+			t.Errorf("Got %v, expected ErrNotBuried", err)
+		}
+		if _, ok := jobs[5]; !ok {
+			t.Error("Expected ready job 5 to be left alone")
+		}
+	})
+}
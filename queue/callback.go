@@ -0,0 +1,67 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/epels/birdbroker-go"
+)
+
+type callbackSender struct {
+	conn producerConn
+}
+
+// NewCallbackSender creates a sender that queues callbacks on c. Use a
+// connection to a separate tube, so callbacks are not mixed with messages.
+func NewCallbackSender(c producerConn) *callbackSender {
+	return &callbackSender{conn: c}
+}
+
+func (snd *callbackSender) SendCallback(ctx context.Context, cb *birdbroker.Callback) error {
+	b, err := encodeEnvelope(cb, jobHeaders(ctx, Headers{
+		HeaderMessageID:  cb.Event.MessageID,
+		HeaderEnqueuedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}))
+	if err != nil {
+		return err
+	}
+
+	_, err = snd.conn.Put(b, defaultPriority, 0*time.Second, 1*time.Minute)
+	if err != nil {
+		return fmt.Errorf("%T: Put: %s", snd.conn, err)
+	}
+	return nil
+}
+
+type callbackHandler interface {
+	ServeCallback(ctx context.Context, cb *birdbroker.Callback) error
+}
+
+// callbackJobHandler handles jobs holding a callback.
+type callbackJobHandler struct {
+	h callbackHandler
+}
+
+func (ch callbackJobHandler) serveJob(ctx context.Context, b []byte) error {
+	var cb birdbroker.Callback
+	if err := json.Unmarshal(b, &cb); err != nil {
+		return fmt.Errorf("%w: encoding/json: Unmarshal: %s", errMalformed, err)
+	}
+	if err := ch.h.ServeCallback(ctx, &cb); err != nil {
+		return fmt.Errorf("%T: ServeCallback: %w", ch.h, err)
+	}
+	return nil
+}
+
+func (ch callbackJobHandler) jobBuried(ctx context.Context, b []byte, br *birdbroker.BuryRecord) {}
+
+func (ch callbackJobHandler) jobRetried(ctx context.Context, b []byte, id uint64) {}
+
+// NewCallbackConsumer creates a consumer that hands the callbacks it reserves
+// to h. Failed callbacks are retried according to the retry policy of the
+// consumer, like messages are.
+func NewCallbackConsumer(c consumerConn, h callbackHandler, opts ...ConsumerOption) *consumer {
+	return newConsumer(c, callbackJobHandler{h: h}, opts...)
+}
@@ -0,0 +1,100 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/internal/mock"
+)
+
+type callbackHandlerFunc func(ctx context.Context, cb *birdbroker.Callback) error
+
+func (f callbackHandlerFunc) ServeCallback(ctx context.Context, cb *birdbroker.Callback) error {
+	return f(ctx, cb)
+}
+
+func TestSendCallback(t *testing.T) {
+	var called bool
+	c := mock.ProducerConn{
+		PutFunc: func(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+			called = true
+
+			var cb birdbroker.Callback
+			decodePayload(t, body, &cb)
+			if cb.URL != "https://example.com/hook" {
+				t.Errorf("Got %q, expected https://example.com/hook", cb.URL)
+			}
+			if cb.Event.Status != birdbroker.StatusSent {
+				t.Errorf("Got %q, expected sent", cb.Event.Status)
+			}
+			return 0, nil
+		},
+	}
+	snd := NewCallbackSender(&c)
+
+	err := snd.SendCallback(context.Background(), &birdbroker.Callback{
+		URL: "https://example.com/hook",
+		Event: birdbroker.Event{
+			MessageID: "abc",
+			Status:    birdbroker.StatusSent,
+		},
+	})
+	if err != nil {
+		t.Errorf("SendCallback: %s", err)
+	}
+	if !called {
+		t.Errorf("Got false, expected true")
+	}
+}
+
+func TestCallbackConsumer(t *testing.T) {
+	// once is used to only return a single job from Reserve.
+	var once sync.Once
+	// wg is decremented within the DeleteFunc, so we can wait for it to be
+	// invoked before shutting down the consumer.
+	var wg sync.WaitGroup
+
+	var handlerCalled bool
+	h := callbackHandlerFunc(func(ctx context.Context, cb *birdbroker.Callback) error {
+		handlerCalled = true
+
+		if cb.Event.MessageID != "abc" {
+			t.Errorf("Got %q, expected abc", cb.Event.MessageID)
+		}
+		return nil
+	})
+	cons := NewCallbackConsumer(&mock.ConsumerConn{
+		DeleteFunc: func(id uint64) error {
+			defer wg.Done()
+			return nil
+		},
+		ReserveFunc: func(timeout time.Duration) (id uint64, body []byte, err error) {
+			once.Do(func() {
+				id = uint64(42)
+				body = []byte(`{"url":"https://example.com/hook","event":{"message_id":"abc","status":"sent"}}`)
+			})
+
+			if body == nil {
+				time.Sleep(timeout)
+				err = beanstalk.ErrTimeout
+			}
+			return
+		},
+	}, h)
+
+	wg.Add(1)
+	go cons.ListenAndServe()
+
+	wg.Wait()
+	if err := cons.Shutdown(context.Background()); err != nil {
+		t.Errorf("Consumer: Shutdown: %s", err)
+	}
+	if !handlerCalled {
+		t.Errorf("Got false, expected true")
+	}
+}
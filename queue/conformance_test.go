@@ -0,0 +1,188 @@
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go/internal/beanstalkd"
+	"github.com/epels/birdbroker-go/queue/queuetest"
+)
+
+// memoryQueue adapts a memory queue to the conformance suite.
+type memoryQueue struct {
+	q *memory
+}
+
+func (mq memoryQueue) Conn(use string, watch ...string) queuetest.Conn {
+	c := mq.q.Conn(watch...)
+	c.use = use
+	return c
+}
+
+// logQueueAdapter adapts a log queue to the conformance suite.
+type logQueueAdapter struct {
+	q *logQueue
+}
+
+func (lq logQueueAdapter) Conn(use string, watch ...string) queuetest.Conn {
+	c := lq.q.Conn(watch...)
+	c.use = use
+	return c
+}
+
+// beanstalkQueue adapts a beanstalkd to the conformance suite. Each Conn is
+// a connection of its own, like a process using beanstalkd would have.
+//
+// A real beanstalkd is shared by all tests, and may hold jobs of earlier
+// runs, so tube names are given a prefix that is unique to the queue.
+type beanstalkQueue struct {
+	t      *testing.T
+	addr   string
+	prefix string
+
+	mu    sync.Mutex
+	conns []*beanstalk.Conn
+	tubes map[string]bool
+}
+
+func (bq *beanstalkQueue) Conn(use string, watch ...string) queuetest.Conn {
+	c, err := beanstalk.Dial("tcp", bq.addr)
+	if err != nil {
+		bq.t.Fatalf("beanstalk: Dial: %s", err)
+	}
+	if len(watch) == 0 {
+		watch = []string{"default"}
+	}
+	names := make([]string, len(watch))
+	for i, tube := range watch {
+		names[i] = bq.prefix + tube
+	}
+	c.Tube = beanstalk.Tube{Conn: c, Name: bq.prefix + use}
+	c.TubeSet = *beanstalk.NewTubeSet(c, names...)
+
+	bq.mu.Lock()
+	bq.conns = append(bq.conns, c)
+	if bq.tubes == nil {
+		bq.tubes = make(map[string]bool)
+	}
+	for _, name := range append(names, c.Tube.Name) {
+		bq.tubes[name] = true
+	}
+	bq.mu.Unlock()
+	return prefixedConn{c, bq.prefix}
+}
+
+// Close closes the connections of bq, and deletes the jobs left in its tubes.
+func (bq *beanstalkQueue) Close() {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	for _, c := range bq.conns {
+		c.Close()
+	}
+	if bq.prefix == "" {
+		return
+	}
+
+	c, err := beanstalk.Dial("tcp", bq.addr)
+	if err != nil {
+		bq.t.Errorf("beanstalk: Dial: %s", err)
+		return
+	}
+	defer c.Close()
+	for name := range bq.tubes {
+		t := &beanstalk.Tube{Conn: c, Name: name}
+		for _, peek := range []func() (uint64, []byte, error){t.PeekReady, t.PeekDelayed, t.PeekBuried} {
+			for {
+				id, _, err := peek()
+				if err != nil {
+					break
+				}
+				if err := c.Delete(id); err != nil {
+					bq.t.Errorf("beanstalk: Conn.Delete: %s", err)
+					break
+				}
+			}
+		}
+	}
+}
+
+// prefixedConn is a connection to a beanstalkQueue, which reports the tubes
+// of jobs without the prefix of the queue.
+type prefixedConn struct {
+	*beanstalk.Conn
+	prefix string
+}
+
+func (pc prefixedConn) StatsJob(id uint64) (map[string]string, error) {
+	stats, err := pc.Conn.StatsJob(id)
+	if err != nil {
+		return nil, err
+	}
+	stats["tube"] = strings.TrimPrefix(stats["tube"], pc.prefix)
+	return stats, nil
+}
+
+func TestConformance(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		queuetest.Run(t, func(t *testing.T) (queuetest.Queue, func()) {
+			return memoryQueue{NewMemory()}, func() {}
+		})
+	})
+
+	t.Run("Log", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "birdbroker-queue")
+		if err != nil {
+			t.Fatalf("ioutil: TempDir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		var n int64
+		queuetest.Run(t, func(t *testing.T) (queuetest.Queue, func()) {
+			name := strconv.FormatInt(atomic.AddInt64(&n, 1), 10) + ".log"
+			q, err := OpenLog(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("OpenLog: %s", err)
+			}
+			return logQueueAdapter{q}, func() { q.Close() }
+		})
+	})
+
+	t.Run("Beanstalk", func(t *testing.T) {
+		queuetest.Run(t, func(t *testing.T) (queuetest.Queue, func()) {
+			srv, err := beanstalkd.NewServer()
+			if err != nil {
+				t.Fatalf("beanstalkd: NewServer: %s", err)
+			}
+			bq := &beanstalkQueue{t: t, addr: srv.Addr()}
+			return bq, func() {
+				bq.Close()
+				srv.Close()
+			}
+		})
+	})
+
+	t.Run("Beanstalkd", func(t *testing.T) {
+		addr := os.Getenv("BEANSTALKD_ADDR")
+		if addr == "" {
+			t.Skip("BEANSTALKD_ADDR is not set")
+		}
+
+		run := time.Now().UnixNano()
+		var n int64
+		queuetest.Run(t, func(t *testing.T) (queuetest.Queue, func()) {
+			prefix := fmt.Sprintf("birdbroker-conformance-%d-%d-", run, atomic.AddInt64(&n, 1))
+			bq := &beanstalkQueue{t: t, addr: addr, prefix: prefix}
+			return bq, bq.Close
+		})
+	})
+}
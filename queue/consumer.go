@@ -4,19 +4,87 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/beanstalkd/go-beanstalk"
+
 	"github.com/epels/birdbroker-go"
 )
 
 var ErrConsumerClosed = errors.New("consumer was closed")
 
+// defaultConcurrency is the maximum number of jobs handled at the same time,
+// unless configured otherwise through WithConcurrency.
+const defaultConcurrency = 10
+
+// defaultReserveTimeout bounds how long a single Reserve call blocks. It is
+// kept short, so the consumer notices a Shutdown soon, and calls on the same
+// connection do not queue up behind a pending Reserve for long.
+const defaultReserveTimeout = 1 * time.Second
+
 type consumer struct {
-	conn consumerConn
-	h    handler
+	conn           consumerConn
+	h              jobHandler
+	reserveTimeout time.Duration
+	retry          RetryPolicy
+	buried         buryStore
+
+	inFlight int64         // Number of jobs being handled. Accessed atomically.
+	sem      chan struct{} // Holds a token for every job being handled.
+
+	mu   sync.Mutex                    // Guards jobs.
+	jobs map[uint64]context.CancelFunc // Jobs being handled, by ID.
+	wg   sync.WaitGroup                // Tracks goroutines handling jobs.
+
+	stopCh   chan struct{} // Closed by Shutdown.
+	stopOnce sync.Once     // Guards closing stopCh.
+}
+
+// ConsumerOption configures a consumer created by NewConsumer.
+type ConsumerOption func(c *consumer)
+
+// WithConcurrency limits the number of jobs handled at the same time to n.
+// While n jobs are in flight, no new jobs are reserved.
+func WithConcurrency(n int) ConsumerOption {
+	return func(c *consumer) {
+		if n < 1 {
+			n = 1
+		}
+		c.sem = make(chan struct{}, n)
+	}
+}
+
+// WithRetryPolicy sets the policy used to delay the retries of failed jobs,
+// and to decide when to bury them instead.
+func WithRetryPolicy(p RetryPolicy) ConsumerOption {
+	return func(c *consumer) {
+		c.retry = p
+	}
+}
+
+// WithReserveTimeout sets how long the consumer waits for a job to become
+// available in a single Reserve call.
+func WithReserveTimeout(d time.Duration) ConsumerOption {
+	return func(c *consumer) {
+		c.reserveTimeout = d
+	}
+}
+
+// WithBuryStore makes the consumer store a record in s for every job it
+// buries, telling why it did.
+func WithBuryStore(s buryStore) ConsumerOption {
+	return func(c *consumer) {
+		c.buried = s
+	}
+}
 
-	stopCh chan struct{}
+type buryStore interface {
+	PutBuryRecord(ctx context.Context, br *birdbroker.BuryRecord) error
 }
 
 type consumerConn interface {
@@ -33,6 +101,9 @@ type consumerConn interface {
 	Release(id uint64, pri uint32, delay time.Duration) error
 	// Reserve retrieves a job from the queue and marks it as reserved.
 	Reserve(timeout time.Duration) (id uint64, body []byte, err error)
+	// StatsJob returns statistics about a job, such as the number of times
+	// it was released.
+	StatsJob(id uint64) (map[string]string, error)
 }
 
 type handler interface {
@@ -45,69 +116,423 @@ func (f handlerFunc) ServeJob(ctx context.Context, m *birdbroker.Message) error
 	return f(ctx, m)
 }
 
-func NewConsumer(c consumerConn, h handler) *consumer {
-	return &consumer{
-		stopCh: make(chan struct{}, 1),
-		conn:   c,
-		h:      h,
+// buryHandler is implemented by handlers that want to be notified when the
+// consumer gives up on a message and buries its job. br tells why.
+type buryHandler interface {
+	JobBuried(ctx context.Context, m *birdbroker.Message, br *birdbroker.BuryRecord)
+}
+
+// retryHandler is implemented by handlers that want to be notified when the
+// consumer puts a failed message back to be retried, as the job identified by
+// jobID.
+type retryHandler interface {
+	JobRetried(ctx context.Context, m *birdbroker.Message, jobID uint64)
+}
+
+// errMalformed is returned by a jobHandler for a job with a payload that
+// cannot be decoded.
+var errMalformed = errors.New("malformed job payload")
+
+// jobHandler decodes the body of a job, and passes the result on to a
+// handler for that kind of job.
+type jobHandler interface {
+	// serveJob handles the job with body b.
+	serveJob(ctx context.Context, b []byte) error
+	// jobBuried is called after the job with body b was buried for the
+	// reason recorded in br.
+	jobBuried(ctx context.Context, b []byte, br *birdbroker.BuryRecord)
+	// jobRetried is called after the job with body b failed, and was put
+	// back to be retried as the job identified by id.
+	jobRetried(ctx context.Context, b []byte, id uint64)
+}
+
+// messageHandler handles jobs holding a message.
+type messageHandler struct {
+	h handler
+}
+
+func (mh messageHandler) serveJob(ctx context.Context, b []byte) error {
+	var m birdbroker.Message
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%w: encoding/json: Unmarshal: %s", errMalformed, err)
 	}
+	if err := mh.h.ServeJob(ctx, &m); err != nil {
+		return fmt.Errorf("%T: ServeJob: %w", mh.h, err)
+	}
+	return nil
 }
 
-// ListenAndServe consumes jobs from c.producerConn and then calls
-// Serve to handle these.
+// jobBuried notifies mh.h of the buried job with body b. If b can't be
+// decoded, the message is only known by the ID in its headers, if any.
+func (mh messageHandler) jobBuried(ctx context.Context, b []byte, br *birdbroker.BuryRecord) {
+	bh, ok := mh.h.(buryHandler)
+	if !ok {
+		return
+	}
+	var m birdbroker.Message
+	if err := json.Unmarshal(b, &m); err != nil {
+		if br.MessageID == "" {
+			return
+		}
+		m = birdbroker.Message{ID: br.MessageID}
+	}
+	bh.JobBuried(ctx, &m, br)
+}
+
+// jobRetried notifies mh.h of the message with body b being retried as the
+// job identified by id.
+func (mh messageHandler) jobRetried(ctx context.Context, b []byte, id uint64) {
+	rh, ok := mh.h.(retryHandler)
+	if !ok {
+		return
+	}
+	var m birdbroker.Message
+	if err := json.Unmarshal(b, &m); err != nil {
+		return
+	}
+	rh.JobRetried(ctx, &m, id)
+}
+
+// NewConsumer creates a consumer that hands the messages it reserves to h.
+func NewConsumer(c consumerConn, h handler, opts ...ConsumerOption) *consumer {
+	return newConsumer(c, messageHandler{h: h}, opts...)
+}
+
+func newConsumer(c consumerConn, h jobHandler, opts ...ConsumerOption) *consumer {
+	cons := &consumer{
+		conn:           c,
+		h:              h,
+		reserveTimeout: defaultReserveTimeout,
+		retry:          DefaultRetryPolicy,
+		sem:            make(chan struct{}, defaultConcurrency),
+		jobs:           make(map[uint64]context.CancelFunc),
+		stopCh:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(cons)
+	}
+	return cons
+}
+
+// Concurrency returns the maximum number of jobs handled at the same time.
+func (c *consumer) Concurrency() int {
+	return cap(c.sem)
+}
+
+// InFlight returns the number of jobs that are currently being handled.
+func (c *consumer) InFlight() int {
+	return int(atomic.LoadInt64(&c.inFlight))
+}
+
+// Utilization returns the fraction of the worker pool that is currently
+// busy, between 0 and 1.
+func (c *consumer) Utilization() float64 {
+	return float64(c.InFlight()) / float64(c.Concurrency())
+}
+
+// ListenAndServe consumes jobs from c.conn and then calls c.h to handle
+// these.
 //
-// ListenAndServe always returns a non-nil error. After Shutdown or Close, the
-// returned error is ErrServerClosed.
+// ListenAndServe always returns a non-nil error. After Shutdown, the returned
+// error is ErrConsumerClosed.
 func (c *consumer) ListenAndServe() error {
+	var backoff time.Duration // Delay after the last failed Reserve, if any.
 	for {
 		select {
 		case <-c.stopCh:
 			return ErrConsumerClosed
 		default:
-			// @todo: Make timeout configurable. For now: very long, as we're
-			//        operating in a worker context.
-			id, b, err := c.conn.Reserve(42 * time.Hour)
-
-			go func(id uint64, b []byte, err error) {
-				if err != nil {
-					log.Printf("%T: Reserve: %s", c.conn, err)
-					return
-				}
-
-				var m birdbroker.Message
-				if err := json.Unmarshal(b, &m); err != nil {
-					log.Printf("encoding/json: Unmarshal: %s", err)
-
-					// Bury the job: its payload has an invalid format, so
-					// there's no use in retrying, but it makes sense to
-					// inspect the job manually.
-					if err = c.conn.Bury(id, defaultPriority); err != nil {
-						log.Printf("%T: Delete: %s", c.h, err)
-					}
-					return
-				}
-
-				// Create a fresh context for the handler: replicate net/http
-				// behaviour.
-				if err := c.h.ServeJob(context.Background(), &m); err != nil {
-					log.Printf("%T: ServeJob: %s", c.h, err)
-					if err = c.conn.Release(id, defaultPriority, 0); err != nil {
-						log.Printf("%T: Release: %s", c.h, err)
-					}
-					return
-				}
-
-				if err = c.conn.Delete(id); err != nil {
-					log.Printf("%T: Delete: %s", c.h, err)
-				}
-			}(id, b, err)
 		}
+
+		// Wait for a free slot in the pool before reserving: a job that is
+		// reserved but not handled would just sit there until its TTR runs
+		// out.
+		select {
+		case <-c.stopCh:
+			return ErrConsumerClosed
+		case c.sem <- struct{}{}:
+		}
+
+		id, b, err := c.conn.Reserve(c.reserveTimeout)
+		if err != nil {
+			<-c.sem
+			if isTimeout(err) {
+				backoff = 0
+				continue
+			}
+
+			// Don't hammer beanstalkd (or the log) while it is unavailable.
+			backoff = nextBackoff(backoff)
+			log.Printf("%T: Reserve: %s (retrying in %s)", c.conn, err, backoff)
+			select {
+			case <-c.stopCh:
+				return ErrConsumerClosed
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+
+		ctx, ok := c.track(id)
+		if !ok {
+			// Shutdown was called while reserving: hand the job back right
+			// away, so another worker can pick it up.
+			if err := c.conn.Release(id, jobPriority(c.stats(id)), 0); err != nil {
+				log.Printf("%T: Release: %s", c.conn, err)
+			}
+			<-c.sem
+			return ErrConsumerClosed
+		}
+
+		atomic.AddInt64(&c.inFlight, 1)
+		go func(id uint64, b []byte) {
+			defer func() {
+				atomic.AddInt64(&c.inFlight, -1)
+				<-c.sem
+				c.wg.Done()
+			}()
+			c.serve(ctx, id, b)
+		}(id, b)
+	}
+}
+
+// nextBackoff returns the delay before reserving again after yet another
+// failed Reserve, given the delay after the previous one. It doubles from
+// defaultMinBackoff up to defaultMaxBackoff.
+func nextBackoff(d time.Duration) time.Duration {
+	if d < defaultMinBackoff {
+		return defaultMinBackoff
+	}
+	if d *= 2; d > defaultMaxBackoff {
+		return defaultMaxBackoff
+	}
+	return d
+}
+
+// track registers the job identified by id as in flight, and returns the
+// context it must be handled with. It reports false if the consumer is
+// shutting down.
+func (c *consumer) track(id uint64) (context.Context, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.stopCh:
+		return nil, false
+	default:
+	}
+
+	// Create a fresh context for the handler: replicate net/http behaviour.
+	// It is only cancelled when Shutdown gives up on the job.
+	ctx, cancel := context.WithCancel(context.Background())
+	c.jobs[id] = cancel
+	c.wg.Add(1)
+	return ctx, true
+}
+
+// untrack removes the job identified by id from the jobs in flight. It
+// reports false if Shutdown already released the job, in which case the
+// caller no longer owns it.
+func (c *consumer) untrack(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cancel, ok := c.jobs[id]
+	if !ok {
+		return false
+	}
+	cancel()
+	delete(c.jobs, id)
+	return true
+}
+
+// serve handles the reserved job identified by id with body b, and deletes,
+// releases or buries it depending on the outcome. Jobs with an envelope that
+// can't be decoded, for instance because its version is unknown, are buried.
+func (c *consumer) serve(ctx context.Context, id uint64, b []byte) {
+	var h Headers
+	env, err := DecodeEnvelope(b)
+	if err == nil {
+		b, h = env.Payload, env.Headers
+		err = c.h.serveJob(ContextWithHeaders(ctx, h), b)
+	}
+	if !c.untrack(id) {
+		return
+	}
+
+	switch {
+	case err == nil:
+		if err := c.conn.Delete(id); err != nil {
+			log.Printf("%T: Delete: %s", c.conn, err)
+		}
+	case errors.Is(err, errMalformed):
+		log.Printf("Job %d: %s", id, err)
+
+		// Bury the job: its payload has an invalid format, so there's no use
+		// in retrying, but it makes sense to inspect the job manually.
+		c.bury(id, c.stats(id), b, h, birdbroker.BuryDecodeError, err)
+	case IsPermanent(err):
+		log.Printf("Job %d: %s", id, err)
+		c.bury(id, c.stats(id), b, h, birdbroker.BuryPermanentError, err)
+	default:
+		log.Printf("Job %d: %s", id, err)
+		c.retryOrBury(id, b, h, err)
+	}
+}
+
+// retryOrBury puts the job identified by id back with a delay according to
+// c.retry, or buries it once it has run out of attempts. Either way, the job
+// keeps its priority.
+//
+// The number of failed attempts is kept in the headers of the job, so jobs
+// that are released for another reason, such as a Shutdown, do not lose an
+// attempt. A job is therefore retried by putting it again, with updated
+// headers, and deleting the failed one. Connections that can't put jobs
+// release them instead.
+func (c *consumer) retryOrBury(id uint64, b []byte, h Headers, cause error) {
+	stats := c.stats(id)
+	if stats == nil {
+		// Neither the attempt nor the tube to retry the job in is known:
+		// give up, rather than risk retrying the job forever.
+		c.bury(id, stats, b, h, birdbroker.BuryNoStats, fmt.Errorf("gave up without job stats: %w", cause))
+		return
+	}
+	n := attempt(h, stats)
+	pri := jobPriority(stats)
+	if c.retry.Exhausted(n) {
+		c.bury(id, stats, b, h, birdbroker.BuryMaxAttempts, fmt.Errorf("gave up after %d attempts: %w", n, cause))
+		return
+	}
+
+	tp, ok := c.conn.(tubeProducer)
+	if !ok {
+		if err := c.conn.Release(id, pri, c.retry.Delay(n)); err != nil {
+			log.Printf("%T: Release: %s", c.conn, err)
+		}
+		return
 	}
+	newID, err := c.requeue(tp, stats, b, h, n, pri)
+	if err != nil {
+		log.Printf("Job %d: %s", id, err)
+		if err := c.conn.Release(id, pri, c.retry.Delay(n)); err != nil {
+			log.Printf("%T: Release: %s", c.conn, err)
+		}
+		return
+	}
+	if err := c.conn.Delete(id); err != nil {
+		log.Printf("%T: Delete: %s (job %d may be handled twice, as job %d)", c.conn, err, id, newID)
+	}
+	c.h.jobRetried(context.Background(), b, newID)
+}
+
+// requeue puts a copy of the job with payload b, headers h and the given
+// stats back in its tube, after its attempt'th attempt failed. It returns the
+// ID of the copy.
+func (c *consumer) requeue(tp tubeProducer, stats map[string]string, b []byte, h Headers, attempt int, pri uint32) (uint64, error) {
+	rh := make(Headers, len(h)+1)
+	for k, v := range h {
+		rh[k] = v
+	}
+	rh[HeaderAttempts] = strconv.Itoa(attempt)
+	body, err := encodeEnvelope(json.RawMessage(b), rh)
+	if err != nil {
+		return 0, err
+	}
+
+	ttr, err := strconv.Atoi(stats["ttr"])
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttr %q in job stats", stats["ttr"])
+	}
+	p := tp.Tube(stats["tube"])
+	if p == nil {
+		return 0, fmt.Errorf("%T can't put jobs in tube %q", tp, stats["tube"])
+	}
+	newID, err := p.Put(body, pri, c.retry.Delay(attempt), time.Duration(ttr)*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("%T: Put: %s", p, err)
+	}
+	return newID, nil
+}
+
+// stats returns the statistics of the job identified by id, or nil if these
+// can't be retrieved.
+func (c *consumer) stats(id uint64) map[string]string {
+	stats, err := c.conn.StatsJob(id)
+	if err != nil {
+		log.Printf("%T: StatsJob: %s", c.conn, err)
+		return nil
+	}
+	return stats
 }
 
-// @todo: Graceful shutdown. Accept ctx for now, so I can do so later without
-//        making breaking changes to the exported API.
+// bury buries the job identified by id with body b and headers h, keeping the
+// priority in its stats. The reason and cause are recorded in c.buried, and
+// passed on to c.h.
+func (c *consumer) bury(id uint64, stats map[string]string, b []byte, h Headers, reason birdbroker.BuryReason, cause error) {
+	log.Printf("Burying job %d: %s", id, cause)
+	if err := c.conn.Bury(id, jobPriority(stats)); err != nil {
+		log.Printf("%T: Bury: %s", c.conn, err)
+	}
+
+	br := &birdbroker.BuryRecord{
+		JobID:     id,
+		Tube:      stats["tube"],
+		MessageID: h[HeaderMessageID],
+		Reason:    reason,
+		Error:     cause.Error(),
+		BuriedAt:  time.Now(),
+	}
+	ctx := context.Background()
+	if c.buried != nil {
+		if err := c.buried.PutBuryRecord(ctx, br); err != nil {
+			log.Printf("%T: PutBuryRecord: %s", c.buried, err)
+		}
+	}
+	c.h.jobBuried(ctx, b, br)
+}
+
+// Shutdown stops reserving new jobs, and waits for the jobs in flight to be
+// handled. If ctx expires first, the context passed to the remaining handlers
+// is cancelled and their jobs are released, so they can be picked up again
+// right away instead of after their TTR. Shutdown then returns the error of
+// ctx.
 func (c *consumer) Shutdown(ctx context.Context) error {
-	c.stopCh <- struct{}{}
-	return nil
+	c.mu.Lock()
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+	})
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, cancel := range c.jobs {
+		cancel()
+		delete(c.jobs, id)
+		if err := c.conn.Release(id, jobPriority(c.stats(id)), 0); err != nil {
+			log.Printf("%T: Release: %s", c.conn, err)
+		}
+	}
+	return ctx.Err()
+}
+
+// isTimeout reports whether err signals that Reserve did not find a job in
+// time, which is expected when the queue is idle.
+func isTimeout(err error) bool {
+	if errors.Is(err, beanstalk.ErrTimeout) {
+		return true
+	}
+	var ce beanstalk.ConnError
+	return errors.As(err, &ce) && ce.Err == beanstalk.ErrTimeout
 }
@@ -2,8 +2,10 @@ package queue
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"sync"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,7 +13,131 @@ import (
 	"github.com/epels/birdbroker-go/internal/mock"
 )
 
-// @todo(emile): Simplify test, and consider making it table-driven.
+// buryRecorder is a handler that is notified of buried jobs.
+type buryRecorder struct {
+	ServeJobFunc  func(ctx context.Context, m *birdbroker.Message) error
+	JobBuriedFunc func(m *birdbroker.Message, br *birdbroker.BuryRecord)
+}
+
+func (h *buryRecorder) ServeJob(ctx context.Context, m *birdbroker.Message) error {
+	return h.ServeJobFunc(ctx, m)
+}
+
+func (h *buryRecorder) JobBuried(ctx context.Context, m *birdbroker.Message, br *birdbroker.BuryRecord) {
+	h.JobBuriedFunc(m, br)
+}
+
+// retryRecorder is a handler that is notified of retried jobs.
+type retryRecorder struct {
+	ServeJobFunc   func(ctx context.Context, m *birdbroker.Message) error
+	JobRetriedFunc func(m *birdbroker.Message, jobID uint64)
+}
+
+func (h *retryRecorder) ServeJob(ctx context.Context, m *birdbroker.Message) error {
+	return h.ServeJobFunc(ctx, m)
+}
+
+func (h *retryRecorder) JobRetried(ctx context.Context, m *birdbroker.Message, jobID uint64) {
+	h.JobRetriedFunc(m, jobID)
+}
+
+// doneConn is a connection to a memory queue that reports every job that is
+// deleted, released or buried through it on done.
+type doneConn struct {
+	*memoryConn
+	done chan uint64
+}
+
+func newDoneConn(q *memory, tubes ...string) *doneConn {
+	return &doneConn{memoryConn: q.Conn(tubes...), done: make(chan uint64, 10)}
+}
+
+func (c *doneConn) Bury(id uint64, pri uint32) error {
+	defer func() { c.done <- id }()
+	return c.memoryConn.Bury(id, pri)
+}
+
+func (c *doneConn) Delete(id uint64) error {
+	defer func() { c.done <- id }()
+	return c.memoryConn.Delete(id)
+}
+
+func (c *doneConn) Release(id uint64, pri uint32, delay time.Duration) error {
+	defer func() { c.done <- id }()
+	return c.memoryConn.Release(id, pri, delay)
+}
+
+// reserveConn is a connection to a memory queue that calls hook before every
+// Reserve.
+type reserveConn struct {
+	*memoryConn
+	hook func()
+}
+
+func (c *reserveConn) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	c.hook()
+	return c.memoryConn.Reserve(timeout)
+}
+
+// consumeOne runs cons until a job reserved through c was handled, and then
+// shuts it down. As Shutdown drains the jobs in flight, cons is done with the
+// job once consumeOne returns.
+func consumeOne(t *testing.T, cons *consumer, c *doneConn) {
+	t.Helper()
+
+	errCh := make(chan error, 1)
+	go func() {
+		// Run on separate goroutine: ListenAndServe blocks until it's
+		// closed.
+		errCh <- cons.ListenAndServe()
+	}()
+
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the job to be handled")
+	}
+	if err := cons.Shutdown(context.Background()); err != nil {
+		t.Errorf("Consumer: Shutdown: %s", err)
+	}
+	if err := <-errCh; !errors.Is(err, ErrConsumerClosed) {
+		t.Errorf("Got %T (%s), expected ErrConsumerClosed", err, err)
+	}
+}
+
+// jobStats returns the statistics of the job identified by id in q, or nil
+// if it doesn't exist.
+func jobStats(q *memory, id uint64) map[string]string {
+	stats, err := q.Conn().StatsJob(id)
+	if err != nil {
+		return nil
+	}
+	return stats
+}
+
+// peekHeaders returns the headers of the job identified by id in q.
+func peekHeaders(t *testing.T, q *memory, id uint64) Headers {
+	t.Helper()
+	q.mu.Lock()
+	j, ok := q.jobs[id]
+	q.mu.Unlock()
+	if !ok {
+		t.Fatalf("Got no job %d, expected it to exist", id)
+	}
+	env, err := DecodeEnvelope(j.Body)
+	if err != nil {
+		t.Fatalf("DecodeEnvelope: %s", err)
+	}
+	return env.Headers
+}
+
+const helloJob = `{
+	"id": "abc",
+	"body": "Hello",
+	"originator": "Foo Inc",
+	"recipient": "31612345678"
+}`
+
 func TestListenAndServe(t *testing.T) {
 	t.Run("Closed", func(t *testing.T) {
 		hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
@@ -29,72 +155,37 @@ func TestListenAndServe(t *testing.T) {
 	})
 
 	t.Run("Buries invalid jobs", func(t *testing.T) {
-		// once is used to only return a single job from Reserve.
-		var once sync.Once
-		// wg is decremented within the ReleaseFunc, so we can wait for it to
-		// be invoked before shutting down the consumer later (as
-		// ListenAndServe is ran on its own goroutine).
-		var wg sync.WaitGroup
+		q := NewMemory()
+		id, _ := q.Tube("some-tube").Put([]byte("not valid json"), priorityBulk, 0, time.Minute)
+		c := newDoneConn(q, "some-tube")
 
 		hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
 			t.Fatalf("Must never be called")
 			return nil
 		})
-		var buried bool
-		cons := NewConsumer(&mock.ConsumerConn{
-			BuryFunc: func(id uint64, pri uint32) error {
-				defer wg.Done()
-				buried = true
-				if id != 9000 {
-					t.Errorf("Got %d, expected 9000", id)
-				}
-				if pri != defaultPriority {
-					t.Errorf("Got %d, expected %d", pri, defaultPriority)
-				}
+		var br *birdbroker.BuryRecord
+		bs := &mock.BuryStore{
+			PutBuryRecordFunc: func(r *birdbroker.BuryRecord) error {
+				br = r
 				return nil
 			},
-			ReserveFunc: func(timeout time.Duration) (id uint64, body []byte, err error) {
-				// Only return a job on the first invocation.
-				once.Do(func() {
-					id = uint64(9000)
-					body = []byte("not valid json")
-					err = nil
-				})
-
-				if body == nil {
-					time.Sleep(timeout)
-					err = errors.New("timeout")
-				}
-				return
-			},
-		}, hf)
-
-		wg.Add(1)
-		go func() {
-			// Run on separate goroutine: ListenAndServe blocks until it's
-			// closed.
-			if err := cons.ListenAndServe(); !errors.Is(err, ErrConsumerClosed) {
-				t.Errorf("Got %T (%s), expected ErrConsumerClosed", err, err)
-			}
-		}()
-
-		wg.Wait()
-		if err := cons.Shutdown(context.Background()); err != nil {
-			t.Errorf("Consumer: Shutdown: %s", err)
 		}
+		consumeOne(t, NewConsumer(c, hf, WithBuryStore(bs), WithReserveTimeout(10*time.Millisecond)), c)
 
-		if !buried {
-			t.Errorf("Got false, expected true")
+		// The job keeps its priority.
+		stats := jobStats(q, id)
+		if stats["state"] != "buried" || jobPriority(stats) != priorityBulk {
+			t.Errorf("Got %v, expected a buried job with priority %d", stats, priorityBulk)
+		}
+		if br == nil || br.JobID != id || br.Tube != "some-tube" || br.Reason != birdbroker.BuryDecodeError || br.Error == "" {
+			t.Errorf("Got %+v, expected a decode error record of job %d in some-tube", br, id)
 		}
 	})
 
 	t.Run("Retries failed jobs", func(t *testing.T) {
-		// once is used to only return a single job from Reserve.
-		var once sync.Once
-		// wg is decremented within the ReleaseFunc, so we can wait for it to
-		// be invoked before shutting down the consumer later (as
-		// ListenAndServe is ran on its own goroutine).
-		var wg sync.WaitGroup
+		q := NewMemory()
+		id, _ := q.Put([]byte(helloJob), priorityOTP, 0, time.Minute)
+		c := newDoneConn(q)
 
 		var handlerCalled bool
 		hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
@@ -112,67 +203,213 @@ func TestListenAndServe(t *testing.T) {
 
 			return errors.New("some error, so that the job is released")
 		})
-		var released bool
-		cons := NewConsumer(&mock.ConsumerConn{
-			ReleaseFunc: func(id uint64, pri uint32, delay time.Duration) error {
-				defer wg.Done()
-				released = true
+		consumeOne(t, NewConsumer(c, hf, WithReserveTimeout(10*time.Millisecond), WithRetryPolicy(RetryPolicy{
+			BaseDelay:   2 * time.Second,
+			Multiplier:  2,
+			MaxAttempts: 5,
+		})), c)
 
-				if id != 42 {
-					t.Errorf("Got %d, expected 42", id)
-				}
-				return nil
+		if !handlerCalled {
+			t.Errorf("Got false, expected true")
+		}
+		// After its first attempt, the job is put back as a new job with
+		// the failed attempt in its headers. It is delayed by the base
+		// delay, and keeps its priority.
+		if stats := jobStats(q, id); stats != nil {
+			t.Errorf("Got %v, expected the failed job to be deleted", stats)
+		}
+		stats := jobStats(q, id+1)
+		if stats["state"] != "delayed" || stats["delay"] != "2" || stats["ttr"] != "60" {
+			t.Errorf("Got %v, expected a job with a delay of 2s and a ttr of 60s", stats)
+		}
+		if pri := jobPriority(stats); pri != priorityOTP {
+			t.Errorf("Got %d, expected %d", pri, priorityOTP)
+		}
+		if h := peekHeaders(t, q, id+1); h[HeaderAttempts] != "1" {
+			t.Errorf("Got %v, expected 1 failed attempt in the headers", h)
+		}
+	})
+
+	t.Run("Counts attempts in headers", func(t *testing.T) {
+		q := NewMemory()
+		b, _ := encodeEnvelope(json.RawMessage(helloJob), Headers{HeaderAttempts: "2"})
+		id, _ := q.Put(b, 0, 0, time.Minute)
+		c := newDoneConn(q)
+
+		// The job was released before, for instance by a Shutdown, which
+		// does not count as a failed attempt.
+		c.Reserve(0)
+		c.Release(id, 0, 0)
+		<-c.done
+
+		var buried bool
+		h := &buryRecorder{
+			ServeJobFunc: func(ctx context.Context, m *birdbroker.Message) error {
+				return errors.New("some error, so that the job is retried")
 			},
-			ReserveFunc: func(timeout time.Duration) (id uint64, body []byte, err error) {
-				// Only return a job on the first invocation.
-				once.Do(func() {
-					b := []byte(`{
-	"body": "Hello",
-	"originator": "Foo Inc",
-	"recipient": "31612345678"
-}`)
-					id = uint64(42)
-					body = b
-					err = nil
-				})
-
-				if body == nil {
-					time.Sleep(timeout)
-					err = errors.New("timeout")
+			JobBuriedFunc: func(m *birdbroker.Message, br *birdbroker.BuryRecord) {
+				buried = true
+			},
+		}
+		consumeOne(t, NewConsumer(c, h, WithReserveTimeout(10*time.Millisecond), WithRetryPolicy(RetryPolicy{MaxAttempts: 4})), c)
+
+		if buried {
+			t.Errorf("Got buried job, expected it to be retried")
+		}
+		if h := peekHeaders(t, q, id+1); h[HeaderAttempts] != "3" {
+			t.Errorf("Got %v, expected 3 failed attempts in the headers", h)
+		}
+	})
+
+	t.Run("Notifies handler of retried jobs", func(t *testing.T) {
+		q := NewMemory()
+		id, _ := q.Put([]byte(helloJob), 0, 0, time.Minute)
+		c := newDoneConn(q)
+
+		var retriedAs uint64
+		h := &retryRecorder{
+			ServeJobFunc: func(ctx context.Context, m *birdbroker.Message) error {
+				return errors.New("some error, so that the job is retried")
+			},
+			JobRetriedFunc: func(m *birdbroker.Message, jobID uint64) {
+				if m.ID != "abc" {
+					t.Errorf("Got %q, expected abc", m.ID)
 				}
-				return
+				retriedAs = jobID
 			},
-		}, hf)
+		}
+		consumeOne(t, NewConsumer(c, h, WithReserveTimeout(10*time.Millisecond)), c)
 
-		wg.Add(1)
-		go func() {
-			// Run on separate goroutine: ListenAndServe blocks until it's
-			// closed.
-			if err := cons.ListenAndServe(); !errors.Is(err, ErrConsumerClosed) {
-				t.Errorf("Got %T (%s), expected ErrConsumerClosed", err, err)
-			}
-		}()
+		if retriedAs != id+1 {
+			t.Errorf("Got %d, expected %d", retriedAs, id+1)
+		}
+	})
 
-		wg.Wait()
-		if err := cons.Shutdown(context.Background()); err != nil {
-			t.Errorf("Consumer: Shutdown: %s", err)
+	t.Run("Buries failed jobs without stats", func(t *testing.T) {
+		q := NewMemory()
+		q.Put([]byte(helloJob), 0, 0, time.Minute)
+		c := newDoneConn(q)
+
+		var br *birdbroker.BuryRecord
+		h := &buryRecorder{
+			ServeJobFunc: func(ctx context.Context, m *birdbroker.Message) error {
+				return errors.New("some error")
+			},
+			JobBuriedFunc: func(m *birdbroker.Message, r *birdbroker.BuryRecord) {
+				br = r
+			},
 		}
+		cons := NewConsumer(&mock.ConsumerConn{
+			BuryFunc:    c.Bury,
+			ReserveFunc: c.Reserve,
+			StatsJobFunc: func(id uint64) (map[string]string, error) {
+				return nil, errors.New("not found")
+			},
+		}, h, WithReserveTimeout(10*time.Millisecond))
+		consumeOne(t, cons, c)
 
-		if !handlerCalled {
+		if br == nil || br.Reason != birdbroker.BuryNoStats {
+			t.Errorf("Got %+v, expected a bury record for missing stats", br)
+		}
+	})
+
+	t.Run("Buries jobs after max attempts", func(t *testing.T) {
+		q := NewMemory()
+		id, _ := q.Put([]byte(helloJob), 0, 0, time.Minute)
+		c := newDoneConn(q)
+
+		var notified bool
+		h := &buryRecorder{
+			ServeJobFunc: func(ctx context.Context, m *birdbroker.Message) error {
+				return errors.New("some error, so that the job is retried")
+			},
+			JobBuriedFunc: func(m *birdbroker.Message, br *birdbroker.BuryRecord) {
+				notified = true
+
+				if m.ID != "abc" {
+					t.Errorf("Got %q, expected abc", m.ID)
+				}
+				if br.Reason != birdbroker.BuryMaxAttempts {
+					t.Errorf("Got %q, expected %q", br.Reason, birdbroker.BuryMaxAttempts)
+				}
+				if br.Error == "" {
+					t.Errorf("Got empty error, expected error")
+				}
+			},
+		}
+		consumeOne(t, NewConsumer(c, h, WithReserveTimeout(10*time.Millisecond), WithRetryPolicy(RetryPolicy{MaxAttempts: 1})), c)
+
+		if stats := jobStats(q, id); stats["state"] != "buried" || stats["releases"] != "0" {
+			t.Errorf("Got %v, expected a job buried without being released", stats)
+		}
+		if !notified {
 			t.Errorf("Got false, expected true")
 		}
-		if !released {
+	})
+
+	t.Run("Buries permanently failed jobs", func(t *testing.T) {
+		q := NewMemory()
+		id, _ := q.Put([]byte(helloJob), priorityBulk, 0, time.Minute)
+		c := newDoneConn(q)
+
+		var notified bool
+		h := &buryRecorder{
+			ServeJobFunc: func(ctx context.Context, m *birdbroker.Message) error {
+				return Permanent(errors.New("invalid recipient"))
+			},
+			JobBuriedFunc: func(m *birdbroker.Message, br *birdbroker.BuryRecord) {
+				notified = true
+
+				if br.Reason != birdbroker.BuryPermanentError {
+					t.Errorf("Got %q, expected %q", br.Reason, birdbroker.BuryPermanentError)
+				}
+				if !strings.Contains(br.Error, "invalid recipient") {
+					t.Errorf("Got %q, expected it to contain the cause", br.Error)
+				}
+			},
+		}
+		consumeOne(t, NewConsumer(c, h, WithReserveTimeout(10*time.Millisecond)), c)
+
+		// The job is buried on its first attempt, and keeps its priority.
+		stats := jobStats(q, id)
+		if stats["state"] != "buried" || stats["releases"] != "0" || jobPriority(stats) != priorityBulk {
+			t.Errorf("Got %v, expected a job buried without retries at priority %d", stats, priorityBulk)
+		}
+		if !notified {
 			t.Errorf("Got false, expected true")
 		}
 	})
 
+	t.Run("Buries jobs without stats at default priority", func(t *testing.T) {
+		q := NewMemory()
+		q.Put([]byte(helloJob), priorityBulk, 0, time.Minute)
+		c := newDoneConn(q)
+
+		hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
+			return Permanent(errors.New("invalid recipient"))
+		})
+		var pri uint32
+		cons := NewConsumer(&mock.ConsumerConn{
+			BuryFunc: func(id uint64, p uint32) error {
+				pri = p
+				return c.Bury(id, p)
+			},
+			ReserveFunc: c.Reserve,
+			StatsJobFunc: func(id uint64) (map[string]string, error) {
+				return nil, errors.New("not found")
+			},
+		}, hf, WithReserveTimeout(10*time.Millisecond))
+		consumeOne(t, cons, c)
+
+		if pri != defaultPriority {
+			t.Errorf("Got %d, expected %d", pri, defaultPriority)
+		}
+	})
+
 	t.Run("Deletes successful jobs", func(t *testing.T) {
-		// once is used to only return a single job from Reserve.
-		var once sync.Once
-		// wg is decremented within the DeleteFunc, so we can wait for it to be
-		// invoked before shutting down the consumer later (as ListenAndServe
-		// is ran on its own goroutine).
-		var wg sync.WaitGroup
+		q := NewMemory()
+		id, _ := q.Put([]byte(helloJob), 0, 0, time.Minute)
+		c := newDoneConn(q)
 
 		var handlerCalled bool
 		hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
@@ -181,66 +418,216 @@ func TestListenAndServe(t *testing.T) {
 			if m.Body != "Hello" {
 				t.Errorf("Got %q, expected Hello", m.Body)
 			}
-			if m.Originator != "Foo Inc" {
-				t.Errorf("Got %q, expected Foo Inc", m.Originator)
-			}
-			if m.Recipient != "31612345678" {
-				t.Errorf("Got %q, expected 31612345678", m.Recipient)
-			}
-
 			return nil
 		})
-		var deleted bool
-		cons := NewConsumer(&mock.ConsumerConn{
-			DeleteFunc: func(id uint64) error {
-				defer wg.Done()
-				deleted = true
+		consumeOne(t, NewConsumer(c, hf, WithReserveTimeout(10*time.Millisecond)), c)
 
-				if id != 42 {
-					t.Errorf("Got %d, expected 42", id)
-				}
-				return nil
-			},
-			ReserveFunc: func(timeout time.Duration) (id uint64, body []byte, err error) {
-				// Only return a job on the first invocation.
-				once.Do(func() {
-					b := []byte(`{
-	"body": "Hello",
-	"originator": "Foo Inc",
-	"recipient": "31612345678"
-}`)
-					id = uint64(42)
-					body = b
-					err = nil
-				})
-
-				if body == nil {
-					time.Sleep(timeout)
-					err = errors.New("timeout")
-				}
-				return
+		if !handlerCalled {
+			t.Errorf("Got false, expected true")
+		}
+		if stats := jobStats(q, id); stats != nil {
+			t.Errorf("Got %v, expected the job to be deleted", stats)
+		}
+	})
+
+	t.Run("Backs off while Reserve fails", func(t *testing.T) {
+		reserved := make(chan time.Time, 10)
+		c := &mock.ConsumerConn{
+			ReserveFunc: func(timeout time.Duration) (uint64, []byte, error) {
+				reserved <- time.Now()
+				return 0, nil, ErrDisconnected
 			},
-		}, hf)
+		}
+		hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
+			t.Fatalf("Must never be called")
+			return nil
+		})
+		cons := NewConsumer(c, hf)
 
-		wg.Add(1)
+		errCh := make(chan error, 1)
 		go func() {
-			// Run on separate goroutine: ListenAndServe blocks until it's
-			// closed.
-			if err := cons.ListenAndServe(); !errors.Is(err, ErrConsumerClosed) {
-				t.Errorf("Got %T (%s), expected ErrConsumerClosed", err, err)
-			}
+			errCh <- cons.ListenAndServe()
 		}()
 
-		wg.Wait()
+		// Every attempt waits twice as long as the one before.
+		var times []time.Time
+		for i := 0; i < 3; i++ {
+			times = append(times, <-reserved)
+		}
+		if d := times[1].Sub(times[0]); d < defaultMinBackoff {
+			t.Errorf("Got %s between attempts, expected at least %s", d, defaultMinBackoff)
+		}
+		if d := times[2].Sub(times[1]); d < 2*defaultMinBackoff {
+			t.Errorf("Got %s between attempts, expected at least %s", d, 2*defaultMinBackoff)
+		}
+
+		// Shutdown does not wait for the backoff to pass.
+		start := time.Now()
 		if err := cons.Shutdown(context.Background()); err != nil {
 			t.Errorf("Consumer: Shutdown: %s", err)
 		}
+		if err := <-errCh; !errors.Is(err, ErrConsumerClosed) {
+			t.Errorf("Got %T (%s), expected ErrConsumerClosed", err, err)
+		}
+		if d := time.Since(start); d >= 4*defaultMinBackoff {
+			t.Errorf("Got %s, expected ListenAndServe to return before the backoff passed", d)
+		}
+	})
+}
 
-		if !handlerCalled {
-			t.Errorf("Got false, expected true")
+func TestNextBackoff(t *testing.T) {
+	var d time.Duration
+	for _, want := range []time.Duration{defaultMinBackoff, 2 * defaultMinBackoff, 4 * defaultMinBackoff} {
+		if d = nextBackoff(d); d != want {
+			t.Errorf("Got %s, expected %s", d, want)
 		}
-		if !deleted {
-			t.Errorf("Got false, expected true")
+	}
+	if d = nextBackoff(defaultMaxBackoff); d != defaultMaxBackoff {
+		t.Errorf("Got %s, expected %s", d, defaultMaxBackoff)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	q := NewMemory()
+	var ids []uint64
+	for i := 0; i < 5; i++ {
+		id, _ := q.Put([]byte(`{"body":"Hello"}`), 0, 0, time.Minute)
+		ids = append(ids, id)
+	}
+
+	// release is closed to let all blocked handlers return.
+	release := make(chan struct{})
+	// started receives a value every time a handler is invoked.
+	started := make(chan struct{}, 10)
+
+	hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	// saturated is set if a job is reserved while all slots are busy. third
+	// is closed once a third job is being reserved, which is only allowed
+	// after a handler returned.
+	var cons *consumer
+	var calls, saturated int64
+	third := make(chan struct{})
+	conn := &reserveConn{memoryConn: q.Conn(), hook: func() {
+		if cons.InFlight() >= 2 {
+			atomic.StoreInt64(&saturated, 1)
+		}
+		if atomic.AddInt64(&calls, 1) == 3 {
+			close(third)
+		}
+	}}
+	cons = NewConsumer(conn, hf, WithConcurrency(2), WithReserveTimeout(10*time.Millisecond))
+
+	if c := cons.Concurrency(); c != 2 {
+		t.Errorf("Got %d, expected 2", c)
+	}
+
+	go func() {
+		// Run on separate goroutine: ListenAndServe blocks until it's
+		// closed.
+		if err := cons.ListenAndServe(); !errors.Is(err, ErrConsumerClosed) {
+			t.Errorf("Got %T (%s), expected ErrConsumerClosed", err, err)
+		}
+	}()
+
+	<-started
+	<-started
+
+	var reserved int
+	for _, id := range ids {
+		if jobStats(q, id)["state"] == "reserved" {
+			reserved++
+		}
+	}
+	if reserved != 2 {
+		t.Errorf("Got %d, expected 2", reserved)
+	}
+	if n := cons.InFlight(); n != 2 {
+		t.Errorf("Got %d, expected 2", n)
+	}
+	if u := cons.Utilization(); u != 1 {
+		t.Errorf("Got %f, expected 1", u)
+	}
+
+	close(release)
+	select {
+	case <-third:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a third job to be reserved")
+	}
+	if err := cons.Shutdown(context.Background()); err != nil {
+		t.Errorf("Consumer: Shutdown: %s", err)
+	}
+	if atomic.LoadInt64(&saturated) != 0 {
+		t.Error("Expected no job to be reserved while all slots were busy")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("Drains in-flight jobs", func(t *testing.T) {
+		q := NewMemory()
+		id, _ := q.Put([]byte(`{"body":"Hello"}`), 0, 0, time.Minute)
+
+		started := make(chan struct{})
+		finish := make(chan struct{})
+		hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
+			close(started)
+			<-finish
+			return nil
+		})
+		cons := NewConsumer(q.Conn(), hf, WithReserveTimeout(10*time.Millisecond))
+
+		go cons.ListenAndServe()
+		<-started
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- cons.Shutdown(context.Background())
+		}()
+
+		select {
+		case err := <-errCh:
+			t.Fatalf("Got %v, expected Shutdown to block", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(finish)
+		if err := <-errCh; err != nil {
+			t.Errorf("Consumer: Shutdown: %s", err)
+		}
+		if stats := jobStats(q, id); stats != nil {
+			t.Errorf("Got %v, expected the job to be deleted", stats)
+		}
+	})
+
+	t.Run("Releases jobs at deadline", func(t *testing.T) {
+		q := NewMemory()
+		id, _ := q.Put([]byte(`{"body":"Hello"}`), priorityOTP, 0, time.Minute)
+
+		started := make(chan struct{})
+		hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		cons := NewConsumer(q.Conn(), hf, WithReserveTimeout(10*time.Millisecond))
+
+		go cons.ListenAndServe()
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := cons.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Got %v, expected context.DeadlineExceeded", err)
+		}
+
+		// The job is released once, right away, and keeps its priority.
+		stats := jobStats(q, id)
+		if stats["state"] != "ready" || stats["releases"] != "1" || jobPriority(stats) != priorityOTP {
+			t.Errorf("Got %v, expected a ready job released once at priority %d", stats, priorityOTP)
 		}
 	})
 }
@@ -0,0 +1,106 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// envelopeVersion is the version of the envelope format jobs are put with.
+//
+// Consumers must be able to decode the envelopes of every version senders
+// use, so consumers are to be deployed before senders that use a new
+// version.
+const envelopeVersion = 1
+
+// Headers holds the metadata of a job, such as the ID of the message it
+// holds, or a trace context.
+type Headers map[string]string
+
+// Headers set on every job holding a message.
+const (
+	HeaderMessageID  = "message-id"
+	HeaderEnqueuedAt = "enqueued-at"
+)
+
+// HeaderAttempts is set by consumers on jobs they put back after a failure,
+// and holds the number of failed attempts at handling the job so far.
+const HeaderAttempts = "attempts"
+
+// Envelope wraps the payload of a job together with its headers. Jobs that
+// were put before envelopes were introduced hold a bare payload, which is
+// recognized by the lack of a version.
+type Envelope struct {
+	Version int             `json:"v"`
+	Headers Headers         `json:"headers,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// encodeEnvelope returns the body of a job holding payload v with headers h.
+func encodeEnvelope(v interface{}, h Headers) ([]byte, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encoding/json: Marshal: %s", err)
+	}
+	b, err := json.Marshal(Envelope{
+		Version: envelopeVersion,
+		Headers: h,
+		Payload: p,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding/json: Marshal: %s", err)
+	}
+	return b, nil
+}
+
+// DecodeEnvelope decodes the body b of a job. Bodies without a version are
+// taken to be a bare payload without headers.
+func DecodeEnvelope(b []byte) (*Envelope, error) {
+	var env struct {
+		Version *int            `json:"v"`
+		Headers Headers         `json:"headers"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("%w: encoding/json: Unmarshal: %s", errMalformed, err)
+	}
+
+	switch {
+	case env.Version == nil:
+		return &Envelope{Payload: b}, nil
+	case *env.Version == 1:
+		if len(env.Payload) == 0 {
+			return nil, fmt.Errorf("%w: envelope without payload", errMalformed)
+		}
+		return &Envelope{Version: 1, Headers: env.Headers, Payload: env.Payload}, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported envelope version %d", errMalformed, *env.Version)
+	}
+}
+
+type headersKey struct{}
+
+// ContextWithHeaders returns a copy of ctx holding headers h. Senders add
+// these to the jobs they put, and consumers pass the headers of a job on to
+// handlers this way.
+func ContextWithHeaders(ctx context.Context, h Headers) context.Context {
+	return context.WithValue(ctx, headersKey{}, h)
+}
+
+// HeadersFromContext returns the headers held by ctx, if any.
+func HeadersFromContext(ctx context.Context) Headers {
+	h, _ := ctx.Value(headersKey{}).(Headers)
+	return h
+}
+
+// jobHeaders returns the headers held by ctx, combined with extra.
+func jobHeaders(ctx context.Context, extra Headers) Headers {
+	h := make(Headers)
+	for k, v := range HeadersFromContext(ctx) {
+		h[k] = v
+	}
+	for k, v := range extra {
+		h[k] = v
+	}
+	return h
+}
@@ -0,0 +1,168 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/internal/mock"
+)
+
+// decodePayload decodes the payload of job body b into v.
+func decodePayload(t *testing.T, b []byte, v interface{}) {
+	t.Helper()
+
+	env, err := DecodeEnvelope(b)
+	if err != nil {
+		t.Fatalf("DecodeEnvelope: %s", err)
+	}
+	if err := json.Unmarshal(env.Payload, v); err != nil {
+		t.Fatalf("encoding/json: Unmarshal: %s", err)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	t.Run("Round trip", func(t *testing.T) {
+		b, err := encodeEnvelope(map[string]string{"body": "Hello"}, Headers{"tenant": "acme"})
+		if err != nil {
+			t.Fatalf("encodeEnvelope: %s", err)
+		}
+
+		env, err := DecodeEnvelope(b)
+		if err != nil {
+			t.Fatalf("DecodeEnvelope: %s", err)
+		}
+		if env.Version != envelopeVersion {
+			t.Errorf("Got %d, expected %d", env.Version, envelopeVersion)
+		}
+		if env.Headers["tenant"] != "acme" {
+			t.Errorf("Got %q, expected acme", env.Headers["tenant"])
+		}
+		if p := string(env.Payload); p != `{"body":"Hello"}` {
+			t.Errorf(`Got %q, expected {"body":"Hello"}`, p)
+		}
+	})
+
+	t.Run("Bare payload", func(t *testing.T) {
+		b := []byte(`{"body":"Hello"}`)
+		env, err := DecodeEnvelope(b)
+		if err != nil {
+			t.Fatalf("DecodeEnvelope: %s", err)
+		}
+		if string(env.Payload) != string(b) {
+			t.Errorf("Got %q, expected %q", env.Payload, b)
+		}
+		if env.Headers != nil {
+			t.Errorf("Got %v, expected no headers", env.Headers)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tt := []struct {
+			name string
+			body string
+		}{
+			{"Not JSON", "not valid json"},
+			{"Unknown version", `{"v":2,"payload":{}}`},
+			{"Without payload", `{"v":1}`},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				if _, err := DecodeEnvelope([]byte(tc.body)); !errors.Is(err, errMalformed) {
+					t.Errorf("Got %v, expected errMalformed", err)
+				}
+			})
+		}
+	})
+}
+
+func TestJobHeaders(t *testing.T) {
+	ctx := ContextWithHeaders(context.Background(), Headers{"traceparent": "00-abc-def-01", HeaderMessageID: "old"})
+	h := jobHeaders(ctx, Headers{HeaderMessageID: "abc"})
+
+	if h["traceparent"] != "00-abc-def-01" {
+		t.Errorf("Got %q, expected 00-abc-def-01", h["traceparent"])
+	}
+	if h[HeaderMessageID] != "abc" {
+		t.Errorf("Got %q, expected abc", h[HeaderMessageID])
+	}
+}
+
+func TestConsumeEnvelope(t *testing.T) {
+	// reserve returns a ReserveFunc that hands out a single job with body b,
+	// and times out afterwards.
+	reserve := func(b []byte) func(timeout time.Duration) (uint64, []byte, error) {
+		var once sync.Once
+		return func(timeout time.Duration) (id uint64, body []byte, err error) {
+			once.Do(func() {
+				id, body = 42, b
+			})
+			if body == nil {
+				time.Sleep(timeout)
+				err = beanstalk.ErrTimeout
+			}
+			return
+		}
+	}
+
+	t.Run("Headers", func(t *testing.T) {
+		b, err := encodeEnvelope(&birdbroker.Message{Body: "Hello"}, Headers{"tenant": "acme"})
+		if err != nil {
+			t.Fatalf("encodeEnvelope: %s", err)
+		}
+
+		done := make(chan struct{})
+		hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
+			if m.Body != "Hello" {
+				t.Errorf("Got %q, expected Hello", m.Body)
+			}
+			if tenant := HeadersFromContext(ctx)["tenant"]; tenant != "acme" {
+				t.Errorf("Got %q, expected acme", tenant)
+			}
+			return nil
+		})
+		cons := NewConsumer(&mock.ConsumerConn{
+			DeleteFunc: func(id uint64) error {
+				close(done)
+				return nil
+			},
+			ReserveFunc: reserve(b),
+		}, hf, WithReserveTimeout(10*time.Millisecond))
+
+		go cons.ListenAndServe()
+		<-done
+		if err := cons.Shutdown(context.Background()); err != nil {
+			t.Errorf("Consumer: Shutdown: %s", err)
+		}
+	})
+
+	t.Run("Unknown version", func(t *testing.T) {
+		done := make(chan struct{})
+		hf := handlerFunc(func(ctx context.Context, m *birdbroker.Message) error {
+			t.Errorf("Must never be called")
+			return nil
+		})
+		cons := NewConsumer(&mock.ConsumerConn{
+			BuryFunc: func(id uint64, pri uint32) error {
+				close(done)
+				return nil
+			},
+			ReserveFunc: reserve([]byte(`{"v":99,"payload":{"body":"Hello"}}`)),
+			StatsJobFunc: func(id uint64) (map[string]string, error) {
+				return map[string]string{"pri": "0"}, nil
+			},
+		}, hf, WithReserveTimeout(10*time.Millisecond))
+
+		go cons.ListenAndServe()
+		<-done
+		if err := cons.Shutdown(context.Background()); err != nil {
+			t.Errorf("Consumer: Shutdown: %s", err)
+		}
+	})
+}
@@ -0,0 +1,26 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestPermanent(t *testing.T) {
+	err := errors.New("oops")
+	if IsPermanent(err) {
+		t.Errorf("Got true, expected false")
+	}
+
+	wrapped := fmt.Errorf("handler: %w", Permanent(err))
+	if !IsPermanent(wrapped) {
+		t.Errorf("Got false, expected true")
+	}
+	if !errors.Is(wrapped, err) {
+		t.Errorf("Got false, expected true")
+	}
+
+	if Permanent(nil) != nil {
+		t.Errorf("Got non-nil, expected nil")
+	}
+}
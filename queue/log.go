@@ -0,0 +1,594 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/internal/jobs"
+)
+
+// logPollInterval is how often a connection waiting for a job checks whether
+// another process put one in the log.
+const logPollInterval = 100 * time.Millisecond
+
+// logCompactMin is the number of records a log holds at least before it is
+// compacted.
+const logCompactMin = 1000
+
+// Operations recorded in a log.
+const (
+	opPut     = "put"
+	opReserve = "reserve"
+	opRelease = "release"
+	opBury    = "bury"
+	opKick    = "kick"
+	opDelete  = "delete"
+	opJob     = "job" // The full state of a job, written by compaction.
+	opSeq     = "seq" // The last ID handed out, written by compaction.
+)
+
+// logQueue is a queue that keeps its jobs in an append-only log file, so
+// they survive restarts and crashes. It behaves like the memory queue, and
+// so like beanstalkd, but can be shared by processes on the same host: every
+// operation takes a lock on the log, catches up with the records other
+// processes appended, and appends a record of its own.
+//
+// Jobs reserved by a process that crashed are handed out again once their
+// time to run passed. The log is compacted when most of its records no
+// longer matter.
+type logQueue struct {
+	path       string
+	lock       *os.File // Locked across processes while the log is used.
+	process    string   // Identifies this process in owners of reserved jobs.
+	compactMin int
+
+	mu       sync.Mutex // Serializes use of the log within this process.
+	f        *os.File
+	offset   int64 // Up to where f was read.
+	records  int   // Number of records in f.
+	jobs     jobs.Set
+	lastID   uint64
+	lastConn uint64
+	wake     chan struct{} // Closed when a job may have become ready.
+}
+
+// logRecord is a line in a log.
+type logRecord struct {
+	Op    string        `json:"op"`
+	ID    uint64        `json:"id"`
+	At    time.Time     `json:"at"`
+	Tube  string        `json:"tube,omitempty"`
+	Body  []byte        `json:"body,omitempty"`
+	Pri   uint32        `json:"pri,omitempty"`
+	Delay time.Duration `json:"delay,omitempty"`
+	TTR   time.Duration `json:"ttr,omitempty"`
+	Owner string        `json:"owner,omitempty"`
+	Job   *logJob       `json:"job,omitempty"`
+}
+
+// logJob is the state of a job, as written by compaction.
+type logJob struct {
+	Tube     string        `json:"tube"`
+	Body     []byte        `json:"body"`
+	Pri      uint32        `json:"pri"`
+	Delay    time.Duration `json:"delay"`
+	TTR      time.Duration `json:"ttr"`
+	Created  time.Time     `json:"created"`
+	State    string        `json:"state"`
+	Until    time.Time     `json:"until"`
+	Owner    string        `json:"owner,omitempty"`
+	Reserves int           `json:"reserves"`
+	Timeouts int           `json:"timeouts"`
+	Releases int           `json:"releases"`
+	Buries   int           `json:"buries"`
+	Kicks    int           `json:"kicks"`
+}
+
+// OpenLog opens the queue kept in the log file at path, creating it if it
+// does not exist yet. A lock file is kept next to it.
+func OpenLog(path string) (*logQueue, error) {
+	process, err := birdbroker.NewID()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("os: OpenFile: %s", err)
+	}
+	q := &logQueue{
+		path:       path,
+		lock:       lock,
+		process:    process,
+		compactMin: logCompactMin,
+		wake:       make(chan struct{}),
+	}
+	if err := q.do(nil); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Conn returns a connection to q that puts jobs in the default tube, and
+// reserves jobs from tubes, or from the default tube if none are given.
+func (q *logQueue) Conn(tubes ...string) *logConn {
+	if len(tubes) == 0 {
+		tubes = []string{"default"}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.lastConn++
+	id := q.process + "-" + strconv.FormatUint(q.lastConn, 10)
+	return &logConn{q: q, id: id, use: "default", watch: tubes}
+}
+
+// Tube returns a connection that puts jobs in the tube named name.
+func (q *logQueue) Tube(name string) producerConn {
+	return &logConn{q: q, use: name}
+}
+
+// Put puts a job in the default tube.
+func (q *logQueue) Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	return q.put("default", body, pri, delay, ttr)
+}
+
+// Delete deletes the job identified by id, unless it is reserved.
+func (q *logQueue) Delete(id uint64) error {
+	return q.delete("", id)
+}
+
+// KickJob moves the buried job identified by id back to the ready queue.
+func (q *logQueue) KickJob(id uint64) error {
+	return q.do(func(now time.Time) (*logRecord, error) {
+		j, ok := q.jobs[id]
+		if !ok || j.State != jobs.StateBuried {
+			return nil, beanstalk.ConnError{Op: "kick-job", Err: beanstalk.ErrNotFound}
+		}
+		return &logRecord{Op: opKick, ID: id}, nil
+	})
+}
+
+// Peek returns the body of the job identified by id.
+func (q *logQueue) Peek(id uint64) ([]byte, error) {
+	var body []byte
+	err := q.do(func(now time.Time) (*logRecord, error) {
+		j, ok := q.jobs[id]
+		if !ok {
+			return nil, beanstalk.ConnError{Op: "peek", Err: beanstalk.ErrNotFound}
+		}
+		body = append([]byte(nil), j.Body...)
+		return nil, nil
+	})
+	return body, err
+}
+
+// PeekBuried returns the buried job in tube that is kicked first.
+func (q *logQueue) PeekBuried(tube string) (uint64, []byte, error) {
+	var (
+		id   uint64
+		body []byte
+	)
+	err := q.do(func(now time.Time) (*logRecord, error) {
+		j := q.jobs.First(tube, jobs.StateBuried)
+		if j == nil {
+			return nil, beanstalk.ConnError{Op: "peek-buried", Err: beanstalk.ErrNotFound}
+		}
+		id, body = j.ID, append([]byte(nil), j.Body...)
+		return nil, nil
+	})
+	return id, body, err
+}
+
+// StatsJob returns the statistics of the job identified by id.
+func (q *logQueue) StatsJob(id uint64) (map[string]string, error) {
+	var stats map[string]string
+	err := q.do(func(now time.Time) (*logRecord, error) {
+		j, ok := q.jobs[id]
+		if !ok {
+			return nil, beanstalk.ConnError{Op: "stats-job", Err: beanstalk.ErrNotFound}
+		}
+		stats = j.Stats(now)
+		return nil, nil
+	})
+	return stats, err
+}
+
+// StatsTube returns how many jobs tube holds in every state.
+func (q *logQueue) StatsTube(tube string) (map[string]string, error) {
+	var stats map[string]string
+	err := q.do(func(now time.Time) (*logRecord, error) {
+		stats, _ = q.jobs.Counts(tube)
+		stats["name"] = tube
+		return nil, nil
+	})
+	return stats, err
+}
+
+// Close closes the log. Jobs reserved through q remain reserved until their
+// time to run passed.
+func (q *logQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var err error
+	if q.f != nil {
+		if cerr := q.f.Close(); cerr != nil {
+			err = fmt.Errorf("os: File.Close: %s", cerr)
+		}
+	}
+	if cerr := q.lock.Close(); cerr != nil {
+		err = fmt.Errorf("os: File.Close: %s", cerr)
+	}
+	return err
+}
+
+func (q *logQueue) put(tube string, body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	var id uint64
+	err := q.do(func(now time.Time) (*logRecord, error) {
+		id = q.lastID + 1
+		return &logRecord{Op: opPut, ID: id, Tube: tube, Body: body, Pri: pri, Delay: delay, TTR: ttr}, nil
+	})
+	return id, err
+}
+
+func (q *logQueue) delete(owner string, id uint64) error {
+	return q.do(func(now time.Time) (*logRecord, error) {
+		if !q.jobs.Deletable(owner, id) {
+			return nil, beanstalk.ConnError{Op: "delete", Err: beanstalk.ErrNotFound}
+		}
+		return &logRecord{Op: opDelete, ID: id}, nil
+	})
+}
+
+// do locks the log, catches up with it, and calls fn with the jobs up to date
+// at now. The record fn returns, if any, is appended to the log and applied.
+// If fn is nil, do only catches up.
+func (q *logQueue) do(fn func(now time.Time) (*logRecord, error)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := syscall.Flock(int(q.lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("syscall: Flock: %s", err)
+	}
+	defer syscall.Flock(int(q.lock.Fd()), syscall.LOCK_UN)
+
+	if err := q.catchUp(); err != nil {
+		return err
+	}
+	if fn == nil {
+		return nil
+	}
+	now := time.Now()
+	q.jobs.Tick(now)
+	rec, err := fn(now)
+	if err != nil || rec == nil {
+		return err
+	}
+	rec.At = now
+	if err := q.append(rec); err != nil {
+		return err
+	}
+	q.apply(rec)
+	q.notify()
+
+	if q.records >= q.compactMin && q.records > 2*len(q.jobs) {
+		// The operation took effect already, so it must not fail: the
+		// log is compacted by a later operation instead.
+		if err := q.compact(); err != nil {
+			log.Printf("%T: compact: %s", q, err)
+		}
+	}
+	return nil
+}
+
+// catchUp applies the records appended to the log since it was last read,
+// reopening the log if another process replaced it by compacting it.
+func (q *logQueue) catchUp() error {
+	fi, err := os.Stat(q.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os: Stat: %s", err)
+	}
+	if q.f == nil || fi == nil {
+		return q.open()
+	}
+	cur, err := q.f.Stat()
+	if err != nil {
+		return fmt.Errorf("os: File.Stat: %s", err)
+	}
+	if !os.SameFile(fi, cur) {
+		return q.open()
+	}
+	if cur.Size() == q.offset {
+		return nil
+	}
+
+	if _, err := q.f.Seek(q.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("os: File.Seek: %s", err)
+	}
+	r := bufio.NewReader(q.f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// The process appending this record crashed halfway, so
+				// it never took effect.
+				if err := q.f.Truncate(q.offset); err != nil {
+					return fmt.Errorf("os: File.Truncate: %s", err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("bufio: Reader.ReadBytes: %s", err)
+		}
+
+		var rec logRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("%s: record at offset %d: %s", q.path, q.offset, err)
+		}
+		q.apply(&rec)
+		q.offset += int64(len(line))
+		q.records++
+	}
+}
+
+// open (re)opens the log, and reads it from the start.
+func (q *logQueue) open() error {
+	f, err := os.OpenFile(q.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("os: OpenFile: %s", err)
+	}
+	if q.f != nil {
+		q.f.Close()
+	}
+	q.f, q.offset, q.records = f, 0, 0
+	q.jobs, q.lastID = make(jobs.Set), 0
+	return q.catchUp()
+}
+
+func (q *logQueue) append(rec *logRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encoding/json: Marshal: %s", err)
+	}
+	b = append(b, '\n')
+	if _, err := q.f.Write(b); err != nil {
+		return fmt.Errorf("os: File.Write: %s", err)
+	}
+	if err := q.f.Sync(); err != nil {
+		return fmt.Errorf("os: File.Sync: %s", err)
+	}
+	q.offset += int64(len(b))
+	q.records++
+	return nil
+}
+
+// apply applies rec to the jobs, at the time rec was appended.
+func (q *logQueue) apply(rec *logRecord) {
+	q.jobs.Tick(rec.At)
+	if rec.ID > q.lastID {
+		q.lastID = rec.ID
+	}
+
+	switch rec.Op {
+	case opPut:
+		q.jobs[rec.ID] = jobs.New(rec.ID, rec.Tube, rec.Body, rec.Pri, rec.Delay, rec.TTR, rec.At)
+		return
+	case opJob:
+		q.jobs[rec.ID] = rec.Job.job(rec.ID)
+		return
+	case opDelete:
+		delete(q.jobs, rec.ID)
+		return
+	}
+
+	j, ok := q.jobs[rec.ID]
+	if !ok {
+		return
+	}
+	switch rec.Op {
+	case opReserve:
+		j.Reserve(rec.Owner, rec.At)
+	case opRelease:
+		j.Release(rec.Pri, rec.Delay, rec.At)
+	case opBury:
+		j.Bury(rec.Pri)
+	case opKick:
+		j.Kick()
+	}
+}
+
+// compact replaces the log by one that holds a record of every job, written
+// to a temporary file first so a crash leaves either log intact.
+func (q *logQueue) compact() error {
+	tmp := q.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("os: OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	ids := make([]uint64, 0, len(q.jobs))
+	for id := range q.jobs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	now := time.Now()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(logRecord{Op: opSeq, ID: q.lastID, At: now}); err != nil {
+		return fmt.Errorf("encoding/json: Encoder.Encode: %s", err)
+	}
+	for _, id := range ids {
+		if err := enc.Encode(logRecord{Op: opJob, ID: id, At: now, Job: newLogJob(q.jobs[id])}); err != nil {
+			return fmt.Errorf("encoding/json: Encoder.Encode: %s", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("bufio: Writer.Flush: %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("os: File.Sync: %s", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("os: Rename: %s", err)
+	}
+	return q.open()
+}
+
+// notify wakes up the connections of this process waiting for a job.
+func (q *logQueue) notify() {
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+func newLogJob(j *jobs.Job) *logJob {
+	return &logJob{
+		Tube:     j.Tube,
+		Body:     j.Body,
+		Pri:      j.Pri,
+		Delay:    j.Delay,
+		TTR:      j.TTR,
+		Created:  j.Created,
+		State:    j.State,
+		Until:    j.Until,
+		Owner:    j.Owner,
+		Reserves: j.Reserves,
+		Timeouts: j.Timeouts,
+		Releases: j.Releases,
+		Buries:   j.Buries,
+		Kicks:    j.Kicks,
+	}
+}
+
+func (lj *logJob) job(id uint64) *jobs.Job {
+	return &jobs.Job{
+		ID:       id,
+		Tube:     lj.Tube,
+		Body:     lj.Body,
+		Pri:      lj.Pri,
+		Delay:    lj.Delay,
+		TTR:      lj.TTR,
+		Created:  lj.Created,
+		State:    lj.State,
+		Until:    lj.Until,
+		Owner:    lj.Owner,
+		Reserves: lj.Reserves,
+		Timeouts: lj.Timeouts,
+		Releases: lj.Releases,
+		Buries:   lj.Buries,
+		Kicks:    lj.Kicks,
+	}
+}
+
+// logConn is a connection to a log queue. Like a beanstalk connection, only
+// the connection that reserved a job can release, bury or delete it.
+type logConn struct {
+	q     *logQueue
+	id    string // Identifies the connection as the owner of reserved jobs.
+	use   string
+	watch []string
+}
+
+func (c *logConn) Bury(id uint64, pri uint32) error {
+	return c.q.do(func(now time.Time) (*logRecord, error) {
+		if c.q.jobs.ReservedBy(c.id, id) == nil {
+			return nil, beanstalk.ConnError{Op: "bury", Err: beanstalk.ErrNotFound}
+		}
+		return &logRecord{Op: opBury, ID: id, Pri: pri}, nil
+	})
+}
+
+func (c *logConn) Delete(id uint64) error {
+	return c.q.delete(c.id, id)
+}
+
+// KickJob moves the buried job identified by id back to the ready queue.
+func (c *logConn) KickJob(id uint64) error {
+	return c.q.KickJob(id)
+}
+
+func (c *logConn) Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	return c.q.put(c.use, body, pri, delay, ttr)
+}
+
+func (c *logConn) Release(id uint64, pri uint32, delay time.Duration) error {
+	return c.q.do(func(now time.Time) (*logRecord, error) {
+		if c.q.jobs.ReservedBy(c.id, id) == nil {
+			return nil, beanstalk.ConnError{Op: "release", Err: beanstalk.ErrNotFound}
+		}
+		return &logRecord{Op: opRelease, ID: id, Pri: pri, Delay: delay}, nil
+	})
+}
+
+// Reserve reserves a job from the watched tubes, waiting at most timeout for
+// one to become ready.
+func (c *logConn) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var (
+			id    uint64
+			body  []byte
+			found bool
+			next  time.Time
+			wake  chan struct{}
+		)
+		err := c.q.do(func(now time.Time) (*logRecord, error) {
+			next, wake = c.q.jobs.Tick(now), c.q.wake
+			j := c.q.jobs.Next(c.watch)
+			if j == nil {
+				return nil, nil
+			}
+			id, body, found = j.ID, append([]byte(nil), j.Body...), true
+			return &logRecord{Op: opReserve, ID: j.ID, Owner: c.id}, nil
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+		if found {
+			return id, body, nil
+		}
+
+		now := time.Now()
+		if !now.Before(deadline) {
+			return 0, nil, beanstalk.ConnError{Op: "reserve-with-timeout", Err: beanstalk.ErrTimeout}
+		}
+		// Jobs put by other processes are only noticed by polling.
+		wait := deadline.Sub(now)
+		if !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		if wait > logPollInterval {
+			wait = logPollInterval
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+func (c *logConn) StatsJob(id uint64) (map[string]string, error) {
+	return c.q.StatsJob(id)
+}
+
+// Tube returns a connection that puts jobs in the tube named name.
+func (c *logConn) Tube(name string) producerConn {
+	return &logConn{q: c.q, id: c.id, use: name, watch: c.watch}
+}
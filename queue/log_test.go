@@ -0,0 +1,224 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "birdbroker-queue")
+	if err != nil {
+		t.Fatalf("ioutil: TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// open opens the log named name in dir.
+	open := func(t *testing.T, name string) *logQueue {
+		t.Helper()
+		q, err := OpenLog(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("OpenLog: %s", err)
+		}
+		return q
+	}
+
+	t.Run("Survives reopening", func(t *testing.T) {
+		q := open(t, "reopen.log")
+		c := q.Conn()
+		buried, _ := q.Put([]byte("buried"), 0, 0, time.Minute)
+		if _, _, err := c.Reserve(0); err != nil {
+			t.Fatalf("Reserve: %s", err)
+		}
+		if err := c.Bury(buried, priorityBulk); err != nil {
+			t.Fatalf("Bury: %s", err)
+		}
+		q.Put([]byte("bulk"), priorityBulk, 0, time.Minute)
+		q.Put([]byte("otp"), priorityOTP, 0, time.Minute)
+		delayed, _ := q.Tube("other").Put([]byte("delayed"), 0, time.Hour, time.Minute)
+		q.Close()
+
+		q = open(t, "reopen.log")
+		defer q.Close()
+		c = q.Conn()
+		if stats, _ := c.StatsJob(buried); stats["state"] != "buried" || jobPriority(stats) != priorityBulk {
+			t.Errorf("Got %v, expected a buried job with priority %d", stats, priorityBulk)
+		}
+		if stats, _ := c.StatsJob(delayed); stats["state"] != "delayed" || stats["tube"] != "other" {
+			t.Errorf("Got %v, expected a delayed job in other", stats)
+		}
+		for _, want := range []string{"otp", "bulk"} {
+			if _, b, err := c.Reserve(0); err != nil || string(b) != want {
+				t.Errorf("Got %q (%v), expected %q", b, err, want)
+			}
+		}
+		if id, _ := q.Put(nil, 0, 0, time.Minute); id != delayed+1 {
+			t.Errorf("Got %d, expected %d", id, delayed+1)
+		}
+	})
+
+	t.Run("Shared between processes", func(t *testing.T) {
+		api, worker := open(t, "shared.log"), open(t, "shared.log")
+		defer api.Close()
+		defer worker.Close()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			api.Tube("otp").Put([]byte("Hello"), 0, 0, time.Minute)
+		}()
+
+		c := worker.Conn("otp")
+		id, b, err := c.Reserve(time.Second)
+		if err != nil || string(b) != "Hello" {
+			t.Fatalf("Got %q (%v), expected Hello", b, err)
+		}
+		if err := api.Delete(id); !isNotFound(err) {
+			t.Errorf("Got %v, expected a reserved job not to be deleted", err)
+		}
+		if err := c.Delete(id); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		if _, err := api.Conn().StatsJob(id); !isNotFound(err) {
+			t.Errorf("Got %v, expected not found", err)
+		}
+	})
+
+	t.Run("Recovers reserved jobs", func(t *testing.T) {
+		q := open(t, "crash.log")
+		id, _ := q.Put([]byte("Hello"), 0, 0, 0)
+		if _, _, err := q.Conn().Reserve(0); err != nil {
+			t.Fatalf("Reserve: %s", err)
+		}
+		// Close without releasing the job, as a crashed worker would.
+		q.Close()
+
+		q = open(t, "crash.log")
+		defer q.Close()
+		c := q.Conn()
+		if stats, _ := c.StatsJob(id); stats["state"] != "reserved" {
+			t.Errorf("Got %q, expected reserved", stats["state"])
+		}
+		// The TTR is at least a second, after which the job is ready again.
+		got, _, err := c.Reserve(2 * time.Second)
+		if err != nil || got != id {
+			t.Fatalf("Got %d (%v), expected %d", got, err, id)
+		}
+		if stats, _ := c.StatsJob(id); stats["timeouts"] != "1" || stats["reserves"] != "2" {
+			t.Errorf("Got %s timeouts and %s reserves, expected 1 and 2", stats["timeouts"], stats["reserves"])
+		}
+	})
+
+	t.Run("Drops torn records", func(t *testing.T) {
+		q := open(t, "torn.log")
+		q.Put([]byte("Hello"), 0, 0, time.Minute)
+		q.Close()
+
+		// A process that crashed while appending leaves half a record.
+		f, err := os.OpenFile(filepath.Join(dir, "torn.log"), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("os: OpenFile: %s", err)
+		}
+		f.WriteString(`{"op":"put","id":2,"bo`)
+		f.Close()
+
+		q = open(t, "torn.log")
+		if id, err := q.Put([]byte("Bye"), 0, 0, time.Minute); err != nil || id != 2 {
+			t.Fatalf("Got %d (%v), expected 2", id, err)
+		}
+		q.Close()
+
+		q = open(t, "torn.log")
+		defer q.Close()
+		c := q.Conn()
+		for _, want := range []string{"Hello", "Bye"} {
+			if _, b, err := c.Reserve(0); err != nil || string(b) != want {
+				t.Errorf("Got %q (%v), expected %q", b, err, want)
+			}
+		}
+	})
+
+	t.Run("Compacts", func(t *testing.T) {
+		q := open(t, "compact.log")
+		defer q.Close()
+		q.compactMin = 10
+		other := open(t, "compact.log")
+		defer other.Close()
+
+		c := q.Conn()
+		kept, _ := q.Put([]byte("kept"), priorityBulk, 0, time.Minute)
+		for i := 0; i < 20; i++ {
+			id, _ := q.Put(nil, 0, 0, time.Minute)
+			if err := c.Delete(id); err != nil {
+				t.Fatalf("Delete: %s", err)
+			}
+		}
+		if q.records >= 10 {
+			t.Errorf("Got %d records, expected the log to be compacted", q.records)
+		}
+
+		// Other processes pick up the compacted log.
+		if stats, err := other.Conn().StatsJob(kept); err != nil || jobPriority(stats) != priorityBulk {
+			t.Errorf("Got %v (%v), expected job %d", stats, err, kept)
+		}
+		if id, _ := other.Put(nil, 0, 0, time.Minute); id != kept+21 {
+			t.Errorf("Got %d, expected %d", id, kept+21)
+		}
+	})
+
+	t.Run("Compaction fails", func(t *testing.T) {
+		q := open(t, "nocompact.log")
+		defer q.Close()
+		q.compactMin = 10
+		// The temporary file can't be created where a directory is.
+		if err := os.Mkdir(filepath.Join(dir, "nocompact.log.tmp"), 0755); err != nil {
+			t.Fatalf("os: Mkdir: %s", err)
+		}
+
+		c := q.Conn()
+		for i := 0; i < 20; i++ {
+			id, err := q.Put(nil, 0, 0, time.Minute)
+			if err != nil {
+				t.Fatalf("Put: %s", err)
+			}
+			if err := c.Delete(id); err != nil {
+				t.Fatalf("Delete: %s", err)
+			}
+		}
+		if q.records < 20 {
+			t.Errorf("Got %d records, expected the log not to be compacted", q.records)
+		}
+	})
+
+	t.Run("Administered", func(t *testing.T) {
+		q := open(t, "admin.log")
+		defer q.Close()
+		c := q.Conn()
+		var ids []uint64
+		for i := 0; i < 2; i++ {
+			q.Put([]byte(`{"v":1,"payload":{}}`), 0, 0, time.Minute)
+			id, _, err := c.Reserve(0)
+			if err != nil {
+				t.Fatalf("Reserve: %s", err)
+			}
+			if err := c.Bury(id, 0); err != nil {
+				t.Fatalf("Bury: %s", err)
+			}
+			ids = append(ids, id)
+		}
+
+		a := NewAdmin(q)
+		if j, err := a.Next("default"); err != nil || j == nil || j.ID != ids[0] || j.Envelope == nil {
+			t.Fatalf("Got %+v (%v), expected job %d", j, err, ids[0])
+		}
+		if err := a.Delete(ids[0]); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		if n, err := a.KickAll("default"); err != nil || n != 1 {
+			t.Fatalf("Got %d (%v), expected 1 job kicked", n, err)
+		}
+		if stats, _ := c.StatsJob(ids[1]); stats["state"] != "ready" {
+			t.Errorf("Got %v, expected job %d to be ready", stats, ids[1])
+		}
+	})
+}
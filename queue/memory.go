@@ -0,0 +1,203 @@
+package queue
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go/internal/jobs"
+)
+
+// memory is a queue that keeps its jobs in memory. It behaves like a
+// beanstalkd: jobs are put in tubes with a priority, a delay and a time to
+// run, after which a reserved job is handed out again. Jobs are lost when
+// the process exits.
+type memory struct {
+	mu       sync.Mutex
+	jobs     jobs.Set
+	lastID   uint64
+	lastConn uint64
+	wake     chan struct{} // Closed when a job may have become ready.
+}
+
+// NewMemory creates an empty in-memory queue, for development and tests.
+func NewMemory() *memory {
+	return &memory{
+		jobs: make(jobs.Set),
+		wake: make(chan struct{}),
+	}
+}
+
+// Conn returns a connection to q that puts jobs in the default tube, and
+// reserves jobs from tubes, or from the default tube if none are given.
+func (q *memory) Conn(tubes ...string) *memoryConn {
+	if len(tubes) == 0 {
+		tubes = []string{"default"}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.lastConn++
+	return &memoryConn{q: q, id: strconv.FormatUint(q.lastConn, 10), use: "default", watch: tubes}
+}
+
+// Tube returns a connection that puts jobs in the tube named name.
+func (q *memory) Tube(name string) producerConn {
+	return &memoryConn{q: q, use: name}
+}
+
+// Put puts a job in the default tube.
+func (q *memory) Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	return q.put("default", body, pri, delay, ttr), nil
+}
+
+// Delete deletes the job identified by id, unless it is reserved.
+func (q *memory) Delete(id uint64) error {
+	return q.delete("", id)
+}
+
+func (q *memory) put(tube string, body []byte, pri uint32, delay, ttr time.Duration) uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.lastID++
+	q.jobs[q.lastID] = jobs.New(q.lastID, tube, body, pri, delay, ttr, time.Now())
+	q.notify()
+	return q.lastID
+}
+
+func (q *memory) delete(owner string, id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.jobs.Tick(time.Now())
+	if !q.jobs.Deletable(owner, id) {
+		return beanstalk.ConnError{Op: "delete", Err: beanstalk.ErrNotFound}
+	}
+	delete(q.jobs, id)
+	return nil
+}
+
+// notify wakes up the connections waiting for a job.
+func (q *memory) notify() {
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+// memoryConn is a connection to a memory queue. Like a beanstalk
+// connection, only the connection that reserved a job can release, bury or
+// delete it.
+type memoryConn struct {
+	q     *memory
+	id    string // Identifies the connection as the owner of reserved jobs.
+	use   string
+	watch []string
+}
+
+func (c *memoryConn) Bury(id uint64, pri uint32) error {
+	c.q.mu.Lock()
+	defer c.q.mu.Unlock()
+
+	j, err := c.reserved(id, "bury")
+	if err != nil {
+		return err
+	}
+	j.Bury(pri)
+	return nil
+}
+
+func (c *memoryConn) Delete(id uint64) error {
+	return c.q.delete(c.id, id)
+}
+
+// KickJob moves the buried job identified by id back to the ready queue.
+func (c *memoryConn) KickJob(id uint64) error {
+	c.q.mu.Lock()
+	defer c.q.mu.Unlock()
+
+	j, ok := c.q.jobs[id]
+	if !ok || j.State != jobs.StateBuried {
+		return beanstalk.ConnError{Op: "kick-job", Err: beanstalk.ErrNotFound}
+	}
+	j.Kick()
+	c.q.notify()
+	return nil
+}
+
+func (c *memoryConn) Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	return c.q.put(c.use, body, pri, delay, ttr), nil
+}
+
+func (c *memoryConn) Release(id uint64, pri uint32, delay time.Duration) error {
+	c.q.mu.Lock()
+	defer c.q.mu.Unlock()
+
+	j, err := c.reserved(id, "release")
+	if err != nil {
+		return err
+	}
+	j.Release(pri, delay, time.Now())
+	c.q.notify()
+	return nil
+}
+
+// Reserve reserves a job from the watched tubes, waiting at most timeout for
+// one to become ready.
+func (c *memoryConn) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		c.q.mu.Lock()
+		now := time.Now()
+		next := c.q.jobs.Tick(now)
+		if j := c.q.jobs.Take(c.id, c.watch, now); j != nil {
+			c.q.mu.Unlock()
+			return j.ID, append([]byte(nil), j.Body...), nil
+		}
+		wake := c.q.wake
+		c.q.mu.Unlock()
+
+		if !now.Before(deadline) {
+			return 0, nil, beanstalk.ConnError{Op: "reserve-with-timeout", Err: beanstalk.ErrTimeout}
+		}
+		wait := deadline.Sub(now)
+		if !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+func (c *memoryConn) StatsJob(id uint64) (map[string]string, error) {
+	c.q.mu.Lock()
+	defer c.q.mu.Unlock()
+
+	now := time.Now()
+	c.q.jobs.Tick(now)
+	j, ok := c.q.jobs[id]
+	if !ok {
+		return nil, beanstalk.ConnError{Op: "stats-job", Err: beanstalk.ErrNotFound}
+	}
+	return j.Stats(now), nil
+}
+
+// Tube returns a connection that puts jobs in the tube named name.
+func (c *memoryConn) Tube(name string) producerConn {
+	return &memoryConn{q: c.q, id: c.id, use: name, watch: c.watch}
+}
+
+// reserved returns the job identified by id if it is reserved by c. The
+// caller must hold c.q.mu.
+func (c *memoryConn) reserved(id uint64, op string) (*jobs.Job, error) {
+	c.q.jobs.Tick(time.Now())
+	if j := c.q.jobs.ReservedBy(c.id, id); j != nil {
+		return j, nil
+	}
+	return nil, beanstalk.ConnError{Op: op, Err: beanstalk.ErrNotFound}
+}
@@ -0,0 +1,153 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	t.Run("Priorities", func(t *testing.T) {
+		q := NewMemory()
+		c := q.Conn()
+		q.Put([]byte("bulk"), priorityBulk, 0, time.Minute)
+		q.Put([]byte("otp"), priorityOTP, 0, time.Minute)
+		q.Put([]byte("bulk 2"), priorityBulk, 0, time.Minute)
+
+		for _, want := range []string{"otp", "bulk", "bulk 2"} {
+			_, b, err := c.Reserve(0)
+			if err != nil {
+				t.Fatalf("Reserve: %s", err)
+			}
+			if string(b) != want {
+				t.Errorf("Got %q, expected %q", b, want)
+			}
+		}
+		if _, _, err := c.Reserve(0); !isTimeout(err) {
+			t.Errorf("Got %v, expected timeout", err)
+		}
+	})
+
+	t.Run("Tubes", func(t *testing.T) {
+		q := NewMemory()
+		q.Tube("other").Put([]byte("other"), 0, 0, time.Minute)
+
+		if _, _, err := q.Conn().Reserve(0); !isTimeout(err) {
+			t.Errorf("Got %v, expected timeout", err)
+		}
+		if _, b, err := q.Conn("other").Reserve(0); err != nil || string(b) != "other" {
+			t.Errorf("Got %q (%v), expected other", b, err)
+		}
+	})
+
+	t.Run("Delay", func(t *testing.T) {
+		q := NewMemory()
+		c := q.Conn()
+		id, _ := q.Put(nil, 0, 50*time.Millisecond, time.Minute)
+
+		if stats, _ := c.StatsJob(id); stats["state"] != "delayed" {
+			t.Errorf("Got %q, expected delayed", stats["state"])
+		}
+		if _, _, err := c.Reserve(0); !isTimeout(err) {
+			t.Errorf("Got %v, expected timeout", err)
+		}
+		start := time.Now()
+		if _, _, err := c.Reserve(time.Second); err != nil {
+			t.Fatalf("Reserve: %s", err)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("Reserved after %s, expected about 50ms", d)
+		}
+	})
+
+	t.Run("Wakes up on put", func(t *testing.T) {
+		q := NewMemory()
+		c := q.Conn()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			q.Put([]byte("late"), 0, 0, time.Minute)
+		}()
+
+		if _, b, err := c.Reserve(time.Second); err != nil || string(b) != "late" {
+			t.Errorf("Got %q (%v), expected late", b, err)
+		}
+	})
+
+	t.Run("TTR expiry", func(t *testing.T) {
+		q := NewMemory()
+		c1, c2 := q.Conn(), q.Conn()
+		id, _ := q.Put(nil, 0, 0, 0)
+
+		if _, _, err := c1.Reserve(0); err != nil {
+			t.Fatalf("Reserve: %s", err)
+		}
+		// The TTR is at least a second, after which c2 can have the job.
+		got, _, err := c2.Reserve(2 * time.Second)
+		if err != nil {
+			t.Fatalf("Reserve: %s", err)
+		}
+		if got != id {
+			t.Errorf("Got %d, expected %d", got, id)
+		}
+		if err := c1.Delete(id); !isNotFound(err) {
+			t.Errorf("Got %v, expected not found", err)
+		}
+		stats, _ := c2.StatsJob(id)
+		if stats["timeouts"] != "1" || stats["reserves"] != "2" {
+			t.Errorf("Got %s timeouts and %s reserves, expected 1 and 2", stats["timeouts"], stats["reserves"])
+		}
+	})
+
+	t.Run("Release", func(t *testing.T) {
+		q := NewMemory()
+		c := q.Conn()
+		id, _ := q.Put(nil, priorityBulk, 0, time.Minute)
+
+		if _, _, err := c.Reserve(0); err != nil {
+			t.Fatalf("Reserve: %s", err)
+		}
+		if err := q.Conn().Release(id, priorityOTP, 0); !isNotFound(err) {
+			t.Errorf("Got %v, expected only the reserving connection to release", err)
+		}
+		if err := c.Release(id, priorityOTP, 0); err != nil {
+			t.Fatalf("Release: %s", err)
+		}
+		stats, _ := c.StatsJob(id)
+		if stats["state"] != "ready" || stats["releases"] != "1" || jobPriority(stats) != priorityOTP {
+			t.Errorf("Got %v, expected a ready job released once with the new priority", stats)
+		}
+	})
+
+	t.Run("Bury and kick", func(t *testing.T) {
+		q := NewMemory()
+		c := q.Conn()
+		id, _ := q.Put(nil, 0, 0, time.Minute)
+
+		if _, _, err := c.Reserve(0); err != nil {
+			t.Fatalf("Reserve: %s", err)
+		}
+		if err := c.Bury(id, 0); err != nil {
+			t.Fatalf("Bury: %s", err)
+		}
+		if _, _, err := c.Reserve(0); !isTimeout(err) {
+			t.Errorf("Got %v, expected buried job not to be reserved", err)
+		}
+		if err := c.KickJob(id); err != nil {
+			t.Fatalf("KickJob: %s", err)
+		}
+		if got, _, err := c.Reserve(0); err != nil || got != id {
+			t.Errorf("Got %d (%v), expected %d", got, err, id)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		q := NewMemory()
+		id, _ := q.Put(nil, 0, time.Hour, time.Minute)
+
+		if err := q.Delete(id); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		if _, err := q.Conn().StatsJob(id); !isNotFound(err) {
+			t.Errorf("Got %v, expected not found", err)
+		}
+	})
+}
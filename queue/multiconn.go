@@ -0,0 +1,191 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+)
+
+// pollInterval is how long a multiConn waits before polling its tubes again,
+// once all of them turned out to be empty.
+const pollInterval = 100 * time.Millisecond
+
+// WeightedConn is a connection watching a single tube, along with the share
+// of the jobs that is reserved from it when other tubes have jobs, too.
+type WeightedConn struct {
+	Conn   consumerConn
+	Weight int
+}
+
+// multiConn reserves jobs from several connections, each of which watches a
+// tube of its own. Reserved jobs can only be deleted, released or buried
+// through the connection they were reserved on, so multiConn remembers where
+// every job came from.
+type multiConn struct {
+	conns  []WeightedConn
+	strict bool
+
+	mu    sync.Mutex              // Guards owner.
+	owner map[uint64]consumerConn // Connection every reserved job came from.
+}
+
+// NewWeighted creates a connection that reserves jobs from conns, picking a
+// connection with a probability proportional to its weight. Connections with
+// a weight below 1 are given weight 1.
+func NewWeighted(conns ...WeightedConn) *multiConn {
+	cs := make([]WeightedConn, len(conns))
+	for i, wc := range conns {
+		if wc.Weight < 1 {
+			wc.Weight = 1
+		}
+		cs[i] = wc
+	}
+	return &multiConn{conns: cs, owner: make(map[uint64]consumerConn)}
+}
+
+// NewStrict creates a connection that reserves jobs from conns in strict
+// order: jobs are only reserved from a connection if all connections before
+// it have none. The weights of conns are ignored.
+func NewStrict(conns ...WeightedConn) *multiConn {
+	cs := append([]WeightedConn(nil), conns...)
+	return &multiConn{conns: cs, strict: true, owner: make(map[uint64]consumerConn)}
+}
+
+func (m *multiConn) Bury(id uint64, pri uint32) error {
+	c, err := m.release(id)
+	if err != nil {
+		return err
+	}
+	return c.Bury(id, pri)
+}
+
+func (m *multiConn) Delete(id uint64) error {
+	c, err := m.release(id)
+	if err != nil {
+		return err
+	}
+	return c.Delete(id)
+}
+
+func (m *multiConn) Release(id uint64, pri uint32, delay time.Duration) error {
+	c, err := m.release(id)
+	if err != nil {
+		return err
+	}
+	return c.Release(id, pri, delay)
+}
+
+func (m *multiConn) StatsJob(id uint64) (map[string]string, error) {
+	m.mu.Lock()
+	c, ok := m.owner[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("job %d was not reserved", id)
+	}
+	return c.StatsJob(id)
+}
+
+// Tube returns a connection that puts jobs in the tube named name, through
+// the first of m's connections that can. It returns nil if none can.
+func (m *multiConn) Tube(name string) producerConn {
+	for _, wc := range m.conns {
+		if tp, ok := wc.Conn.(tubeProducer); ok {
+			return tp.Tube(name)
+		}
+	}
+	return nil
+}
+
+// Reserve polls the connections in the order given by m.order for a job,
+// until one is found or timeout expires. If every connection fails, the error
+// of the last one is returned.
+func (m *multiConn) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var failed int
+		var lastErr error
+		for _, c := range m.order() {
+			id, b, err := c.Reserve(0)
+			if err != nil {
+				if isTimeout(err) {
+					continue
+				}
+				failed++
+				lastErr = err
+				// Connections that wait to reconnect log why they broke
+				// already.
+				if !errors.Is(err, ErrDisconnected) {
+					log.Printf("%T: Reserve: %s", c, err)
+				}
+				continue
+			}
+
+			m.mu.Lock()
+			m.owner[id] = c
+			m.mu.Unlock()
+			return id, b, nil
+		}
+
+		if failed == len(m.conns) {
+			return 0, nil, lastErr
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, nil, beanstalk.ErrTimeout
+		}
+		if remaining > pollInterval {
+			remaining = pollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// release forgets the reserved job identified by id, and returns the
+// connection it was reserved on.
+func (m *multiConn) release(id uint64) (consumerConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.owner[id]
+	if !ok {
+		return nil, fmt.Errorf("job %d was not reserved", id)
+	}
+	delete(m.owner, id)
+	return c, nil
+}
+
+// order returns the connections in the order they are to be polled: as given
+// if m is strict, or else shuffled according to their weights.
+func (m *multiConn) order() []consumerConn {
+	cs := make([]consumerConn, 0, len(m.conns))
+	if m.strict {
+		for _, wc := range m.conns {
+			cs = append(cs, wc.Conn)
+		}
+		return cs
+	}
+
+	left := append([]WeightedConn(nil), m.conns...)
+	total := 0
+	for _, wc := range left {
+		total += wc.Weight
+	}
+	for len(left) > 0 {
+		n := rand.Intn(total)
+		for i, wc := range left {
+			if n -= wc.Weight; n < 0 {
+				cs = append(cs, wc.Conn)
+				total -= wc.Weight
+				left = append(left[:i], left[i+1:]...)
+				break
+			}
+		}
+	}
+	return cs
+}
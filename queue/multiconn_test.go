@@ -0,0 +1,124 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go/internal/mock"
+)
+
+// tubeConn returns a connection to a tube holding the job identified by id,
+// if id is not 0. deleted is set to the ID of the job deleted through it.
+func tubeConn(id uint64, deleted *uint64) *mock.ConsumerConn {
+	return &mock.ConsumerConn{
+		DeleteFunc: func(id uint64) error {
+			*deleted = id
+			return nil
+		},
+		ReserveFunc: func(timeout time.Duration) (uint64, []byte, error) {
+			if timeout != 0 {
+				return 0, nil, errors.New("expected a poll")
+			}
+			if id == 0 {
+				return 0, nil, beanstalk.ConnError{Op: "reserve-with-timeout", Err: beanstalk.ErrTimeout}
+			}
+			return id, []byte("{}"), nil
+		},
+	}
+}
+
+func TestMultiConn(t *testing.T) {
+	t.Run("Strict", func(t *testing.T) {
+		var deleted1, deleted2, deleted3 uint64
+		mc := NewStrict(
+			WeightedConn{Conn: tubeConn(0, &deleted1)},
+			WeightedConn{Conn: tubeConn(2, &deleted2)},
+			WeightedConn{Conn: tubeConn(3, &deleted3)},
+		)
+
+		for i := 0; i < 10; i++ {
+			id, _, err := mc.Reserve(time.Second)
+			if err != nil {
+				t.Fatalf("Reserve: %s", err)
+			}
+			if id != 2 {
+				t.Fatalf("Got %d, expected 2", id)
+			}
+			if err := mc.Delete(id); err != nil {
+				t.Fatalf("Delete: %s", err)
+			}
+		}
+		// Jobs are deleted through the connection they were reserved on.
+		if deleted1 != 0 || deleted2 != 2 || deleted3 != 0 {
+			t.Errorf("Got %d, %d and %d, expected 0, 2 and 0", deleted1, deleted2, deleted3)
+		}
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		var deleted uint64
+		mc := NewWeighted(
+			WeightedConn{Conn: tubeConn(1, &deleted), Weight: 3},
+			WeightedConn{Conn: tubeConn(2, &deleted), Weight: 1},
+		)
+
+		counts := make(map[uint64]int)
+		for i := 0; i < 4000; i++ {
+			id, _, err := mc.Reserve(time.Second)
+			if err != nil {
+				t.Fatalf("Reserve: %s", err)
+			}
+			counts[id]++
+			if err := mc.Delete(id); err != nil {
+				t.Fatalf("Delete: %s", err)
+			}
+		}
+		// Expect 3000 and 1000, give or take.
+		if counts[1] < 2800 || counts[1] > 3200 {
+			t.Errorf("Got %d jobs from the first tube, expected about 3000", counts[1])
+		}
+		if counts[1]+counts[2] != 4000 {
+			t.Errorf("Got %d, expected 4000", counts[1]+counts[2])
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		var deleted uint64
+		mc := NewWeighted(WeightedConn{Conn: tubeConn(0, &deleted)})
+
+		_, _, err := mc.Reserve(10 * time.Millisecond)
+		if !isTimeout(err) {
+			t.Errorf("Got %v, expected timeout", err)
+		}
+	})
+
+	t.Run("Disconnected", func(t *testing.T) {
+		c := &mock.ConsumerConn{
+			ReserveFunc: func(timeout time.Duration) (uint64, []byte, error) {
+				return 0, nil, ErrDisconnected
+			},
+		}
+		mc := NewWeighted(WeightedConn{Conn: c}, WeightedConn{Conn: c})
+
+		// The error is returned right away, rather than polling until
+		// the timeout expires.
+		_, _, err := mc.Reserve(time.Minute)
+		if !errors.Is(err, ErrDisconnected) {
+			t.Errorf("Got %v, expected ErrDisconnected", err)
+		}
+	})
+
+	t.Run("Unknown job", func(t *testing.T) {
+		var deleted uint64
+		mc := NewStrict(WeightedConn{Conn: tubeConn(1, &deleted)})
+
+		if err := mc.Delete(42); err == nil {
+			t.Errorf("Got nil, expected error")
+		}
+		if deleted != 0 {
+			t.Errorf("Got %d, expected 0", deleted)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package queue
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+)
+
+// Defaults of a pool, unless configured otherwise through PoolOptions.
+const (
+	defaultPoolSize            = 4
+	defaultHealthCheckInterval = 30 * time.Second
+)
+
+// pool spreads the jobs it puts over several connections, as a beanstalk
+// connection handles a single command at a time. Every connection reconnects
+// on its own when it breaks, and remembers the tube it uses, so switching
+// tubes only costs a round trip when a connection put a job in another tube
+// before.
+type pool struct {
+	conns    []*reconnConn
+	idle     chan *reconnConn // Connections not in use.
+	interval time.Duration
+
+	stopCh    chan struct{}  // Closed by Close.
+	closeOnce sync.Once      // Guards closing stopCh.
+	wg        sync.WaitGroup // Tracks the health check goroutine.
+}
+
+// PoolOption configures a pool created by DialPool.
+type PoolOption func(p *poolConfig)
+
+type poolConfig struct {
+	size     int
+	interval time.Duration
+	opts     []ConnOption
+}
+
+// WithPoolSize sets the number of connections in the pool to n.
+func WithPoolSize(n int) PoolOption {
+	return func(p *poolConfig) {
+		if n < 1 {
+			n = 1
+		}
+		p.size = n
+	}
+}
+
+// WithHealthCheckInterval sets how often the connections that are not in use
+// are checked, so broken connections are replaced before a Put runs into
+// them.
+func WithHealthCheckInterval(d time.Duration) PoolOption {
+	return func(p *poolConfig) {
+		p.interval = d
+	}
+}
+
+// WithConnOptions configures every connection in the pool with opts.
+func WithConnOptions(opts ...ConnOption) PoolOption {
+	return func(p *poolConfig) {
+		p.opts = append(p.opts, opts...)
+	}
+}
+
+// DialPool connects to the beanstalkd at addr, and returns a pool of
+// connections that is safe for concurrent use. Only the first connection is
+// dialed right away; the others are dialed once they are needed.
+func DialPool(addr string, opts ...PoolOption) (*pool, error) {
+	cfg := poolConfig{size: defaultPoolSize, interval: defaultHealthCheckInterval}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	p := newPool(func() (*beanstalk.Conn, error) {
+		return beanstalk.DialTimeout("tcp", addr, 10*time.Second)
+	}, cfg)
+	if _, err := p.conns[0].get(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func newPool(dial func() (*beanstalk.Conn, error), cfg poolConfig) *pool {
+	p := &pool{
+		idle:     make(chan *reconnConn, cfg.size),
+		interval: cfg.interval,
+		stopCh:   make(chan struct{}),
+	}
+	for i := 0; i < cfg.size; i++ {
+		r := newReconnConn(dial, cfg.opts...)
+		p.conns = append(p.conns, r)
+		p.idle <- r
+	}
+	if p.interval > 0 {
+		p.wg.Add(1)
+		go p.checkHealth()
+	}
+	return p
+}
+
+// Delete deletes the job identified by id through any of the connections.
+func (p *pool) Delete(id uint64) error {
+	r := p.get()
+	defer p.put(r)
+	return r.Delete(id)
+}
+
+// Put puts a job in the tube the connections use.
+func (p *pool) Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	r := p.get()
+	defer p.put(r)
+	return r.Put(body, pri, delay, ttr)
+}
+
+// Tube returns a connection that puts jobs in tube through the pool.
+func (p *pool) Tube(name string) producerConn {
+	return &poolTube{p: p, name: name}
+}
+
+// Close stops the health checks, and closes all connections. It must not be
+// called while jobs are being put.
+func (p *pool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.stopCh)
+	})
+	p.wg.Wait()
+
+	var err error
+	for _, r := range p.conns {
+		if cerr := r.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// get waits for a connection to become idle, and takes it.
+func (p *pool) get() *reconnConn {
+	return <-p.idle
+}
+
+// put hands the connection r back to the pool.
+func (p *pool) put(r *reconnConn) {
+	p.idle <- r
+}
+
+// checkHealth checks the idle connections every p.interval, until p is
+// closed.
+func (p *pool) checkHealth() {
+	defer p.wg.Done()
+
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-t.C:
+		}
+
+		// Only check the connections that are idle right now: the others
+		// prove they are healthy by being used.
+		var rs []*reconnConn
+	take:
+		for len(rs) < len(p.conns) {
+			select {
+			case r := <-p.idle:
+				rs = append(rs, r)
+			default:
+				break take
+			}
+		}
+		for _, r := range rs {
+			if err := r.ping(); err != nil {
+				log.Printf("%T: ping: %s", r, err)
+			}
+			p.put(r)
+		}
+	}
+}
+
+// poolTube puts jobs in a tube through a pool.
+type poolTube struct {
+	p    *pool
+	name string
+}
+
+func (t *poolTube) Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	r := t.p.get()
+	defer t.p.put(r)
+	return r.Tube(t.name).Put(body, pri, delay, ttr)
+}
@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+)
+
+// fakeServer is a beanstalkd that knows just enough commands to put jobs in
+// tubes. Every connection to it runs on a pipe.
+type fakeServer struct {
+	lastID uint64 // Accessed atomically.
+
+	mu    sync.Mutex
+	dials int
+	uses  int
+}
+
+func (s *fakeServer) dial() (*beanstalk.Conn, error) {
+	s.mu.Lock()
+	s.dials++
+	s.mu.Unlock()
+
+	client, server := net.Pipe()
+	go s.serve(server)
+	return beanstalk.NewConn(client), nil
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		var resp string
+		switch f[0] {
+		case "use":
+			s.mu.Lock()
+			s.uses++
+			s.mu.Unlock()
+			resp = "USING " + f[1]
+		case "put":
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			resp = fmt.Sprintf("INSERTED %d", atomic.AddUint64(&s.lastID, 1))
+		case "delete":
+			resp = "DELETED"
+		case "list-tubes":
+			resp = "OK 14\r\n---\n- default\n"
+		default:
+			resp = "UNKNOWN_COMMAND"
+		}
+		if _, err := conn.Write([]byte(resp + "\r\n")); err != nil {
+			return
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	t.Run("Concurrent puts", func(t *testing.T) {
+		var s fakeServer
+		p := newPool(s.dial, poolConfig{size: 3})
+		defer p.Close()
+
+		tube := p.Tube("otp")
+		var mu sync.Mutex
+		ids := make(map[uint64]bool)
+		var wg sync.WaitGroup
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				id, err := tube.Put([]byte("{}"), 0, 0, time.Minute)
+				if err != nil {
+					t.Errorf("Put: %s", err)
+					return
+				}
+				mu.Lock()
+				ids[id] = true
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		if len(ids) != 30 {
+			t.Errorf("Got %d distinct IDs, expected 30", len(ids))
+		}
+		// Every connection selects the tube once.
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.dials > 3 || s.uses != s.dials {
+			t.Errorf("Got %d dials and %d uses, expected at most 3 of both", s.dials, s.uses)
+		}
+	})
+
+	t.Run("Health check", func(t *testing.T) {
+		var s fakeServer
+		var broken sync.Once
+		dial := func() (*beanstalk.Conn, error) {
+			c, err := s.dial()
+			// Break the first connection right away.
+			broken.Do(func() {
+				c.Close()
+			})
+			return c, err
+		}
+		p := newPool(dial, poolConfig{
+			size:     1,
+			interval: 10 * time.Millisecond,
+			opts:     []ConnOption{WithBackoff(time.Millisecond, time.Millisecond)},
+		})
+		defer p.Close()
+		if _, err := p.conns[0].get(); err != nil {
+			t.Fatalf("get: %s", err)
+		}
+
+		// The health check finds the connection broke, and dials a new one
+		// before it is used.
+		time.Sleep(50 * time.Millisecond)
+		if _, err := p.Put([]byte("{}"), 0, 0, time.Minute); err != nil {
+			t.Fatalf("Put: %s", err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.dials != 2 {
+			t.Errorf("Got %d dials, expected 2", s.dials)
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package queue
+
+import (
+	"strconv"
+
+	"github.com/epels/birdbroker-go"
+)
+
+// Beanstalk priorities of jobs holding messages of each priority. Jobs with
+// a lower value are reserved first, so one-time passwords always jump the
+// queue, and bulk traffic waits for everything else.
+const (
+	priorityOTP           uint32 = 0
+	priorityTransactional uint32 = 1024
+	priorityBulk          uint32 = 4096
+)
+
+// defaultPriority is the priority of jobs that don't specify one.
+const defaultPriority = priorityTransactional
+
+// priority returns the beanstalk priority of jobs holding messages with
+// priority p.
+func priority(p birdbroker.Priority) uint32 {
+	switch p {
+	case birdbroker.PriorityOTP:
+		return priorityOTP
+	case birdbroker.PriorityBulk:
+		return priorityBulk
+	default:
+		return priorityTransactional
+	}
+}
+
+// jobPriority returns the priority of a job from its statistics, so it can be
+// kept when the job is released or buried.
+func jobPriority(stats map[string]string) uint32 {
+	pri, err := strconv.ParseUint(stats["pri"], 10, 32)
+	if err != nil {
+		return defaultPriority
+	}
+	return uint32(pri)
+}
@@ -0,0 +1,367 @@
+// Package queuetest checks that a queue backend behaves like beanstalkd, as
+// far as birdbroker relies on it.
+//
+// A backend runs the suite from a test of its own:
+//
+//	func TestConformance(t *testing.T) {
+//		queuetest.Run(t, func(t *testing.T) (queuetest.Queue, func()) {
+//			q := newQueue()
+//			return q, func() { q.Close() }
+//		})
+//	}
+//
+// Durations in the beanstalkd protocol are whole seconds, so the suite uses
+// delays and times to run of a second, and takes a few seconds to run.
+package queuetest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+)
+
+// Queue is a queue backend under test.
+type Queue interface {
+	// Conn returns a new connection that puts jobs in the tube named use,
+	// and reserves jobs from the tubes named watch. Like on a beanstalk
+	// connection, only the connection that reserved a job can release,
+	// bury or delete it.
+	Conn(use string, watch ...string) Conn
+}
+
+// Conn is a connection to a queue backend under test. Errors are reported
+// like go-beanstalk does: as a beanstalk.ConnError wrapping, for instance,
+// beanstalk.ErrNotFound or beanstalk.ErrTimeout.
+type Conn interface {
+	Bury(id uint64, pri uint32) error
+	Delete(id uint64) error
+	KickJob(id uint64) error
+	Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error)
+	Release(id uint64, pri uint32, delay time.Duration) error
+	Reserve(timeout time.Duration) (id uint64, body []byte, err error)
+	StatsJob(id uint64) (map[string]string, error)
+}
+
+// Run runs the suite against the queues created by newQueue. Every test gets
+// a new, empty queue, which it closes through the function returned along
+// with it once it is done.
+func Run(t *testing.T, newQueue func(t *testing.T) (Queue, func())) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, q Queue)
+	}{
+		{"Priorities", testPriorities},
+		{"Tubes", testTubes},
+		{"Delay", testDelay},
+		{"TTR expiry", testTTRExpiry},
+		{"Release", testRelease},
+		{"Release with delay", testReleaseWithDelay},
+		{"Bury", testBury},
+		{"Delete", testDelete},
+		{"Stats", testStats},
+		{"Concurrent reservers", testConcurrentReservers},
+	}
+
+	// The tests run in parallel, as most of them wait for a second or two.
+	// Grouping them makes Run return once they all finished.
+	t.Run("Conformance", func(t *testing.T) {
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				t.Parallel()
+
+				q, closeQueue := newQueue(t)
+				defer closeQueue()
+				tc.fn(t, q)
+			})
+		}
+	})
+}
+
+func testPriorities(t *testing.T, q Queue) {
+	c := q.Conn("default", "default")
+	mustPut(t, c, "bulk", 10, 0)
+	mustPut(t, c, "otp", 0, 0)
+	mustPut(t, c, "bulk 2", 10, 0)
+
+	// Jobs with the same priority are reserved in the order they were put.
+	for _, want := range []string{"otp", "bulk", "bulk 2"} {
+		_, b := mustReserve(t, c, 0)
+		if string(b) != want {
+			t.Errorf("Got %q, expected %q", b, want)
+		}
+	}
+	expectTimeout(t, c)
+}
+
+func testTubes(t *testing.T, q Queue) {
+	mustPut(t, q.Conn("a"), "in a", 0, 0)
+	mustPut(t, q.Conn("b"), "in b", 0, 0)
+
+	expectTimeout(t, q.Conn("default", "c"))
+	if _, b := mustReserve(t, q.Conn("default", "b"), 0); string(b) != "in b" {
+		t.Errorf("Got %q, expected in b", b)
+	}
+	c := q.Conn("default", "c", "a")
+	if _, b := mustReserve(t, c, 0); string(b) != "in a" {
+		t.Errorf("Got %q, expected in a", b)
+	}
+	expectTimeout(t, c)
+}
+
+func testDelay(t *testing.T, q Queue) {
+	c := q.Conn("default", "default")
+	id := mustPut(t, c, "delayed", 0, time.Second)
+
+	expectState(t, c, id, "delayed")
+	expectTimeout(t, c)
+
+	start := time.Now()
+	got, _ := mustReserve(t, c, 5*time.Second)
+	if got != id {
+		t.Errorf("Got %d, expected %d", got, id)
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("Reserved after %s, expected after about a second", d)
+	}
+}
+
+func testTTRExpiry(t *testing.T, q Queue) {
+	c1, c2 := q.Conn("default", "default"), q.Conn("default", "default")
+	id := mustPut(t, c1, "Hello", 0, 0)
+
+	mustReserve(t, c1, 0)
+	expectState(t, c2, id, "reserved")
+	expectTimeout(t, c2)
+
+	// Once its time to run passed, the job is handed out again.
+	got, _ := mustReserve(t, c2, 5*time.Second)
+	if got != id {
+		t.Fatalf("Got %d, expected %d", got, id)
+	}
+	if err := c1.Delete(id); !isErr(err, beanstalk.ErrNotFound) {
+		t.Errorf("Got %v, expected not found", err)
+	}
+	stats := mustStats(t, c2, id)
+	if stats["reserves"] != "2" || stats["timeouts"] != "1" {
+		t.Errorf("Got %s reserves and %s timeouts, expected 2 and 1", stats["reserves"], stats["timeouts"])
+	}
+}
+
+func testRelease(t *testing.T, q Queue) {
+	c1, c2 := q.Conn("default", "default"), q.Conn("default", "default")
+	id := mustPut(t, c1, "Hello", 10, 0)
+	mustReserve(t, c1, 0)
+
+	if err := c2.Release(id, 0, 0); !isErr(err, beanstalk.ErrNotFound) {
+		t.Errorf("Got %v, expected only the reserving connection to release", err)
+	}
+	if err := c1.Release(id, 5, 0); err != nil {
+		t.Fatalf("Release: %s", err)
+	}
+	stats := mustStats(t, c1, id)
+	if stats["state"] != "ready" || stats["pri"] != "5" || stats["releases"] != "1" {
+		t.Errorf("Got %v, expected a ready job with priority 5, released once", stats)
+	}
+	if got, _ := mustReserve(t, c2, 0); got != id {
+		t.Errorf("Got %d, expected %d", got, id)
+	}
+}
+
+func testReleaseWithDelay(t *testing.T, q Queue) {
+	c := q.Conn("default", "default")
+	id := mustPut(t, c, "Hello", 0, 0)
+	mustReserve(t, c, 0)
+
+	if err := c.Release(id, 0, time.Second); err != nil {
+		t.Fatalf("Release: %s", err)
+	}
+	if stats := mustStats(t, c, id); stats["state"] != "delayed" || stats["delay"] != "1" {
+		t.Errorf("Got %v, expected a job delayed by a second", stats)
+	}
+	expectTimeout(t, c)
+	if got, _ := mustReserve(t, c, 5*time.Second); got != id {
+		t.Errorf("Got %d, expected %d", got, id)
+	}
+}
+
+func testBury(t *testing.T, q Queue) {
+	c1, c2 := q.Conn("default", "default"), q.Conn("default", "default")
+	id := mustPut(t, c1, "Hello", 0, 0)
+	mustReserve(t, c1, 0)
+
+	if err := c2.Bury(id, 0); !isErr(err, beanstalk.ErrNotFound) {
+		t.Errorf("Got %v, expected only the reserving connection to bury", err)
+	}
+	if err := c1.Bury(id, 7); err != nil {
+		t.Fatalf("Bury: %s", err)
+	}
+	if stats := mustStats(t, c1, id); stats["state"] != "buried" || stats["pri"] != "7" || stats["buries"] != "1" {
+		t.Errorf("Got %v, expected a job buried once with priority 7", stats)
+	}
+	// Buried jobs are not handed out, not even after their time to run.
+	expectTimeout(t, c2)
+
+	if err := c2.KickJob(id); err != nil {
+		t.Fatalf("KickJob: %s", err)
+	}
+	if err := c2.KickJob(id); !isErr(err, beanstalk.ErrNotFound) {
+		t.Errorf("Got %v, expected a ready job not to be kicked", err)
+	}
+	if got, _ := mustReserve(t, c2, 0); got != id {
+		t.Errorf("Got %d, expected %d", got, id)
+	}
+}
+
+func testDelete(t *testing.T, q Queue) {
+	c1, c2 := q.Conn("default", "default"), q.Conn("default", "default")
+	ready := mustPut(t, c1, "ready", 0, 0)
+	delayed := mustPut(t, c1, "delayed", 0, time.Hour)
+	reserved := mustPut(t, c1, "reserved", 1, 0)
+
+	for _, id := range []uint64{ready, delayed} {
+		if err := c2.Delete(id); err != nil {
+			t.Errorf("Delete: %s", err)
+		}
+		if _, err := c2.StatsJob(id); !isErr(err, beanstalk.ErrNotFound) {
+			t.Errorf("Got %v, expected not found", err)
+		}
+		if err := c2.Delete(id); !isErr(err, beanstalk.ErrNotFound) {
+			t.Errorf("Got %v, expected not found", err)
+		}
+	}
+
+	mustReserve(t, c1, 0)
+	if err := c2.Delete(reserved); !isErr(err, beanstalk.ErrNotFound) {
+		t.Errorf("Got %v, expected a job reserved by another connection not to be deleted", err)
+	}
+	if err := c1.Delete(reserved); err != nil {
+		t.Errorf("Delete: %s", err)
+	}
+	expectTimeout(t, c1)
+}
+
+func testStats(t *testing.T, q Queue) {
+	c := q.Conn("some-tube", "some-tube")
+	id, err := c.Put([]byte("Hello"), 42, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	stats := mustStats(t, c, id)
+	want := map[string]string{
+		"id":       fmt.Sprint(id),
+		"tube":     "some-tube",
+		"state":    "ready",
+		"pri":      "42",
+		"delay":    "0",
+		"ttr":      "60",
+		"reserves": "0",
+		"timeouts": "0",
+		"releases": "0",
+		"buries":   "0",
+		"kicks":    "0",
+	}
+	for k, v := range want {
+		if stats[k] != v {
+			t.Errorf("Got %s %q, expected %q", k, stats[k], v)
+		}
+	}
+}
+
+func testConcurrentReservers(t *testing.T, q Queue) {
+	const jobs, conns = 20, 4
+
+	p := q.Conn("default")
+	for i := 0; i < jobs; i++ {
+		mustPut(t, p, fmt.Sprint(i), 0, 0)
+	}
+
+	var mu sync.Mutex
+	reserved := make(map[uint64]int)
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		c := q.Conn("default", "default")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				id, _, err := c.Reserve(0)
+				if isErr(err, beanstalk.ErrTimeout) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Reserve: %s", err)
+					return
+				}
+				mu.Lock()
+				reserved[id]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(reserved) != jobs {
+		t.Errorf("Got %d jobs, expected %d", len(reserved), jobs)
+	}
+	for id, n := range reserved {
+		if n != 1 {
+			t.Errorf("Got job %d reserved %d times, expected once", id, n)
+		}
+	}
+}
+
+func mustPut(t *testing.T, c Conn, body string, pri uint32, delay time.Duration) uint64 {
+	t.Helper()
+	id, err := c.Put([]byte(body), pri, delay, time.Second)
+	if err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	return id
+}
+
+func mustReserve(t *testing.T, c Conn, timeout time.Duration) (uint64, []byte) {
+	t.Helper()
+	id, b, err := c.Reserve(timeout)
+	if err != nil {
+		t.Fatalf("Reserve: %s", err)
+	}
+	return id, b
+}
+
+func mustStats(t *testing.T, c Conn, id uint64) map[string]string {
+	t.Helper()
+	stats, err := c.StatsJob(id)
+	if err != nil {
+		t.Fatalf("StatsJob: %s", err)
+	}
+	return stats
+}
+
+func expectState(t *testing.T, c Conn, id uint64, state string) {
+	t.Helper()
+	if got := mustStats(t, c, id)["state"]; got != state {
+		t.Errorf("Got %q, expected %q", got, state)
+	}
+}
+
+func expectTimeout(t *testing.T, c Conn) {
+	t.Helper()
+	if id, b, err := c.Reserve(0); !isErr(err, beanstalk.ErrTimeout) {
+		t.Errorf("Got job %d (%q) and %v, expected a timeout", id, b, err)
+	}
+}
+
+// isErr reports whether err is target, or a beanstalk.ConnError wrapping it.
+func isErr(err, target error) bool {
+	var ce beanstalk.ConnError
+	if errors.As(err, &ce) {
+		err = ce.Err
+	}
+	return errors.Is(err, target)
+}
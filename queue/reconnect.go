@@ -0,0 +1,285 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+)
+
+// Default bounds of the delay between attempts to reconnect, unless configured
+// otherwise through WithBackoff.
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// ErrDisconnected is returned by a reconnecting connection while it waits to
+// dial beanstalkd again.
+var ErrDisconnected = errors.New("disconnected from beanstalkd")
+
+// reconnConn is a connection to beanstalkd that redials it when the
+// connection breaks, waiting longer after every failed attempt. The tubes it
+// uses and watches are selected again on every new connection.
+//
+// Jobs reserved on a connection that broke are released by beanstalkd, so
+// they can't be deleted, released or buried anymore after reconnecting.
+type reconnConn struct {
+	dial       func() (*beanstalk.Conn, error)
+	use        string
+	watch      []string
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu       sync.Mutex      // Guards conn, failures and retryAt.
+	conn     *beanstalk.Conn // Nil while disconnected.
+	failures int             // Number of failures since the last success.
+	retryAt  time.Time       // When to dial again while disconnected.
+}
+
+// ConnOption configures a connection created by Dial.
+type ConnOption func(r *reconnConn)
+
+// WithUse makes the connection put jobs in tube, instead of the default tube.
+func WithUse(tube string) ConnOption {
+	return func(r *reconnConn) {
+		r.use = tube
+	}
+}
+
+// WithWatch makes the connection reserve jobs from tubes, instead of the
+// default tube.
+func WithWatch(tubes ...string) ConnOption {
+	return func(r *reconnConn) {
+		r.watch = tubes
+	}
+}
+
+// WithBackoff sets the delay before the first attempt to reconnect to min.
+// The delay doubles after every failed attempt, up to max.
+func WithBackoff(min, max time.Duration) ConnOption {
+	return func(r *reconnConn) {
+		r.minBackoff, r.maxBackoff = min, max
+	}
+}
+
+// Dial connects to the beanstalkd at addr, and returns a connection that
+// reconnects whenever the connection breaks.
+func Dial(addr string, opts ...ConnOption) (*reconnConn, error) {
+	r := newReconnConn(func() (*beanstalk.Conn, error) {
+		return beanstalk.DialTimeout("tcp", addr, 10*time.Second)
+	}, opts...)
+	if _, err := r.get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func newReconnConn(dial func() (*beanstalk.Conn, error), opts ...ConnOption) *reconnConn {
+	r := &reconnConn{
+		dial:       dial,
+		use:        "default",
+		watch:      []string{"default"},
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *reconnConn) Bury(id uint64, pri uint32) error {
+	return r.do(func(c *beanstalk.Conn) error {
+		return c.Bury(id, pri)
+	})
+}
+
+func (r *reconnConn) Delete(id uint64) error {
+	return r.do(func(c *beanstalk.Conn) error {
+		return c.Delete(id)
+	})
+}
+
+func (r *reconnConn) Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	return r.Tube(r.use).Put(body, pri, delay, ttr)
+}
+
+func (r *reconnConn) Release(id uint64, pri uint32, delay time.Duration) error {
+	return r.do(func(c *beanstalk.Conn) error {
+		return c.Release(id, pri, delay)
+	})
+}
+
+// Reserve reserves a job from the watched tubes. While disconnected, it
+// waits until it may reconnect, for at most timeout.
+func (r *reconnConn) Reserve(timeout time.Duration) (id uint64, body []byte, err error) {
+	if wait := r.wait(); wait > 0 {
+		if wait > timeout {
+			time.Sleep(timeout)
+			return 0, nil, fmt.Errorf("%w: reconnecting in %s", ErrDisconnected, wait-timeout)
+		}
+		time.Sleep(wait)
+		timeout -= wait
+	}
+
+	err = r.do(func(c *beanstalk.Conn) error {
+		id, body, err = c.Reserve(timeout)
+		return err
+	})
+	return id, body, err
+}
+
+func (r *reconnConn) StatsJob(id uint64) (map[string]string, error) {
+	var stats map[string]string
+	err := r.do(func(c *beanstalk.Conn) (err error) {
+		stats, err = c.StatsJob(id)
+		return err
+	})
+	return stats, err
+}
+
+// Tube returns a connection that puts jobs in tube.
+func (r *reconnConn) Tube(name string) producerConn {
+	return &reconnTube{r: r, name: name}
+}
+
+// ping checks whether the connection still works, dialing a new one if it
+// is disconnected and the backoff has passed.
+func (r *reconnConn) ping() error {
+	return r.do(func(c *beanstalk.Conn) error {
+		_, err := c.ListTubes()
+		return err
+	})
+}
+
+// Close closes the current connection, if any.
+func (r *reconnConn) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// do calls f with the current connection, dialing a new one if needed. If f
+// fails because the connection broke, the connection is dropped.
+func (r *reconnConn) do(f func(c *beanstalk.Conn) error) error {
+	c, err := r.get()
+	if err != nil {
+		return err
+	}
+	err = f(c)
+	if err != nil && isBroken(err) {
+		r.drop(c, err)
+	}
+	return err
+}
+
+// get returns the current connection, or dials a new one if r is
+// disconnected and the backoff has passed.
+func (r *reconnConn) get() (*beanstalk.Conn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn != nil {
+		return r.conn, nil
+	}
+	if wait := time.Until(r.retryAt); wait > 0 {
+		return nil, fmt.Errorf("%w: reconnecting in %s", ErrDisconnected, wait)
+	}
+
+	c, err := r.dial()
+	if err != nil {
+		r.backoff()
+		return nil, fmt.Errorf("%w: %s", ErrDisconnected, err)
+	}
+	c.Tube = beanstalk.Tube{Conn: c, Name: r.use}
+	c.TubeSet = *beanstalk.NewTubeSet(c, r.watch...)
+	r.conn = c
+	r.failures = 0
+	return c, nil
+}
+
+// drop closes c after it failed with err, unless it was replaced already.
+func (r *reconnConn) drop(c *beanstalk.Conn, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn != c {
+		return
+	}
+	log.Printf("Connection to beanstalkd broke: %s", err)
+	if err := c.Close(); err != nil {
+		log.Printf("%T: Close: %s", c, err)
+	}
+	r.conn = nil
+	r.backoff()
+}
+
+// backoff sets when to dial again, after yet another failure.
+func (r *reconnConn) backoff() {
+	d := r.minBackoff
+	for i := 0; i < r.failures && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	r.failures++
+	r.retryAt = time.Now().Add(d)
+}
+
+// wait returns how long r must wait before it may dial again, or 0 if it is
+// connected or may dial right away.
+func (r *reconnConn) wait() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn != nil {
+		return 0
+	}
+	if wait := time.Until(r.retryAt); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// reconnTube puts jobs in a tube through a reconnecting connection.
+type reconnTube struct {
+	r    *reconnConn
+	name string
+}
+
+func (t *reconnTube) Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	var id uint64
+	err := t.r.do(func(c *beanstalk.Conn) (err error) {
+		id, err = (&beanstalk.Tube{Conn: c, Name: t.name}).Put(body, pri, delay, ttr)
+		return err
+	})
+	return id, err
+}
+
+// isBroken reports whether err signals the connection it came from broke, as
+// opposed to an error response of beanstalkd.
+func isBroken(err error) bool {
+	var ce beanstalk.ConnError
+	if errors.As(err, &ce) {
+		err = ce.Err
+	}
+	switch err {
+	case beanstalk.ErrBadFormat, beanstalk.ErrBuried, beanstalk.ErrDeadline,
+		beanstalk.ErrDraining, beanstalk.ErrInternal, beanstalk.ErrJobTooBig,
+		beanstalk.ErrNoCRLF, beanstalk.ErrNotFound, beanstalk.ErrNotIgnored,
+		beanstalk.ErrOOM, beanstalk.ErrTimeout, beanstalk.ErrUnknown:
+		return false
+	}
+	return true
+}
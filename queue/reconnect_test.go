@@ -0,0 +1,143 @@
+package queue
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+)
+
+// scriptedConn returns a connection to a server that answers the commands it
+// reads with responses, in order, and hangs up once it runs out of these. The
+// commands are sent on the returned channel.
+func scriptedConn(responses ...string) (*beanstalk.Conn, <-chan string) {
+	client, server := net.Pipe()
+	cmds := make(chan string, 100)
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		for _, resp := range responses {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimSpace(line)
+			if strings.HasPrefix(cmd, "put ") {
+				// Skip the body of the job.
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+			}
+			cmds <- cmd
+			if _, err := server.Write([]byte(resp + "\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+	return beanstalk.NewConn(client), cmds
+}
+
+// dialer returns a dial func that hands out conns in order, and fails once it
+// runs out of these. n is set to the number of calls.
+func dialer(n *int, conns ...*beanstalk.Conn) func() (*beanstalk.Conn, error) {
+	var mu sync.Mutex
+	return func() (*beanstalk.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		*n++
+		if len(conns) == 0 {
+			return nil, errors.New("connection refused")
+		}
+		c := conns[0]
+		conns = conns[1:]
+		return c, nil
+	}
+}
+
+func TestReconnConn(t *testing.T) {
+	t.Run("Reconnects", func(t *testing.T) {
+		// The first server hangs up right away.
+		c1, _ := scriptedConn()
+		c2, cmds := scriptedConn("USING otp", "INSERTED 42")
+		var n int
+		r := newReconnConn(dialer(&n, c1, c2), WithUse("otp"), WithBackoff(20*time.Millisecond, time.Second))
+
+		if _, err := r.Put([]byte("{}"), 0, 0, time.Minute); err == nil {
+			t.Fatal("Got nil, expected error")
+		}
+		// Within the backoff, no attempt is made to reconnect.
+		if _, err := r.Put([]byte("{}"), 0, 0, time.Minute); !errors.Is(err, ErrDisconnected) {
+			t.Fatalf("Got %v, expected ErrDisconnected", err)
+		}
+		if n != 1 {
+			t.Fatalf("Got %d dials, expected 1", n)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		id, err := r.Put([]byte("{}"), 0, 0, time.Minute)
+		if err != nil {
+			t.Fatalf("Put: %s", err)
+		}
+		if id != 42 {
+			t.Errorf("Got %d, expected 42", id)
+		}
+		// The tube is selected again on the new connection.
+		if cmd := <-cmds; cmd != "use otp" {
+			t.Errorf("Got %q, expected use otp", cmd)
+		}
+	})
+
+	t.Run("Keeps connection on error responses", func(t *testing.T) {
+		c, _ := scriptedConn("NOT_FOUND", "DELETED")
+		var n int
+		r := newReconnConn(dialer(&n, c))
+
+		if err := r.Delete(1); !isNotFound(err) {
+			t.Fatalf("Got %v, expected not found", err)
+		}
+		if err := r.Delete(2); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		if n != 1 {
+			t.Errorf("Got %d dials, expected 1", n)
+		}
+	})
+
+	t.Run("Reserve waits while disconnected", func(t *testing.T) {
+		var n int
+		r := newReconnConn(dialer(&n), WithBackoff(time.Second, time.Second))
+		if _, err := r.get(); err == nil {
+			t.Fatal("Got nil, expected error")
+		}
+
+		start := time.Now()
+		_, _, err := r.Reserve(50 * time.Millisecond)
+		if !errors.Is(err, ErrDisconnected) {
+			t.Fatalf("Got %v, expected ErrDisconnected", err)
+		}
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Errorf("Returned after %s, expected to wait 50ms", d)
+		}
+		if n != 1 {
+			t.Errorf("Got %d dials, expected 1", n)
+		}
+	})
+
+	t.Run("Backoff", func(t *testing.T) {
+		r := newReconnConn(nil, WithBackoff(time.Second, 5*time.Second))
+
+		for _, want := range []time.Duration{1, 2, 4, 5, 5} {
+			r.backoff()
+			d := time.Until(r.retryAt).Round(time.Second)
+			if d != want*time.Second {
+				t.Errorf("Got %s, expected %s", d, want*time.Second)
+			}
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// maxQueueDelay is the longest delay a job can be put or released with:
+// beanstalkd takes it in seconds, as an unsigned 32-bit integer.
+const maxQueueDelay = math.MaxUint32 * time.Second
+
+// RetryPolicy decides how long a failed job waits before it is retried, and
+// when to stop retrying it altogether.
+type RetryPolicy struct {
+	// BaseDelay is the delay before the first retry.
+	BaseDelay time.Duration
+	// Multiplier is applied to the delay for every subsequent retry.
+	Multiplier float64
+	// Jitter randomizes every delay by up to this fraction in either
+	// direction, so jobs that failed together are not retried together.
+	Jitter float64
+	// MaxDelay caps the delay between two attempts. Zero, or a delay longer
+	// than the queue accepts, means the longest delay the queue accepts.
+	MaxDelay time.Duration
+	// MaxAttempts is the number of attempts after which a job is buried
+	// instead of released. Zero means jobs are retried forever.
+	MaxAttempts int
+}
+
+// DefaultRetryPolicy is used by consumers unless configured otherwise through
+// WithRetryPolicy. It gives up after roughly a day.
+var DefaultRetryPolicy = RetryPolicy{
+	BaseDelay:   10 * time.Second,
+	Multiplier:  2,
+	Jitter:      0.2,
+	MaxDelay:    4 * time.Hour,
+	MaxAttempts: 15,
+}
+
+// Delay returns how long to wait before retrying a job that failed its
+// attempt'th attempt, counting from 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := float64(p.BaseDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.Jitter > 0 {
+		d *= 1 - p.Jitter + 2*p.Jitter*rand.Float64()
+	}
+	max := p.MaxDelay
+	if max <= 0 || max > maxQueueDelay {
+		max = maxQueueDelay
+	}
+	switch {
+	case math.IsNaN(d) || d < 0:
+		return 0
+	case d > float64(max):
+		return max
+	}
+	return time.Duration(d)
+}
+
+// Exhausted reports whether a job that failed its attempt'th attempt must not
+// be retried again.
+func (p RetryPolicy) Exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
+
+// attempt returns which attempt at handling a job is being made, counting
+// from 1. Retried jobs carry the number of failed attempts in their headers h.
+// Jobs without that header, such as those put before it was introduced, are
+// counted by the releases in their stats instead.
+func attempt(h Headers, stats map[string]string) int {
+	if n, err := strconv.Atoi(h[HeaderAttempts]); err == nil {
+		return n + 1
+	}
+	n, err := strconv.Atoi(stats["releases"])
+	if err != nil {
+		return 1
+	}
+	return n + 1
+}
@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{
+		BaseDelay:   time.Second,
+		Multiplier:  2,
+		MaxDelay:    5 * time.Second,
+		MaxAttempts: 4,
+	}
+
+	tt := []struct {
+		attempt   int
+		delay     time.Duration
+		exhausted bool
+	}{
+		{1, time.Second, false},
+		{2, 2 * time.Second, false},
+		{3, 4 * time.Second, false},
+		{4, 5 * time.Second, true},
+		{5, 5 * time.Second, true},
+	}
+	for _, tc := range tt {
+		if d := p.Delay(tc.attempt); d != tc.delay {
+			t.Errorf("Got %s, expected %s for attempt %d", d, tc.delay, tc.attempt)
+		}
+		if ex := p.Exhausted(tc.attempt); ex != tc.exhausted {
+			t.Errorf("Got %t, expected %t for attempt %d", ex, tc.exhausted, tc.attempt)
+		}
+	}
+
+	t.Run("Jitter", func(t *testing.T) {
+		p := RetryPolicy{
+			BaseDelay:  time.Second,
+			Multiplier: 1,
+			Jitter:     0.5,
+		}
+		for i := 0; i < 100; i++ {
+			if d := p.Delay(1); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+				t.Fatalf("Got %s, expected 500ms-1.5s", d)
+			}
+		}
+	})
+
+	t.Run("Unlimited delay", func(t *testing.T) {
+		p := RetryPolicy{
+			BaseDelay:  time.Second,
+			Multiplier: 2,
+		}
+		for _, attempt := range []int{64, 1000, math.MaxInt32} {
+			if d := p.Delay(attempt); d != maxQueueDelay {
+				t.Errorf("Got %s, expected the maximum delay for attempt %d", d, attempt)
+			}
+		}
+	})
+
+	t.Run("Zero base delay", func(t *testing.T) {
+		p := RetryPolicy{Multiplier: 2}
+		if d := p.Delay(10000); d != 0 {
+			t.Errorf("Got %s, expected 0", d)
+		}
+	})
+
+	t.Run("Unlimited attempts", func(t *testing.T) {
+		var p RetryPolicy
+		if p.Exhausted(1000) {
+			t.Errorf("Got true, expected false")
+		}
+	})
+}
+
+func TestAttempt(t *testing.T) {
+	stats := map[string]string{"releases": "3"}
+	if n := attempt(nil, stats); n != 4 {
+		t.Errorf("Got %d, expected 4", n)
+	}
+	// Releases are not counted once the failed attempts are in the headers,
+	// as the job may have been released by a Shutdown.
+	if n := attempt(Headers{HeaderAttempts: "1"}, stats); n != 2 {
+		t.Errorf("Got %d, expected 2", n)
+	}
+	if n := attempt(nil, nil); n != 1 {
+		t.Errorf("Got %d, expected 1", n)
+	}
+}
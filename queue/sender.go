@@ -2,36 +2,150 @@ package queue
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/epels/birdbroker-go"
 )
 
-const defaultPriority = 0
+// maxDelay is the longest time a scheduled message is delayed in the queue.
+// Messages scheduled further ahead are queued right away, and scheduled by
+// MessageBird instead, so they don't sit in beanstalkd for weeks.
+const maxDelay = 24 * time.Hour
+
+// Messages are sent to at most recipientsPerRequest recipients at a time, one
+// request after another, so the time to run of their jobs grows with their
+// recipients: every request is given ttrPerRequest, on top of baseTTR. This
+// keeps a job from being reserved again while its message is still being
+// sent.
+const (
+	baseTTR              = 1 * time.Minute
+	recipientsPerRequest = 50
+	ttrPerRequest        = 10 * time.Second
+)
 
 type sender struct {
-	conn producerConn
+	conn senderConn
+
+	tubeFunc TubeFunc
+	tube     func(name string) producerConn
+}
+
+// SenderOption configures a sender created by NewSender.
+type SenderOption func(snd *sender)
+
+// WithTubes makes the sender put every message in the tube f returns for it,
+// using connection c. Messages are put in the tube used by the connection of
+// the sender otherwise.
+func WithTubes(c tubeProducer, f TubeFunc) SenderOption {
+	return func(snd *sender) {
+		snd.tubeFunc = f
+		snd.tube = c.Tube
+	}
+}
+
+// tubeProducer is a connection that can put jobs in any tube.
+type tubeProducer interface {
+	// Tube returns a connection that puts jobs in the tube named name.
+	Tube(name string) producerConn
 }
 
 type producerConn interface {
 	Put(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error)
 }
 
-func NewSender(c producerConn) *sender {
-	return &sender{conn: c}
+type senderConn interface {
+	producerConn
+	// Delete drops a job from the queue. Jobs that are reserved by another
+	// connection can't be deleted.
+	Delete(id uint64) error
+}
+
+func NewSender(c senderConn, opts ...SenderOption) *sender {
+	snd := &sender{conn: c}
+	for _, opt := range opts {
+		opt(snd)
+	}
+	return snd
 }
 
-func (snd *sender) Send(ctx context.Context, m *birdbroker.Message) error {
-	b, err := json.Marshal(m)
+// Send queues m, and returns the ID of the job holding it. The headers held by
+// ctx are added to the job.
+func (snd *sender) Send(ctx context.Context, m *birdbroker.Message) (uint64, error) {
+	b, err := encodeEnvelope(m, jobHeaders(ctx, Headers{
+		HeaderMessageID:  m.ID,
+		HeaderEnqueuedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}))
 	if err != nil {
-		return fmt.Errorf("encoding/json: Marshal: %s", err)
+		return 0, err
 	}
 
-	_, err = snd.conn.Put(b, defaultPriority, 0*time.Second, 1*time.Minute)
+	var conn producerConn = snd.conn
+	if snd.tubeFunc != nil {
+		conn = snd.tube(snd.tubeFunc(m))
+	}
+	id, err := conn.Put(b, priority(m.Priority), delay(m, time.Now()), ttr(m))
 	if err != nil {
-		return fmt.Errorf("%T: Put: %s", snd.conn, err)
+		return 0, fmt.Errorf("%T: Put: %s", conn, err)
+	}
+	return id, nil
+}
+
+// Cancel deletes the job identified by id, so the message it holds is not
+// sent. It fails if a worker reserved the job already.
+func (snd *sender) Cancel(ctx context.Context, id uint64) error {
+	if err := snd.conn.Delete(id); err != nil {
+		return fmt.Errorf("%T: Delete: %s", snd.conn, err)
 	}
 	return nil
 }
+
+// delay returns how long the job for m must be delayed at time now, so it is
+// reserved when m is scheduled to be sent.
+func delay(m *birdbroker.Message, now time.Time) time.Duration {
+	if m.ScheduledAt == nil {
+		return 0
+	}
+	d := m.ScheduledAt.Sub(now)
+	if d < 0 || d > maxDelay {
+		return 0
+	}
+	return d
+}
+
+// ttr returns the time to run of the job for m.
+func ttr(m *birdbroker.Message) time.Duration {
+	requests := (len(m.AllRecipients()) + recipientsPerRequest - 1) / recipientsPerRequest
+	return baseTTR + time.Duration(requests)*ttrPerRequest
+}
+
+// maxPipelined is the maximum number of Put commands SendBatch has
+// outstanding at the same time.
+const maxPipelined = 32
+
+// SendBatch sends every message of ms, and returns a job ID and an error for
+// each of them: the error at index i is nil if ms[i] was sent successfully.
+//
+// The Put commands are issued concurrently, so connections that pipeline
+// commands (like a beanstalk.Conn) don't wait for a response before sending
+// the next command.
+func (snd *sender) SendBatch(ctx context.Context, ms []*birdbroker.Message) ([]uint64, []error) {
+	ids := make([]uint64, len(ms))
+	errs := make([]error, len(ms))
+	sem := make(chan struct{}, maxPipelined)
+	var wg sync.WaitGroup
+	for i, m := range ms {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, m *birdbroker.Message) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ids[i], errs[i] = snd.Send(ctx, m)
+		}(i, m)
+	}
+	wg.Wait()
+	return ids, errs
+}
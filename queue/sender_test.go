@@ -2,8 +2,9 @@ package queue
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,9 +22,7 @@ func TestPublish(t *testing.T) {
 				var m struct {
 					Body, Originator, Recipient string
 				}
-				if err := json.Unmarshal(body, &m); err != nil {
-					t.Fatalf("encoding/json: Unmarshal: %s", err)
-				}
+				decodePayload(t, body, &m)
 
 				if m.Body != "Foo" {
 					t.Errorf("Got %q, expected Foo", m.Body)
@@ -35,12 +34,12 @@ func TestPublish(t *testing.T) {
 					t.Errorf("Got %q, expected Baz", m.Recipient)
 				}
 
-				return 0, nil
+				return 42, nil
 			},
 		}
 		snd := NewSender(&c)
 
-		err := snd.Send(context.Background(), &birdbroker.Message{
+		id, err := snd.Send(context.Background(), &birdbroker.Message{
 			Body:       "Foo",
 			Originator: "Bar",
 			Recipient:  "Baz",
@@ -48,6 +47,9 @@ func TestPublish(t *testing.T) {
 		if err != nil {
 			t.Errorf("Send: %s", err)
 		}
+		if id != 42 {
+			t.Errorf("Got %d, expected 42", id)
+		}
 		if !called {
 			t.Errorf("Got false, expected true")
 		}
@@ -61,7 +63,7 @@ func TestPublish(t *testing.T) {
 		}
 		snd := NewSender(&c)
 
-		err := snd.Send(context.Background(), &birdbroker.Message{
+		_, err := snd.Send(context.Background(), &birdbroker.Message{
 			Body:       "Foo",
 			Originator: "Bar",
 			Recipient:  "Baz",
@@ -71,3 +73,169 @@ func TestPublish(t *testing.T) {
 		}
 	})
 }
+
+func TestTTR(t *testing.T) {
+	recipients := func(n int) []string {
+		rs := make([]string, n)
+		for i := range rs {
+			rs[i] = fmt.Sprintf("3161234%04d", i)
+		}
+		return rs
+	}
+	tt := []struct {
+		recipients []string
+		expected   time.Duration
+	}{
+		{recipients(1), 70 * time.Second},
+		{recipients(50), 70 * time.Second},
+		{recipients(51), 80 * time.Second},
+		{recipients(birdbroker.MaxRecipients), 260 * time.Second},
+	}
+	for _, tc := range tt {
+		if got := ttr(&birdbroker.Message{Recipients: tc.recipients}); got != tc.expected {
+			t.Errorf("Got %s for %d recipients, expected %s", got, len(tc.recipients), tc.expected)
+		}
+	}
+}
+
+func TestSendPriority(t *testing.T) {
+	tt := []struct {
+		priority birdbroker.Priority
+		expected uint32
+	}{
+		{"", priorityTransactional},
+		{birdbroker.PriorityOTP, priorityOTP},
+		{birdbroker.PriorityTransactional, priorityTransactional},
+		{birdbroker.PriorityBulk, priorityBulk},
+	}
+	for _, tc := range tt {
+		t.Run(string(tc.priority), func(t *testing.T) {
+			c := mock.ProducerConn{
+				PutFunc: func(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+					if pri != tc.expected {
+						t.Errorf("Got %d, expected %d", pri, tc.expected)
+					}
+					return 1, nil
+				},
+			}
+			snd := NewSender(&c)
+
+			if _, err := snd.Send(context.Background(), &birdbroker.Message{Priority: tc.priority}); err != nil {
+				t.Errorf("Send: %s", err)
+			}
+		})
+	}
+}
+
+func TestSendTubes(t *testing.T) {
+	tubes := make(map[string]int)
+	snd := NewSender(nil)
+	snd.tubeFunc = ByPriority("birdbroker")
+	snd.tube = func(name string) producerConn {
+		return &mock.ProducerConn{
+			PutFunc: func(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+				tubes[name]++
+				return 1, nil
+			},
+		}
+	}
+
+	for _, p := range []birdbroker.Priority{"", birdbroker.PriorityOTP, birdbroker.PriorityTransactional} {
+		if _, err := snd.Send(context.Background(), &birdbroker.Message{Priority: p}); err != nil {
+			t.Fatalf("Send: %s", err)
+		}
+	}
+	if tubes["birdbroker-otp"] != 1 || tubes["birdbroker-transactional"] != 2 {
+		t.Errorf("Got %v, expected 1 job in birdbroker-otp and 2 in birdbroker-transactional", tubes)
+	}
+}
+
+func TestByOriginator(t *testing.T) {
+	f := ByOriginator("birdbroker")
+	if tube := f(&birdbroker.Message{Originator: "Foo Inc!"}); tube != "birdbroker-Foo_Inc_" {
+		t.Errorf("Got %q, expected birdbroker-Foo_Inc_", tube)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	var deleted uint64
+	c := mock.ProducerConn{
+		DeleteFunc: func(id uint64) error {
+			deleted = id
+			return nil
+		},
+	}
+	snd := NewSender(&c)
+
+	if err := snd.Cancel(context.Background(), 42); err != nil {
+		t.Fatalf("Cancel: %s", err)
+	}
+	if deleted != 42 {
+		t.Errorf("Got %d, expected 42", deleted)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+
+	tt := []struct {
+		name        string
+		scheduledAt *time.Time
+		expected    time.Duration
+	}{
+		{"Not scheduled", nil, 0},
+		{"Past", at(-time.Minute), 0},
+		{"Soon", at(time.Hour), time.Hour},
+		{"Beyond max delay", at(maxDelay + time.Hour), 0},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			m := birdbroker.Message{ScheduledAt: tc.scheduledAt}
+			if d := delay(&m, now); d != tc.expected {
+				t.Errorf("Got %s, expected %s", d, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	var mu sync.Mutex
+	var put []string
+	c := mock.ProducerConn{
+		PutFunc: func(body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+			var m birdbroker.Message
+			decodePayload(t, body, &m)
+			if m.Body == "fail" {
+				return 0, errors.New("oops")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			put = append(put, m.Body)
+			return 0, nil
+		},
+	}
+	snd := NewSender(&c)
+
+	_, errs := snd.SendBatch(context.Background(), []*birdbroker.Message{
+		{Body: "one"},
+		{Body: "fail"},
+		{Body: "three"},
+	})
+	if len(errs) != 3 {
+		t.Fatalf("Got %d, expected 3", len(errs))
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("Got %v, expected nil errors for index 0 and 2", errs)
+	}
+	if errs[1] == nil {
+		t.Errorf("Got nil, expected error")
+	}
+	if len(put) != 2 {
+		t.Errorf("Got %d, expected 2", len(put))
+	}
+}
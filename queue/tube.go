@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"strings"
+
+	"github.com/beanstalkd/go-beanstalk"
+
+	"github.com/epels/birdbroker-go"
+)
+
+// TubeFunc returns the name of the tube the job for m is put in.
+type TubeFunc func(m *birdbroker.Message) string
+
+// ByPriority puts messages in a tube per priority class, named after the
+// priority and prefixed with prefix (e.g. "birdbroker-otp").
+func ByPriority(prefix string) TubeFunc {
+	return func(m *birdbroker.Message) string {
+		p := m.Priority
+		if p == "" {
+			p = birdbroker.PriorityTransactional
+		}
+		return prefix + "-" + string(p)
+	}
+}
+
+// ByOriginator puts messages in a tube per originator, prefixed with prefix,
+// so a single noisy sender does not hold up the others. Characters not
+// allowed in tube names are replaced by underscores.
+func ByOriginator(prefix string) TubeFunc {
+	return func(m *birdbroker.Message) string {
+		return prefix + "-" + tubeName(m.Originator)
+	}
+}
+
+// tubeName replaces the characters of s that are not allowed in tube names.
+func tubeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if !strings.ContainsRune(beanstalk.NameChars, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
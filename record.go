@@ -0,0 +1,90 @@
+package birdbroker
+
+import "time"
+
+// Status is the lifecycle state of an accepted message.
+type Status string
+
+const (
+	// StatusAccepted is set as soon as a message passed validation.
+	StatusAccepted Status = "accepted"
+	// StatusQueued is set once a message was put on the queue.
+	StatusQueued Status = "queued"
+	// StatusScheduled is set instead of StatusQueued for messages that are
+	// to be sent at a later time, and while MessageBird holds on to such a
+	// message until then.
+	StatusScheduled Status = "scheduled"
+	// StatusSending is set while a worker is handing a message to
+	// MessageBird.
+	StatusSending Status = "sending"
+	// StatusSent is set once MessageBird accepted a message.
+	StatusSent Status = "sent"
+	// StatusDelivered is set once MessageBird reported the message was
+	// delivered to all of its recipients.
+	StatusDelivered Status = "delivered"
+	// StatusFailed is set when the last attempt to send a message failed,
+	// or when MessageBird reported it could not be delivered.
+	StatusFailed Status = "failed"
+	// StatusCancelled is set when a message was called back before it was
+	// handed to MessageBird.
+	StatusCancelled Status = "cancelled"
+	// StatusBuried is set when a message was given up on, and needs to be
+	// inspected manually.
+	StatusBuried Status = "buried"
+)
+
+// Record tracks the lifecycle of a single accepted message.
+type Record struct {
+	ID            string     `json:"id"`
+	Status        Status     `json:"status"`
+	MessageBirdID string     `json:"messagebird_id,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	CallbackURL   string     `json:"callback_url,omitempty"`
+	ScheduledAt   *time.Time `json:"scheduled_at,omitempty"`
+	// JobID is the ID of the beanstalk job holding the message, if it was
+	// queued.
+	JobID uint64 `json:"job_id,omitempty"`
+	// Bury tells why the job holding the message was buried, if it was.
+	Bury      *BuryRecord `json:"bury,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+
+	// Recipients holds the status of the message for every recipient, as
+	// last reported by MessageBird.
+	Recipients []RecipientStatus `json:"recipients,omitempty"`
+}
+
+// RecipientPending is the status of a recipient the message was not handed
+// to MessageBird for yet.
+const RecipientPending = "pending"
+
+// RecipientStatus is the status of a message for a single recipient, using
+// MessageBird's vocabulary (e.g. "sent", "delivered" or "delivery_failed").
+type RecipientStatus struct {
+	Recipient string `json:"recipient"`
+	Status    string `json:"status"`
+	// MessageBirdID is the ID of the MessageBird message the recipient was
+	// sent to. A message with many recipients is split into several
+	// MessageBird messages.
+	MessageBirdID string    `json:"messagebird_id,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// DeliveryReport is a status update for a single recipient of a message, as
+// reported by MessageBird.
+type DeliveryReport struct {
+	MessageID     string
+	MessageBirdID string
+	Recipient     string
+	Status        string
+	Reason        string
+	At            time.Time
+}
+
+// BatchResult is the outcome of accepting a single message of a batch. Either
+// ID and Status, or Error is set.
+type BatchResult struct {
+	ID     string `json:"id,omitempty"`
+	Status Status `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
@@ -2,29 +2,427 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/messagebird"
 )
 
+// defaultKeyRetention is how long idempotency keys are kept, unless
+// configured otherwise through WithKeyRetention.
+const defaultKeyRetention = 24 * time.Hour
+
+// maxKeyLength is the maximum length of an idempotency key.
+const maxKeyLength = 255
+
 type service struct {
 	snd sender
+	st  store
+
+	keys         keyStore
+	keyRetention time.Duration
 }
 
 type sender interface {
-	Send(ctx context.Context, m *birdbroker.Message) error
+	Cancel(ctx context.Context, jobID uint64) error
+	Send(ctx context.Context, m *birdbroker.Message) (uint64, error)
+	SendBatch(ctx context.Context, ms []*birdbroker.Message) ([]uint64, []error)
 }
 
-func New(snd sender) *service {
-	return &service{snd: snd}
+type store interface {
+	Create(ctx context.Context, r *birdbroker.Record) error
+	Get(ctx context.Context, id string) (*birdbroker.Record, error)
+	Update(ctx context.Context, id string, fn func(r *birdbroker.Record) error) error
 }
 
-func (s *service) SendMessage(ctx context.Context, m *birdbroker.Message) error {
-	if err := m.Validate(); err != nil {
-		return fmt.Errorf("message: Validate: %w", err)
+type keyStore interface {
+	PutKey(ctx context.Context, k *birdbroker.IdempotencyKey) (*birdbroker.IdempotencyKey, error)
+	DeleteKey(ctx context.Context, key string) error
+}
+
+// Option configures a service created by New.
+type Option func(s *service)
+
+// WithKeyStore enables idempotency keys, which are kept in ks.
+func WithKeyStore(ks keyStore) Option {
+	return func(s *service) {
+		s.keys = ks
+	}
+}
+
+// WithKeyRetention sets how long an idempotency key can be used to look up
+// the message it was first used with.
+func WithKeyRetention(d time.Duration) Option {
+	return func(s *service) {
+		s.keyRetention = d
 	}
-	if err := s.snd.Send(context.Background(), m); err != nil {
+}
+
+func New(snd sender, st store, opts ...Option) *service {
+	s := &service{
+		snd:          snd,
+		st:           st,
+		keyRetention: defaultKeyRetention,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// GetMessage returns the record of the message identified by id.
+func (s *service) GetMessage(ctx context.Context, id string) (*birdbroker.Record, error) {
+	r, err := s.st.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("%T: Get: %w", s.st, err)
+	}
+	return r, nil
+}
+
+// SendMessage validates m, assigns it an ID and queues it for sending. The
+// returned record can be used to look up the message status later.
+func (s *service) SendMessage(ctx context.Context, m *birdbroker.Message) (*birdbroker.Record, error) {
+	r, err := s.accept(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.send(ctx, m, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// send queues the accepted message m, and updates its record r accordingly.
+func (s *service) send(ctx context.Context, m *birdbroker.Message, r *birdbroker.Record) error {
+	jobID, err := s.snd.Send(context.Background(), m)
+	if err != nil {
+		s.setStatus(ctx, r, birdbroker.StatusFailed, err)
 		return fmt.Errorf("%T: Send: %s", s.snd, err)
 	}
+	s.setQueued(ctx, r, m, jobID)
 	return nil
 }
+
+// queuedStatus returns the status of m once it was queued.
+func queuedStatus(m *birdbroker.Message) birdbroker.Status {
+	if m.ScheduledAt != nil {
+		return birdbroker.StatusScheduled
+	}
+	return birdbroker.StatusQueued
+}
+
+// SendMessageIdempotent is like SendMessage, but only sends m once for every
+// key within the retention window. Repeated requests with the same key and
+// payload return the record of the original message. Using the key for a
+// different payload fails with ErrKeyReused.
+//
+// Keys of messages that could not be queued are released, so the request can
+// be retried.
+func (s *service) SendMessageIdempotent(ctx context.Context, key string, m *birdbroker.Message) (*birdbroker.Record, error) {
+	if s.keys == nil {
+		return nil, birdbroker.ClientError{Reason: "Idempotency keys are not supported"}
+	}
+	if key == "" || len(key) > maxKeyLength {
+		return nil, birdbroker.ClientError{Reason: fmt.Sprintf("Idempotency key length must be 1-%d chars", maxKeyLength)}
+	}
+
+	fp, err := fingerprint(m)
+	if err != nil {
+		return nil, err
+	}
+	id, err := birdbroker.NewID()
+	if err != nil {
+		return nil, fmt.Errorf("birdbroker: NewID: %s", err)
+	}
+
+	cur, err := s.keys.PutKey(ctx, &birdbroker.IdempotencyKey{
+		Key:         key,
+		Fingerprint: fp,
+		MessageID:   id,
+		ExpiresAt:   time.Now().Add(s.keyRetention),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%T: PutKey: %s", s.keys, err)
+	}
+	if cur != nil {
+		if cur.Fingerprint != fp {
+			return nil, fmt.Errorf("idempotency key %q: %w", key, birdbroker.ErrKeyReused)
+		}
+		r, err := s.st.Get(ctx, cur.MessageID)
+		if errors.Is(err, birdbroker.ErrNotFound) {
+			// The original request did not store its record yet.
+			return nil, fmt.Errorf("request with idempotency key %q is in progress: %w", key, birdbroker.ErrConflict)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%T: Get: %s", s.st, err)
+		}
+		return r, nil
+	}
+
+	r, err := s.acceptWithID(ctx, m, id)
+	if err == nil {
+		err = s.send(ctx, m, r)
+	}
+	if err != nil {
+		if err := s.keys.DeleteKey(ctx, key); err != nil {
+			log.Printf("%T: DeleteKey: %s", s.keys, err)
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// fingerprint returns a hash of the payload of m, disregarding its ID.
+func fingerprint(m *birdbroker.Message) (string, error) {
+	cp := *m
+	cp.ID = ""
+	b, err := json.Marshal(&cp)
+	if err != nil {
+		return "", fmt.Errorf("encoding/json: Marshal: %s", err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// SendMessages is like SendMessage, but for many messages at once. Every
+// message is validated and queued on its own: the result at index i tells
+// whether ms[i] was accepted.
+func (s *service) SendMessages(ctx context.Context, ms []*birdbroker.Message) []birdbroker.BatchResult {
+	res := make([]birdbroker.BatchResult, len(ms))
+	recs := make([]*birdbroker.Record, len(ms))
+	var accepted []*birdbroker.Message
+	var idx []int
+	for i, m := range ms {
+		r, err := s.accept(ctx, m)
+		if err != nil {
+			res[i].Error = errorReason(err)
+			continue
+		}
+		recs[i] = r
+		accepted = append(accepted, m)
+		idx = append(idx, i)
+	}
+	if len(accepted) == 0 {
+		return res
+	}
+
+	jobIDs, errs := s.snd.SendBatch(context.Background(), accepted)
+	for j, i := range idx {
+		if err := errs[j]; err != nil {
+			log.Printf("%T: SendBatch: %s", s.snd, err)
+			s.setStatus(ctx, recs[i], birdbroker.StatusFailed, err)
+			res[i].Error = errorReason(err)
+			continue
+		}
+		s.setQueued(ctx, recs[i], ms[i], jobIDs[j])
+		res[i].ID = recs[i].ID
+		res[i].Status = recs[i].Status
+	}
+	return res
+}
+
+// accept validates m, assigns it an ID and stores a record for it.
+func (s *service) accept(ctx context.Context, m *birdbroker.Message) (*birdbroker.Record, error) {
+	id, err := birdbroker.NewID()
+	if err != nil {
+		return nil, fmt.Errorf("birdbroker: NewID: %s", err)
+	}
+	return s.acceptWithID(ctx, m, id)
+}
+
+// acceptWithID is like accept, but assigns ID id to m.
+func (s *service) acceptWithID(ctx context.Context, m *birdbroker.Message, id string) (*birdbroker.Record, error) {
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("message: Validate: %w", err)
+	}
+	m.ID = id
+
+	now := time.Now()
+	r := birdbroker.Record{
+		ID:          id,
+		Status:      birdbroker.StatusAccepted,
+		CallbackURL: m.CallbackURL,
+		ScheduledAt: m.ScheduledAt,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	for _, rcpt := range m.AllRecipients() {
+		r.Recipients = append(r.Recipients, birdbroker.RecipientStatus{
+			Recipient: rcpt,
+			Status:    birdbroker.RecipientPending,
+			UpdatedAt: now,
+		})
+	}
+	if err := s.st.Create(ctx, &r); err != nil {
+		return nil, fmt.Errorf("%T: Create: %s", s.st, err)
+	}
+	return &r, nil
+}
+
+// errorReason returns the reason of err if it's a client error, so it can be
+// shown to the caller. Other errors are not exposed.
+func errorReason(err error) string {
+	var ce birdbroker.ClientError
+	if errors.As(err, &ce) {
+		return ce.Reason
+	}
+	return "Internal Server Error"
+}
+
+// UpdateDeliveryStatus applies the delivery report dr to the record of the
+// message it is about. Reports older than the last known status of the
+// recipient are ignored, as they may arrive out of order.
+func (s *service) UpdateDeliveryStatus(ctx context.Context, dr *birdbroker.DeliveryReport) error {
+	if dr.MessageID == "" {
+		return fmt.Errorf("delivery report without reference for %q: %w", dr.MessageBirdID, birdbroker.ErrNotFound)
+	}
+
+	err := s.st.Update(ctx, dr.MessageID, func(r *birdbroker.Record) error {
+		if r.MessageBirdID == "" {
+			r.MessageBirdID = dr.MessageBirdID
+		}
+		applyDeliveryReport(r, dr)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%T: Update: %w", s.st, err)
+	}
+	return nil
+}
+
+func applyDeliveryReport(r *birdbroker.Record, dr *birdbroker.DeliveryReport) {
+	rs := birdbroker.RecipientStatus{
+		Recipient:     dr.Recipient,
+		Status:        dr.Status,
+		MessageBirdID: dr.MessageBirdID,
+		UpdatedAt:     dr.At,
+	}
+
+	// MessageBird reports recipients without formatting, so "+31 6 12345678"
+	// is reported as "31612345678".
+	found := false
+	for i, cur := range r.Recipients {
+		if birdbroker.NormalizeRecipient(cur.Recipient) != birdbroker.NormalizeRecipient(dr.Recipient) {
+			continue
+		}
+		found = true
+		if dr.At.Before(cur.UpdatedAt) {
+			return
+		}
+		rs.Recipient = cur.Recipient
+		if rs.MessageBirdID == "" {
+			rs.MessageBirdID = cur.MessageBirdID
+		}
+		r.Recipients[i] = rs
+	}
+	if !found {
+		r.Recipients = append(r.Recipients, rs)
+	}
+
+	// Only settle the status of the message once every recipient reached a
+	// final state.
+	var delivered, failed int
+	for _, cur := range r.Recipients {
+		switch cur.Status {
+		case messagebird.StatusDelivered:
+			delivered++
+		case messagebird.StatusDeliveryFailed, messagebird.StatusExpired:
+			failed++
+		}
+	}
+	switch {
+	case delivered+failed < len(r.Recipients):
+	case failed == 0:
+		r.Status = birdbroker.StatusDelivered
+		r.Error = ""
+	default:
+		r.Status = birdbroker.StatusFailed
+		r.Error = fmt.Sprintf("not delivered to %d of %d recipients", failed, len(r.Recipients))
+		if dr.Reason != "" {
+			r.Error += ": " + dr.Reason
+		}
+	}
+}
+
+// CancelMessage calls back the message identified by id, unless it was handed
+// to MessageBird already, in which case ErrConflict is returned. Its job is
+// deleted from the queue if possible: otherwise, the worker skips the message
+// once it reserves the job.
+func (s *service) CancelMessage(ctx context.Context, id string) (*birdbroker.Record, error) {
+	var r birdbroker.Record
+	err := s.st.Update(ctx, id, func(cur *birdbroker.Record) error {
+		if cur.Status == birdbroker.StatusCancelled {
+			r = *cur
+			return nil
+		}
+		if !cancellable(cur) {
+			return fmt.Errorf("message with status %q: %w", cur.Status, birdbroker.ErrConflict)
+		}
+		cur.Status = birdbroker.StatusCancelled
+		cur.Error = ""
+		r = *cur
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%T: Update: %w", s.st, err)
+	}
+
+	if r.JobID != 0 {
+		if err := s.snd.Cancel(ctx, r.JobID); err != nil {
+			log.Printf("%T: Cancel: %s", s.snd, err)
+		}
+	}
+	return &r, nil
+}
+
+// cancellable reports whether the message of r can still be called back,
+// which is the case as long as no part of it reached MessageBird.
+func cancellable(r *birdbroker.Record) bool {
+	switch r.Status {
+	case birdbroker.StatusAccepted, birdbroker.StatusQueued, birdbroker.StatusScheduled,
+		birdbroker.StatusFailed, birdbroker.StatusBuried:
+		return r.MessageBirdID == ""
+	}
+	return false
+}
+
+// setQueued records that m was queued as job jobID, and moves the record r to
+// the queued (or scheduled) status like setStatus.
+func (s *service) setQueued(ctx context.Context, r *birdbroker.Record, m *birdbroker.Message, jobID uint64) {
+	err := s.st.Update(ctx, r.ID, func(cur *birdbroker.Record) error {
+		cur.JobID = jobID
+		if cur.Status == birdbroker.StatusAccepted {
+			cur.Status = queuedStatus(m)
+		}
+		*r = *cur
+		return nil
+	})
+	if err != nil {
+		log.Printf("%T: Update: %s", s.st, err)
+	}
+}
+
+// setStatus moves the record r to status, unless a worker already picked up
+// the message and moved it past the accepted state. Failing to store the
+// status is not fatal, as the message itself was (or was not) queued already.
+func (s *service) setStatus(ctx context.Context, r *birdbroker.Record, status birdbroker.Status, cause error) {
+	err := s.st.Update(ctx, r.ID, func(cur *birdbroker.Record) error {
+		if cur.Status == birdbroker.StatusAccepted {
+			cur.Status = status
+			if cause != nil {
+				cur.Error = cause.Error()
+			}
+		}
+		*r = *cur
+		return nil
+	})
+	if err != nil {
+		log.Printf("%T: Update: %s", s.st, err)
+	}
+}
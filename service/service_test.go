@@ -3,7 +3,9 @@ package service
 import (
 	"context"
 	"errors"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/epels/birdbroker-go"
 	"github.com/epels/birdbroker-go/internal/mock"
@@ -49,11 +51,63 @@ func TestSendMessage(t *testing.T) {
 					Recipient:  "",
 				},
 			},
+			{
+				"Recipients: empty",
+				&birdbroker.Message{
+					Body:       "Hello",
+					Originator: "Foo",
+					Recipients: []string{"31612345678", ""},
+				},
+			},
+			{
+				"Recipients: too many",
+				&birdbroker.Message{
+					Body:       "Hello",
+					Originator: "Foo",
+					Recipients: manyRecipients(birdbroker.MaxRecipients + 1),
+				},
+			},
+			{
+				"Priority",
+				&birdbroker.Message{
+					Body:       "Hello",
+					Originator: "Foo",
+					Recipient:  "31612345678",
+					Priority:   "urgent",
+				},
+			},
+			{
+				"Scheduled: past",
+				&birdbroker.Message{
+					Body:        "Hello",
+					Originator:  "Foo",
+					Recipient:   "31612345678",
+					ScheduledAt: timePtr(time.Now().Add(-time.Minute)),
+				},
+			},
+			{
+				"Scheduled: beyond horizon",
+				&birdbroker.Message{
+					Body:        "Hello",
+					Originator:  "Foo",
+					Recipient:   "31612345678",
+					ScheduledAt: timePtr(time.Now().Add(birdbroker.MaxScheduleHorizon + time.Hour)),
+				},
+			},
+			{
+				"Callback URL",
+				&birdbroker.Message{
+					Body:        "Hello",
+					Originator:  "Foo",
+					Recipient:   "31612345678",
+					CallbackURL: "/relative",
+				},
+			},
 		}
 		for _, tc := range tt {
 			t.Run(tc.name, func(t *testing.T) {
 				var ce birdbroker.ClientError
-				if err := s.SendMessage(context.Background(), tc.m); !errors.As(err, &ce) {
+				if _, err := s.SendMessage(context.Background(), tc.m); !errors.As(err, &ce) {
 					t.Errorf("Got %T, expected ClientError", err)
 				}
 			})
@@ -62,11 +116,15 @@ func TestSendMessage(t *testing.T) {
 
 	t.Run("OK", func(t *testing.T) {
 		var called bool
+		var created birdbroker.Record
 		s := service{
 			snd: &mock.Sender{
-				SendFunc: func(m *birdbroker.Message) error {
+				SendFunc: func(m *birdbroker.Message) (uint64, error) {
 					called = true
 
+					if m.ID == "" {
+						t.Errorf("Got empty string, expected ID")
+					}
 					if m.Body != "Hello" {
 						t.Errorf("Got %q, expected Hello", m.Body)
 					}
@@ -77,8 +135,23 @@ func TestSendMessage(t *testing.T) {
 						t.Errorf("Got %q, expected 31612345678", m.Recipient)
 					}
 
+					return 1, nil
+				},
+			},
+			st: &mock.Store{
+				CreateFunc: func(r *birdbroker.Record) error {
+					if r.Status != birdbroker.StatusAccepted {
+						t.Errorf("Got %q, expected accepted", r.Status)
+					}
+					created = *r
 					return nil
 				},
+				UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+					if id != created.ID {
+						t.Errorf("Got %q, expected %q", id, created.ID)
+					}
+					return fn(&created)
+				},
 			},
 		}
 
@@ -87,11 +160,487 @@ func TestSendMessage(t *testing.T) {
 			Originator: "Foo",
 			Recipient:  "31612345678",
 		}
-		if err := s.SendMessage(context.Background(), &m); err != nil {
+		r, err := s.SendMessage(context.Background(), &m)
+		if err != nil {
 			t.Fatalf("SendMessage: %s", err)
 		}
 		if !called {
 			t.Errorf("Got false, expected true")
 		}
+		if r.ID != m.ID {
+			t.Errorf("Got %q, expected %q", r.ID, m.ID)
+		}
+		if r.Status != birdbroker.StatusQueued {
+			t.Errorf("Got %q, expected queued", r.Status)
+		}
+	})
+
+	t.Run("Multiple recipients", func(t *testing.T) {
+		var created birdbroker.Record
+		s := service{
+			snd: &mock.Sender{
+				SendFunc: func(m *birdbroker.Message) (uint64, error) {
+					return 1, nil
+				},
+			},
+			st: &mock.Store{
+				CreateFunc: func(r *birdbroker.Record) error {
+					created = *r
+					return nil
+				},
+				UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+					return fn(&created)
+				},
+			},
+		}
+
+		m := birdbroker.Message{
+			Body:       "Hello",
+			Originator: "Foo",
+			Recipient:  "+31612345678",
+			Recipients: []string{"31612345678", "31687654321"},
+		}
+		r, err := s.SendMessage(context.Background(), &m)
+		if err != nil {
+			t.Fatalf("SendMessage: %s", err)
+		}
+		// Duplicates are only sent to once.
+		if len(r.Recipients) != 2 {
+			t.Fatalf("Got %d, expected 2", len(r.Recipients))
+		}
+		for i, exp := range []string{"+31612345678", "31687654321"} {
+			if rs := r.Recipients[i]; rs.Recipient != exp || rs.Status != birdbroker.RecipientPending {
+				t.Errorf("Got %+v, expected %s with status pending", rs, exp)
+			}
+		}
+	})
+
+	t.Run("Scheduled", func(t *testing.T) {
+		var created birdbroker.Record
+		s := service{
+			snd: &mock.Sender{
+				SendFunc: func(m *birdbroker.Message) (uint64, error) {
+					return 1, nil
+				},
+			},
+			st: &mock.Store{
+				CreateFunc: func(r *birdbroker.Record) error {
+					created = *r
+					return nil
+				},
+				UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+					return fn(&created)
+				},
+			},
+		}
+
+		at := time.Now().Add(time.Hour)
+		m := birdbroker.Message{
+			Body:        "Hello",
+			Originator:  "Foo",
+			Recipient:   "31612345678",
+			ScheduledAt: &at,
+		}
+		r, err := s.SendMessage(context.Background(), &m)
+		if err != nil {
+			t.Fatalf("SendMessage: %s", err)
+		}
+		if r.Status != birdbroker.StatusScheduled {
+			t.Errorf("Got %q, expected scheduled", r.Status)
+		}
+		if r.ScheduledAt == nil || !r.ScheduledAt.Equal(at) {
+			t.Errorf("Got %v, expected %s", r.ScheduledAt, at)
+		}
+	})
+
+	t.Run("Send error", func(t *testing.T) {
+		var status birdbroker.Status
+		s := service{
+			snd: &mock.Sender{
+				SendFunc: func(m *birdbroker.Message) (uint64, error) {
+					return 0, errors.New("oops")
+				},
+			},
+			st: &mock.Store{
+				CreateFunc: func(r *birdbroker.Record) error {
+					return nil
+				},
+				UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+					r := birdbroker.Record{ID: id, Status: birdbroker.StatusAccepted}
+					err := fn(&r)
+					status = r.Status
+					return err
+				},
+			},
+		}
+
+		m := birdbroker.Message{
+			Body:       "Hello",
+			Originator: "Foo",
+			Recipient:  "31612345678",
+		}
+		if _, err := s.SendMessage(context.Background(), &m); err == nil {
+			t.Errorf("Got nil, expected error")
+		}
+		if status != birdbroker.StatusFailed {
+			t.Errorf("Got %q, expected failed", status)
+		}
 	})
 }
+
+func TestSendMessageIdempotent(t *testing.T) {
+	m := func() *birdbroker.Message {
+		return &birdbroker.Message{
+			Body:       "Hello",
+			Originator: "Foo",
+			Recipient:  "31612345678",
+		}
+	}
+
+	newService := func(sendErr error) (*service, *int) {
+		var sent int
+		records := make(map[string]*birdbroker.Record)
+		keys := make(map[string]birdbroker.IdempotencyKey)
+		return &service{
+			snd: &mock.Sender{
+				SendFunc: func(m *birdbroker.Message) (uint64, error) {
+					sent++
+					return 1, sendErr
+				},
+			},
+			st: &mock.Store{
+				CreateFunc: func(r *birdbroker.Record) error {
+					records[r.ID] = r
+					return nil
+				},
+				GetFunc: func(id string) (*birdbroker.Record, error) {
+					r, ok := records[id]
+					if !ok {
+						return nil, birdbroker.ErrNotFound
+					}
+					return r, nil
+				},
+				UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+					return fn(records[id])
+				},
+			},
+			keys: &mock.KeyStore{
+				PutKeyFunc: func(k *birdbroker.IdempotencyKey) (*birdbroker.IdempotencyKey, error) {
+					if cur, ok := keys[k.Key]; ok {
+						return &cur, nil
+					}
+					keys[k.Key] = *k
+					return nil, nil
+				},
+				DeleteKeyFunc: func(key string) error {
+					delete(keys, key)
+					return nil
+				},
+			},
+			keyRetention: time.Hour,
+		}, &sent
+	}
+
+	t.Run("Repeated", func(t *testing.T) {
+		s, sent := newService(nil)
+
+		r1, err := s.SendMessageIdempotent(context.Background(), "key", m())
+		if err != nil {
+			t.Fatalf("SendMessageIdempotent: %s", err)
+		}
+		r2, err := s.SendMessageIdempotent(context.Background(), "key", m())
+		if err != nil {
+			t.Fatalf("SendMessageIdempotent: %s", err)
+		}
+		if r1.ID != r2.ID {
+			t.Errorf("Got %q, expected %q", r2.ID, r1.ID)
+		}
+		if r2.Status != birdbroker.StatusQueued {
+			t.Errorf("Got %q, expected queued", r2.Status)
+		}
+		if *sent != 1 {
+			t.Errorf("Got %d, expected 1", *sent)
+		}
+	})
+
+	t.Run("Different payload", func(t *testing.T) {
+		s, sent := newService(nil)
+
+		if _, err := s.SendMessageIdempotent(context.Background(), "key", m()); err != nil {
+			t.Fatalf("SendMessageIdempotent: %s", err)
+		}
+		other := m()
+		other.Body = "Bye"
+		if _, err := s.SendMessageIdempotent(context.Background(), "key", other); !errors.Is(err, birdbroker.ErrKeyReused) {
+			t.Errorf("Got %v, expected ErrKeyReused", err)
+		}
+		if *sent != 1 {
+			t.Errorf("Got %d, expected 1", *sent)
+		}
+	})
+
+	t.Run("Send error releases key", func(t *testing.T) {
+		s, sent := newService(errors.New("oops"))
+
+		for i := 0; i < 2; i++ {
+			if _, err := s.SendMessageIdempotent(context.Background(), "key", m()); err == nil {
+				t.Errorf("Got nil, expected error")
+			}
+		}
+		if *sent != 2 {
+			t.Errorf("Got %d, expected 2", *sent)
+		}
+	})
+
+	t.Run("Not supported", func(t *testing.T) {
+		var s service
+
+		var ce birdbroker.ClientError
+		if _, err := s.SendMessageIdempotent(context.Background(), "key", m()); !errors.As(err, &ce) {
+			t.Errorf("Got %T, expected ClientError", err)
+		}
+	})
+}
+
+func TestCancelMessage(t *testing.T) {
+	tt := []struct {
+		name      string
+		rec       birdbroker.Record
+		conflict  bool
+		cancelled uint64
+	}{
+		{"Queued", birdbroker.Record{Status: birdbroker.StatusQueued, JobID: 7}, false, 7},
+		{"Scheduled", birdbroker.Record{Status: birdbroker.StatusScheduled, JobID: 7}, false, 7},
+		{"Failed to queue", birdbroker.Record{Status: birdbroker.StatusFailed}, false, 0},
+		{"Already cancelled", birdbroker.Record{Status: birdbroker.StatusCancelled, JobID: 7}, false, 7},
+		{"Sending", birdbroker.Record{Status: birdbroker.StatusSending, JobID: 7}, true, 0},
+		{"Sent", birdbroker.Record{Status: birdbroker.StatusSent, MessageBirdID: "mb-1"}, true, 0},
+		{"Scheduled by MessageBird", birdbroker.Record{Status: birdbroker.StatusScheduled, MessageBirdID: "mb-1"}, true, 0},
+		{"Partially sent", birdbroker.Record{Status: birdbroker.StatusFailed, MessageBirdID: "mb-1"}, true, 0},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var cancelled uint64
+			r := tc.rec
+			s := service{
+				snd: &mock.Sender{
+					CancelFunc: func(id uint64) error {
+						cancelled = id
+						return errors.New("reserved")
+					},
+				},
+				st: &mock.Store{
+					UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+						return fn(&r)
+					},
+				},
+			}
+
+			res, err := s.CancelMessage(context.Background(), "abc")
+			if tc.conflict {
+				if !errors.Is(err, birdbroker.ErrConflict) {
+					t.Errorf("Got %v, expected ErrConflict", err)
+				}
+				return
+			}
+			// Failing to delete the job is not fatal: the worker skips it.
+			if err != nil {
+				t.Fatalf("CancelMessage: %s", err)
+			}
+			if res.Status != birdbroker.StatusCancelled {
+				t.Errorf("Got %q, expected cancelled", res.Status)
+			}
+			if cancelled != tc.cancelled {
+				t.Errorf("Got %d, expected %d", cancelled, tc.cancelled)
+			}
+		})
+	}
+
+	t.Run("Not found", func(t *testing.T) {
+		s := service{
+			st: &mock.Store{
+				UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+					return birdbroker.ErrNotFound
+				},
+			},
+		}
+		if _, err := s.CancelMessage(context.Background(), "abc"); !errors.Is(err, birdbroker.ErrNotFound) {
+			t.Errorf("Got %v, expected ErrNotFound", err)
+		}
+	})
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func manyRecipients(n int) []string {
+	rs := make([]string, n)
+	for i := range rs {
+		rs[i] = strconv.Itoa(31600000000 + i)
+	}
+	return rs
+}
+
+func TestGetMessage(t *testing.T) {
+	s := service{
+		st: &mock.Store{
+			GetFunc: func(id string) (*birdbroker.Record, error) {
+				return nil, birdbroker.ErrNotFound
+			},
+		},
+	}
+
+	if _, err := s.GetMessage(context.Background(), "nope"); !errors.Is(err, birdbroker.ErrNotFound) {
+		t.Errorf("Got %v, expected ErrNotFound", err)
+	}
+}
+
+func TestUpdateDeliveryStatus(t *testing.T) {
+	now := time.Now()
+
+	tt := []struct {
+		name       string
+		recipients []birdbroker.RecipientStatus
+		report     birdbroker.DeliveryReport
+		status     birdbroker.Status
+	}{
+		{
+			"Delivered",
+			[]birdbroker.RecipientStatus{
+				{Recipient: "31612345678", Status: "sent", UpdatedAt: now.Add(-time.Minute)},
+			},
+			birdbroker.DeliveryReport{Recipient: "31612345678", Status: "delivered", At: now},
+			birdbroker.StatusDelivered,
+		},
+		{
+			"Failed",
+			[]birdbroker.RecipientStatus{
+				{Recipient: "31612345678", Status: "sent", UpdatedAt: now.Add(-time.Minute)},
+			},
+			birdbroker.DeliveryReport{Recipient: "31612345678", Status: "delivery_failed", At: now},
+			birdbroker.StatusFailed,
+		},
+		{
+			"Out of order",
+			[]birdbroker.RecipientStatus{
+				{Recipient: "31612345678", Status: "delivered", UpdatedAt: now},
+			},
+			birdbroker.DeliveryReport{Recipient: "31612345678", Status: "buffered", At: now.Add(-time.Minute)},
+			birdbroker.StatusSent,
+		},
+		{
+			"Pending recipients",
+			[]birdbroker.RecipientStatus{
+				{Recipient: "31612345678", Status: "sent", UpdatedAt: now.Add(-time.Minute)},
+				{Recipient: "31687654321", Status: "sent", UpdatedAt: now.Add(-time.Minute)},
+			},
+			birdbroker.DeliveryReport{Recipient: "31612345678", Status: "delivered", At: now},
+			birdbroker.StatusSent,
+		},
+		{
+			"Pending recipients: not sent yet",
+			[]birdbroker.RecipientStatus{
+				{Recipient: "31612345678", Status: "sent", UpdatedAt: now.Add(-time.Minute)},
+				{Recipient: "31687654321", Status: birdbroker.RecipientPending, UpdatedAt: now.Add(-time.Minute)},
+			},
+			birdbroker.DeliveryReport{Recipient: "31612345678", Status: "delivered", At: now},
+			birdbroker.StatusSent,
+		},
+		{
+			"Formatted recipient",
+			[]birdbroker.RecipientStatus{
+				{Recipient: "+31 6 12345678", Status: "sent", UpdatedAt: now.Add(-time.Minute)},
+			},
+			birdbroker.DeliveryReport{Recipient: "31612345678", Status: "delivered", At: now},
+			birdbroker.StatusDelivered,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := birdbroker.Record{
+				ID:         "abc",
+				Status:     birdbroker.StatusSent,
+				Recipients: tc.recipients,
+			}
+			s := service{
+				st: &mock.Store{
+					UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+						if id != "abc" {
+							t.Errorf("Got %q, expected abc", id)
+						}
+						return fn(&r)
+					},
+				},
+			}
+
+			tc.report.MessageID = "abc"
+			tc.report.MessageBirdID = "mb-1"
+			if err := s.UpdateDeliveryStatus(context.Background(), &tc.report); err != nil {
+				t.Fatalf("UpdateDeliveryStatus: %s", err)
+			}
+			if r.Status != tc.status {
+				t.Errorf("Got %q, expected %q", r.Status, tc.status)
+			}
+			if r.MessageBirdID != "mb-1" {
+				t.Errorf("Got %q, expected mb-1", r.MessageBirdID)
+			}
+		})
+	}
+
+	t.Run("Without reference", func(t *testing.T) {
+		var s service
+		err := s.UpdateDeliveryStatus(context.Background(), &birdbroker.DeliveryReport{MessageBirdID: "mb-1"})
+		if !errors.Is(err, birdbroker.ErrNotFound) {
+			t.Errorf("Got %v, expected ErrNotFound", err)
+		}
+	})
+}
+
+func TestSendMessages(t *testing.T) {
+	records := make(map[string]*birdbroker.Record)
+	s := service{
+		snd: &mock.Sender{
+			SendBatchFunc: func(ms []*birdbroker.Message) ([]uint64, []error) {
+				if len(ms) != 2 {
+					t.Fatalf("Got %d, expected 2", len(ms))
+				}
+				return []uint64{1, 0}, []error{nil, errors.New("oops")}
+			},
+		},
+		st: &mock.Store{
+			CreateFunc: func(r *birdbroker.Record) error {
+				records[r.ID] = r
+				return nil
+			},
+			UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+				return fn(records[id])
+			},
+		},
+	}
+
+	res := s.SendMessages(context.Background(), []*birdbroker.Message{
+		{Body: "Hello", Originator: "Foo", Recipient: "31612345678"},
+		{Body: "", Originator: "Foo", Recipient: "31612345678"},
+		{Body: "Hello", Originator: "Foo", Recipient: "31687654321"},
+	})
+	if len(res) != 3 {
+		t.Fatalf("Got %d, expected 3", len(res))
+	}
+
+	if res[0].ID == "" || res[0].Status != birdbroker.StatusQueued {
+		t.Errorf("Got %+v, expected queued message", res[0])
+	}
+	if r := records[res[0].ID]; r == nil || r.JobID != 1 {
+		t.Errorf("Got %+v, expected job ID 1", r)
+	}
+	if res[1].Error != "Missing body" {
+		t.Errorf("Got %q, expected Missing body", res[1].Error)
+	}
+	if res[2].Error != "Internal Server Error" {
+		t.Errorf("Got %q, expected Internal Server Error", res[2].Error)
+	}
+	if len(records) != 2 {
+		t.Errorf("Got %d, expected 2", len(records))
+	}
+}
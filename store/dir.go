@@ -0,0 +1,351 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/epels/birdbroker-go"
+)
+
+type dir struct {
+	path     string
+	lockFile *os.File // Locked across processes while a file is updated.
+
+	mu        sync.Mutex // Serializes updates within this process.
+	lastSweep time.Time
+}
+
+// lockName is the name of the lock file kept in the directory.
+const lockName = ".lock"
+
+// keysDir is the subdirectory idempotency keys are kept in.
+const keysDir = "keys"
+
+// buriedDir is the subdirectory bury records are kept in.
+const buriedDir = "buried"
+
+// NewDir creates a store that keeps every record as a JSON file in directory
+// path, so it can be shared by processes on the same host (or volume). The
+// directory is created if it does not exist yet. Updates take a lock on a
+// file in the directory, so processes never overwrite each other's changes.
+func NewDir(path string) (*dir, error) {
+	for _, sub := range []string{keysDir, buriedDir} {
+		if err := os.MkdirAll(filepath.Join(path, sub), 0755); err != nil {
+			return nil, fmt.Errorf("os: MkdirAll: %s", err)
+		}
+	}
+	lf, err := os.OpenFile(filepath.Join(path, lockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("os: OpenFile: %s", err)
+	}
+	return &dir{path: path, lockFile: lf}, nil
+}
+
+// Close closes the lock file of s.
+func (s *dir) Close() error {
+	if err := s.lockFile.Close(); err != nil {
+		return fmt.Errorf("os: File.Close: %s", err)
+	}
+	return nil
+}
+
+// lock locks s within this process and across processes, and returns a
+// function that releases the lock.
+func (s *dir) lock() (func(), error) {
+	s.mu.Lock()
+	if err := syscall.Flock(int(s.lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("syscall: Flock: %s", err)
+	}
+	return func() {
+		syscall.Flock(int(s.lockFile.Fd()), syscall.LOCK_UN)
+		s.mu.Unlock()
+	}, nil
+}
+
+func (s *dir) Create(ctx context.Context, r *birdbroker.Record) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fn, err := s.filename(r.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(fn); err == nil {
+		return fmt.Errorf("record %q already exists", r.ID)
+	}
+	return s.write(fn, r)
+}
+
+func (s *dir) Get(ctx context.Context, id string) (*birdbroker.Record, error) {
+	fn, err := s.filename(id)
+	if err != nil {
+		return nil, birdbroker.ErrNotFound
+	}
+	return s.read(fn)
+}
+
+// Update calls fn with the record identified by id, and stores the result if
+// fn returns nil.
+func (s *dir) Update(ctx context.Context, id string, fn func(r *birdbroker.Record) error) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	name, err := s.filename(id)
+	if err != nil {
+		return birdbroker.ErrNotFound
+	}
+	r, err := s.read(name)
+	if err != nil {
+		return err
+	}
+	if err := fn(r); err != nil {
+		return err
+	}
+	r.UpdatedAt = time.Now()
+	return s.write(name, r)
+}
+
+// PutKey stores k, unless a key with the same name that did not expire yet
+// exists. In that case, the existing key is returned instead. The key is
+// looked up and stored under the lock of s, so of the processes putting the
+// same key at once, only one stores it. Expired keys are deleted now and then.
+func (s *dir) PutKey(ctx context.Context, k *birdbroker.IdempotencyKey) (*birdbroker.IdempotencyKey, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > sweepInterval {
+		if err := s.sweepKeys(now); err != nil {
+			return nil, err
+		}
+		s.lastSweep = now
+	}
+
+	name := s.keyFilename(k.Key)
+	b, err := ioutil.ReadFile(name)
+	switch {
+	case err == nil:
+		var cur birdbroker.IdempotencyKey
+		if err := json.Unmarshal(b, &cur); err != nil {
+			return nil, fmt.Errorf("encoding/json: Unmarshal: %s", err)
+		}
+		if !cur.Expired(now) {
+			return &cur, nil
+		}
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("io/ioutil: ReadFile: %s", err)
+	}
+	return nil, s.write(name, k)
+}
+
+// sweepKeys deletes the idempotency keys that expired at now. It must be
+// called with s locked.
+func (s *dir) sweepKeys(now time.Time) error {
+	fis, err := ioutil.ReadDir(filepath.Join(s.path, keysDir))
+	if err != nil {
+		return fmt.Errorf("io/ioutil: ReadDir: %s", err)
+	}
+	for _, fi := range fis {
+		name := filepath.Join(s.path, keysDir, fi.Name())
+		b, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("io/ioutil: ReadFile: %s", err)
+		}
+		var k birdbroker.IdempotencyKey
+		if err := json.Unmarshal(b, &k); err != nil {
+			return fmt.Errorf("encoding/json: Unmarshal: %s", err)
+		}
+		if !k.Expired(now) {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("os: Remove: %s", err)
+		}
+	}
+	return nil
+}
+
+// DeleteKey deletes the idempotency key named key, if it exists.
+func (s *dir) DeleteKey(ctx context.Context, key string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(s.keyFilename(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os: Remove: %s", err)
+	}
+	return nil
+}
+
+// PutBuryRecord stores br, replacing the bury record of the same job if it
+// exists.
+func (s *dir) PutBuryRecord(ctx context.Context, br *birdbroker.BuryRecord) error {
+	return s.write(s.buryFilename(br.Tube, br.JobID), br)
+}
+
+// GetBuryRecord returns the bury record of the job identified by jobID in
+// tube.
+func (s *dir) GetBuryRecord(ctx context.Context, tube string, jobID uint64) (*birdbroker.BuryRecord, error) {
+	b, err := ioutil.ReadFile(s.buryFilename(tube, jobID))
+	if os.IsNotExist(err) {
+		return nil, birdbroker.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("io/ioutil: ReadFile: %s", err)
+	}
+
+	var br birdbroker.BuryRecord
+	if err := json.Unmarshal(b, &br); err != nil {
+		return nil, fmt.Errorf("encoding/json: Unmarshal: %s", err)
+	}
+	return &br, nil
+}
+
+// ListBuryRecords returns the bury records of the jobs in tube, most recently
+// buried first.
+func (s *dir) ListBuryRecords(ctx context.Context, tube string) ([]*birdbroker.BuryRecord, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(s.path, buriedDir))
+	if err != nil {
+		return nil, fmt.Errorf("io/ioutil: ReadDir: %s", err)
+	}
+	prefix := url.PathEscape(tube) + "@"
+	var brs []*birdbroker.BuryRecord
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.path, buriedDir, fi.Name()))
+		if os.IsNotExist(err) {
+			// Deleted since the directory was read.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("io/ioutil: ReadFile: %s", err)
+		}
+		var br birdbroker.BuryRecord
+		if err := json.Unmarshal(b, &br); err != nil {
+			return nil, fmt.Errorf("encoding/json: Unmarshal: %s", err)
+		}
+		brs = append(brs, &br)
+	}
+	sortBuryRecords(brs)
+	return brs, nil
+}
+
+// DeleteBuryRecord deletes the bury record of the job identified by jobID in
+// tube, if it exists.
+func (s *dir) DeleteBuryRecord(ctx context.Context, tube string, jobID uint64) error {
+	if err := os.Remove(s.buryFilename(tube, jobID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os: Remove: %s", err)
+	}
+	return nil
+}
+
+// buryFilename returns the file holding the bury record of the job identified
+// by jobID in tube. Tube names may contain slashes, so they are escaped, and
+// can't contain "@", which separates them from the ID.
+func (s *dir) buryFilename(tube string, jobID uint64) string {
+	name := url.PathEscape(tube) + "@" + strconv.FormatUint(jobID, 10) + ".json"
+	return filepath.Join(s.path, buriedDir, name)
+}
+
+// keyFilename returns the file holding the idempotency key named key. Keys
+// are chosen by callers, so their hash is used as file name.
+func (s *dir) keyFilename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.path, keysDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// filename returns the file holding the record identified by id. IDs are
+// restricted to a safe set of characters, as they end up in a file path.
+func (s *dir) filename(id string) (string, error) {
+	if !isSafeID(id) {
+		return "", fmt.Errorf("invalid record ID %q", id)
+	}
+	return filepath.Join(s.path, id+".json"), nil
+}
+
+func (s *dir) read(name string) (*birdbroker.Record, error) {
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, birdbroker.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("io/ioutil: ReadFile: %s", err)
+	}
+
+	var r birdbroker.Record
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("encoding/json: Unmarshal: %s", err)
+	}
+	return &r, nil
+}
+
+// write writes v to a temporary file first and then renames it, so readers in
+// other processes never observe a partially written file.
+func (s *dir) write(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding/json: Marshal: %s", err)
+	}
+
+	f, err := ioutil.TempFile(s.path, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("io/ioutil: TempFile: %s", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("%T: Write: %s", f, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("%T: Close: %s", f, err)
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("os: Rename: %s", err)
+	}
+	return nil
+}
+
+func isSafeID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
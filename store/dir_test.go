@@ -0,0 +1,169 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epels/birdbroker-go"
+)
+
+func TestDir(t *testing.T) {
+	path, err := ioutil.TempDir("", "birdbroker-store")
+	if err != nil {
+		t.Fatalf("io/ioutil: TempDir: %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	s, err := NewDir(path)
+	if err != nil {
+		t.Fatalf("NewDir: %s", err)
+	}
+	testStore(t, s)
+
+	t.Run("Unsafe ID", func(t *testing.T) {
+		if _, err := s.Get(context.Background(), "../etc/passwd"); !errors.Is(err, birdbroker.ErrNotFound) {
+			t.Errorf("Got %v, expected ErrNotFound", err)
+		}
+		if err := s.Create(context.Background(), &birdbroker.Record{ID: "a/b"}); err == nil {
+			t.Errorf("Got nil, expected error")
+		}
+	})
+}
+
+func TestDir_SharedDirectory(t *testing.T) {
+	ctx := context.Background()
+	path, err := ioutil.TempDir("", "birdbroker-store")
+	if err != nil {
+		t.Fatalf("io/ioutil: TempDir: %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Every instance has its own lock file descriptor, like separate
+	// processes sharing the directory do.
+	var stores []*dir
+	for i := 0; i < 2; i++ {
+		s, err := NewDir(path)
+		if err != nil {
+			t.Fatalf("NewDir: %s", err)
+		}
+		defer s.Close()
+		stores = append(stores, s)
+	}
+	if err := stores[0].Create(ctx, &birdbroker.Record{ID: "shared"}); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+
+	const updates = 50
+	var wg sync.WaitGroup
+	for i, s := range stores {
+		wg.Add(1)
+		go func(i int, s *dir) {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				err := s.Update(ctx, "shared", func(r *birdbroker.Record) error {
+					r.Recipients = append(r.Recipients, birdbroker.RecipientStatus{
+						Recipient: strconv.Itoa(i) + "-" + strconv.Itoa(j),
+					})
+					return nil
+				})
+				if err != nil {
+					t.Errorf("Update: %s", err)
+					return
+				}
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	r, err := stores[1].Get(ctx, "shared")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if n := len(r.Recipients); n != len(stores)*updates {
+		t.Errorf("Got %d updates, expected %d", n, len(stores)*updates)
+	}
+}
+
+func TestDir_SweepKeys(t *testing.T) {
+	ctx := context.Background()
+	path, err := ioutil.TempDir("", "birdbroker-store")
+	if err != nil {
+		t.Fatalf("io/ioutil: TempDir: %s", err)
+	}
+	defer os.RemoveAll(path)
+	s, err := NewDir(path)
+	if err != nil {
+		t.Fatalf("NewDir: %s", err)
+	}
+	defer s.Close()
+
+	expired := birdbroker.IdempotencyKey{Key: "expired", ExpiresAt: time.Now().Add(-time.Second)}
+	valid := birdbroker.IdempotencyKey{Key: "valid", ExpiresAt: time.Now().Add(time.Hour)}
+	for _, k := range []*birdbroker.IdempotencyKey{&expired, &valid} {
+		if _, err := s.PutKey(ctx, k); err != nil {
+			t.Fatalf("PutKey: %s", err)
+		}
+	}
+
+	s.lastSweep = time.Time{}
+	if _, err := s.PutKey(ctx, &birdbroker.IdempotencyKey{Key: "other", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("PutKey: %s", err)
+	}
+	if _, err := os.Stat(s.keyFilename(expired.Key)); !os.IsNotExist(err) {
+		t.Errorf("Got %v, expected expired key to be deleted", err)
+	}
+	if _, err := os.Stat(s.keyFilename(valid.Key)); err != nil {
+		t.Errorf("Got %v, expected valid key to be kept", err)
+	}
+}
+
+func TestDir_PutKeyShared(t *testing.T) {
+	ctx := context.Background()
+	path, err := ioutil.TempDir("", "birdbroker-store")
+	if err != nil {
+		t.Fatalf("io/ioutil: TempDir: %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Replicas of the API put the same key at once: only one of them may
+	// store it.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var stored int
+	for i := 0; i < 10; i++ {
+		s, err := NewDir(path)
+		if err != nil {
+			t.Fatalf("NewDir: %s", err)
+		}
+		defer s.Close()
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cur, err := s.PutKey(ctx, &birdbroker.IdempotencyKey{
+				Key:       "shared",
+				MessageID: strconv.Itoa(i),
+				ExpiresAt: time.Now().Add(time.Hour),
+			})
+			if err != nil {
+				t.Errorf("PutKey: %s", err)
+				return
+			}
+			if cur == nil {
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if stored != 1 {
+		t.Errorf("Got %d stored keys, expected 1", stored)
+	}
+}
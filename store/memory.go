@@ -0,0 +1,172 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/epels/birdbroker-go"
+)
+
+// sweepInterval is how often expired idempotency keys are dropped.
+const sweepInterval = time.Minute
+
+type memory struct {
+	mu        sync.Mutex // Guards records, keys, buried and lastSweep.
+	records   map[string]birdbroker.Record
+	keys      map[string]birdbroker.IdempotencyKey
+	buried    map[buryKey]birdbroker.BuryRecord
+	lastSweep time.Time
+}
+
+// buryKey identifies a bury record. Job IDs are only unique within a
+// beanstalkd, so the tube is part of the key.
+type buryKey struct {
+	tube  string
+	jobID uint64
+}
+
+// NewMemory creates a store that keeps records in memory. Records are not
+// shared between processes, nor do they survive restarts.
+func NewMemory() *memory {
+	return &memory{
+		records: make(map[string]birdbroker.Record),
+		keys:    make(map[string]birdbroker.IdempotencyKey),
+		buried:  make(map[buryKey]birdbroker.BuryRecord),
+	}
+}
+
+func (s *memory) Create(ctx context.Context, r *birdbroker.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[r.ID]; ok {
+		return fmt.Errorf("record %q already exists", r.ID)
+	}
+	s.records[r.ID] = *r
+	return nil
+}
+
+func (s *memory) Get(ctx context.Context, id string) (*birdbroker.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[id]
+	if !ok {
+		return nil, birdbroker.ErrNotFound
+	}
+	return &r, nil
+}
+
+// Update calls fn with the record identified by id, and stores the result if
+// fn returns nil.
+func (s *memory) Update(ctx context.Context, id string, fn func(r *birdbroker.Record) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[id]
+	if !ok {
+		return birdbroker.ErrNotFound
+	}
+	if err := fn(&r); err != nil {
+		return err
+	}
+	r.UpdatedAt = time.Now()
+	s.records[id] = r
+	return nil
+}
+
+// PutKey stores k, unless a key with the same name that did not expire yet
+// exists. In that case, the existing key is returned instead.
+func (s *memory) PutKey(ctx context.Context, k *birdbroker.IdempotencyKey) (*birdbroker.IdempotencyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > sweepInterval {
+		for name, cur := range s.keys {
+			if cur.Expired(now) {
+				delete(s.keys, name)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if cur, ok := s.keys[k.Key]; ok && !cur.Expired(now) {
+		return &cur, nil
+	}
+	s.keys[k.Key] = *k
+	return nil, nil
+}
+
+// DeleteKey deletes the idempotency key named key, if it exists.
+func (s *memory) DeleteKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, key)
+	return nil
+}
+
+// PutBuryRecord stores br, replacing the bury record of the same job if it
+// exists.
+func (s *memory) PutBuryRecord(ctx context.Context, br *birdbroker.BuryRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buried[buryKey{br.Tube, br.JobID}] = *br
+	return nil
+}
+
+// GetBuryRecord returns the bury record of the job identified by jobID in
+// tube.
+func (s *memory) GetBuryRecord(ctx context.Context, tube string, jobID uint64) (*birdbroker.BuryRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	br, ok := s.buried[buryKey{tube, jobID}]
+	if !ok {
+		return nil, birdbroker.ErrNotFound
+	}
+	return &br, nil
+}
+
+// DeleteBuryRecord deletes the bury record of the job identified by jobID in
+// tube, if it exists.
+func (s *memory) DeleteBuryRecord(ctx context.Context, tube string, jobID uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.buried, buryKey{tube, jobID})
+	return nil
+}
+
+// ListBuryRecords returns the bury records of the jobs in tube, most recently
+// buried first.
+func (s *memory) ListBuryRecords(ctx context.Context, tube string) ([]*birdbroker.BuryRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var brs []*birdbroker.BuryRecord
+	for k, br := range s.buried {
+		if k.tube == tube {
+			br := br
+			brs = append(brs, &br)
+		}
+	}
+	sortBuryRecords(brs)
+	return brs, nil
+}
+
+// sortBuryRecords sorts brs by the time they were buried, most recent first,
+// and then by job ID.
+func sortBuryRecords(brs []*birdbroker.BuryRecord) {
+	sort.Slice(brs, func(i, j int) bool {
+		if !brs[i].BuriedAt.Equal(brs[j].BuriedAt) {
+			return brs[i].BuriedAt.After(brs[j].BuriedAt)
+		}
+		return brs[i].JobID > brs[j].JobID
+	})
+}
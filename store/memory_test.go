@@ -0,0 +1,208 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/epels/birdbroker-go"
+)
+
+type recordStore interface {
+	Create(ctx context.Context, r *birdbroker.Record) error
+	Get(ctx context.Context, id string) (*birdbroker.Record, error)
+	Update(ctx context.Context, id string, fn func(r *birdbroker.Record) error) error
+	PutKey(ctx context.Context, k *birdbroker.IdempotencyKey) (*birdbroker.IdempotencyKey, error)
+	DeleteKey(ctx context.Context, key string) error
+	PutBuryRecord(ctx context.Context, br *birdbroker.BuryRecord) error
+	GetBuryRecord(ctx context.Context, tube string, jobID uint64) (*birdbroker.BuryRecord, error)
+	ListBuryRecords(ctx context.Context, tube string) ([]*birdbroker.BuryRecord, error)
+	DeleteBuryRecord(ctx context.Context, tube string, jobID uint64) error
+}
+
+// testStore runs the tests every store implementation must pass.
+func testStore(t *testing.T, s recordStore) {
+	ctx := context.Background()
+
+	t.Run("Not found", func(t *testing.T) {
+		if _, err := s.Get(ctx, "missing"); !errors.Is(err, birdbroker.ErrNotFound) {
+			t.Errorf("Got %v, expected ErrNotFound", err)
+		}
+		err := s.Update(ctx, "missing", func(r *birdbroker.Record) error {
+			t.Fatalf("Must never be called")
+			return nil
+		})
+		if !errors.Is(err, birdbroker.ErrNotFound) {
+			t.Errorf("Got %v, expected ErrNotFound", err)
+		}
+	})
+
+	t.Run("Create and get", func(t *testing.T) {
+		err := s.Create(ctx, &birdbroker.Record{
+			ID:     "create",
+			Status: birdbroker.StatusAccepted,
+		})
+		if err != nil {
+			t.Fatalf("Create: %s", err)
+		}
+
+		r, err := s.Get(ctx, "create")
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+		if r.Status != birdbroker.StatusAccepted {
+			t.Errorf("Got %q, expected accepted", r.Status)
+		}
+
+		if err := s.Create(ctx, &birdbroker.Record{ID: "create"}); err == nil {
+			t.Errorf("Got nil, expected error")
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		if err := s.Create(ctx, &birdbroker.Record{ID: "update"}); err != nil {
+			t.Fatalf("Create: %s", err)
+		}
+		err := s.Update(ctx, "update", func(r *birdbroker.Record) error {
+			r.Status = birdbroker.StatusSent
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Update: %s", err)
+		}
+		err = s.Update(ctx, "update", func(r *birdbroker.Record) error {
+			r.Status = birdbroker.StatusFailed
+			return errors.New("abort")
+		})
+		if err == nil {
+			t.Errorf("Got nil, expected error")
+		}
+
+		r, err := s.Get(ctx, "update")
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+		if r.Status != birdbroker.StatusSent {
+			t.Errorf("Got %q, expected sent", r.Status)
+		}
+		if r.UpdatedAt.IsZero() {
+			t.Errorf("Got zero time, expected UpdatedAt to be set")
+		}
+	})
+
+	t.Run("Idempotency keys", func(t *testing.T) {
+		k := birdbroker.IdempotencyKey{
+			Key:       "some key/with ../ characters",
+			MessageID: "first",
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		cur, err := s.PutKey(ctx, &k)
+		if err != nil {
+			t.Fatalf("PutKey: %s", err)
+		}
+		if cur != nil {
+			t.Errorf("Got %+v, expected nil", cur)
+		}
+
+		cur, err = s.PutKey(ctx, &birdbroker.IdempotencyKey{Key: k.Key, MessageID: "second"})
+		if err != nil {
+			t.Fatalf("PutKey: %s", err)
+		}
+		if cur == nil || cur.MessageID != "first" {
+			t.Errorf("Got %+v, expected key of first", cur)
+		}
+
+		if err := s.DeleteKey(ctx, k.Key); err != nil {
+			t.Fatalf("DeleteKey: %s", err)
+		}
+		if cur, err = s.PutKey(ctx, &k); err != nil || cur != nil {
+			t.Errorf("Got %+v (%v), expected nil", cur, err)
+		}
+	})
+
+	t.Run("Idempotency keys: expired", func(t *testing.T) {
+		k := birdbroker.IdempotencyKey{
+			Key:       "expired",
+			MessageID: "first",
+			ExpiresAt: time.Now().Add(-time.Second),
+		}
+		if _, err := s.PutKey(ctx, &k); err != nil {
+			t.Fatalf("PutKey: %s", err)
+		}
+		k.MessageID = "second"
+		if cur, err := s.PutKey(ctx, &k); err != nil || cur != nil {
+			t.Errorf("Got %+v (%v), expected nil", cur, err)
+		}
+	})
+
+	t.Run("Bury records", func(t *testing.T) {
+		if _, err := s.GetBuryRecord(ctx, "default", 42); !errors.Is(err, birdbroker.ErrNotFound) {
+			t.Errorf("Got %v, expected ErrNotFound", err)
+		}
+
+		br := birdbroker.BuryRecord{
+			JobID:    42,
+			Tube:     "default",
+			Reason:   birdbroker.BuryMaxAttempts,
+			Error:    "some error",
+			BuriedAt: time.Now().UTC().Truncate(time.Second),
+		}
+		if err := s.PutBuryRecord(ctx, &br); err != nil {
+			t.Fatalf("PutBuryRecord: %s", err)
+		}
+		got, err := s.GetBuryRecord(ctx, "default", 42)
+		if err != nil {
+			t.Fatalf("GetBuryRecord: %s", err)
+		}
+		if *got != br {
+			t.Errorf("Got %+v, expected %+v", got, br)
+		}
+
+		// Job IDs are only unique within a tube.
+		other := br
+		other.Tube, other.Reason = "callbacks/1", birdbroker.BuryDecodeError
+		if err := s.PutBuryRecord(ctx, &other); err != nil {
+			t.Fatalf("PutBuryRecord: %s", err)
+		}
+		if got, err := s.GetBuryRecord(ctx, "default", 42); err != nil || got.Reason != br.Reason {
+			t.Errorf("Got %+v (%v), expected reason %q", got, err, br.Reason)
+		}
+		if got, err := s.GetBuryRecord(ctx, "callbacks/1", 42); err != nil || got.Reason != other.Reason {
+			t.Errorf("Got %+v (%v), expected reason %q", got, err, other.Reason)
+		}
+
+		newer := br
+		newer.JobID, newer.BuriedAt = 43, br.BuriedAt.Add(time.Second)
+		if err := s.PutBuryRecord(ctx, &newer); err != nil {
+			t.Fatalf("PutBuryRecord: %s", err)
+		}
+		brs, err := s.ListBuryRecords(ctx, "default")
+		if err != nil {
+			t.Fatalf("ListBuryRecords: %s", err)
+		}
+		if len(brs) != 2 || brs[0].JobID != 43 || brs[1].JobID != 42 {
+			t.Errorf("Got %+v, expected the records of jobs 43 and 42", brs)
+		}
+		if brs, err := s.ListBuryRecords(ctx, "callbacks/1"); err != nil || len(brs) != 1 {
+			t.Errorf("Got %+v (%v), expected the record in the other tube", brs, err)
+		}
+
+		if err := s.DeleteBuryRecord(ctx, "default", 42); err != nil {
+			t.Fatalf("DeleteBuryRecord: %s", err)
+		}
+		if _, err := s.GetBuryRecord(ctx, "default", 42); !errors.Is(err, birdbroker.ErrNotFound) {
+			t.Errorf("Got %v, expected ErrNotFound", err)
+		}
+		if _, err := s.GetBuryRecord(ctx, "callbacks/1", 42); err != nil {
+			t.Errorf("Got %v, expected the record in the other tube to be left alone", err)
+		}
+		if err := s.DeleteBuryRecord(ctx, "default", 42); err != nil {
+			t.Errorf("Got %v, expected deleting a missing record to succeed", err)
+		}
+	})
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
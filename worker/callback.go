@@ -0,0 +1,38 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/callback"
+	"github.com/epels/birdbroker-go/queue"
+)
+
+// callbackHandler delivers the callbacks it is handed by a consumer.
+type callbackHandler struct {
+	d deliverer
+}
+
+// NewCallbackHandler creates a handler that delivers callbacks through d.
+func NewCallbackHandler(d deliverer) *callbackHandler {
+	return &callbackHandler{d: d}
+}
+
+type deliverer interface {
+	Deliver(ctx context.Context, cb *birdbroker.Callback) error
+}
+
+func (c *callbackHandler) ServeCallback(ctx context.Context, cb *birdbroker.Callback) error {
+	if err := c.d.Deliver(ctx, cb); err != nil {
+		// Don't retry callbacks the receiver will keep rejecting, nor those
+		// to addresses callbacks are never delivered to.
+		var se *callback.StatusError
+		if (errors.As(err, &se) && !se.Temporary()) || errors.Is(err, callback.ErrForbiddenAddress) {
+			return queue.Permanent(fmt.Errorf("%T: Deliver: %w", c.d, err))
+		}
+		return fmt.Errorf("%T: Deliver: %s", c.d, err)
+	}
+	return nil
+}
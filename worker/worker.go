@@ -0,0 +1,245 @@
+// Package worker handles the jobs consumed from the queue: it sends messages
+// through MessageBird, and delivers callbacks.
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/messagebird"
+	"github.com/epels/birdbroker-go/queue"
+)
+
+// handler sends the messages it is handed by a consumer through MessageBird,
+// and keeps their records up to date.
+type handler struct {
+	snd sender
+	st  recordStore
+}
+
+// NewHandler creates a handler that sends messages through snd, and updates
+// their records in st.
+func NewHandler(snd sender, st recordStore) *handler {
+	return &handler{snd: snd, st: st}
+}
+
+type sender interface {
+	SendMessage(ctx context.Context, m *birdbroker.Message) ([]*messagebird.Message, error)
+}
+
+type recordStore interface {
+	Get(ctx context.Context, id string) (*birdbroker.Record, error)
+	Update(ctx context.Context, id string, fn func(r *birdbroker.Record) error) error
+}
+
+// errCancelled is returned by the update claiming a message that was
+// cancelled.
+var errCancelled = errors.New("message was cancelled")
+
+// errClaimed is returned by the update claiming a message that is being sent,
+// or was sent already, by an earlier delivery of its job.
+var errClaimed = errors.New("message was claimed already")
+
+func (c *handler) ServeJob(ctx context.Context, m *birdbroker.Message) error {
+	err := c.claim(ctx, m)
+	if errors.Is(err, errCancelled) {
+		// The job could not be deleted when the message was cancelled,
+		// because it was reserved (or about to be) at the time.
+		log.Printf("Skipping cancelled message %q", m.ID)
+		return nil
+	}
+	if errors.Is(err, errClaimed) {
+		// The job was reserved again, for instance because its time to
+		// run passed while another worker was still sending it.
+		log.Printf("Skipping message %q: %s", m.ID, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only send to the recipients that did not get the message yet: when a
+	// previous attempt failed halfway, the others must not get it twice.
+	pm := *m
+	pm.Recipient = ""
+	pm.Recipients = c.pendingRecipients(ctx, m)
+
+	mbms, err := c.snd.SendMessage(ctx, &pm)
+	if err != nil {
+		c.update(ctx, m, func(r *birdbroker.Record) {
+			applySent(r, mbms)
+			r.Status = birdbroker.StatusFailed
+			r.Error = err.Error()
+		})
+
+		// Don't retry requests MessageBird will keep rejecting, such as
+		// those with an invalid recipient.
+		var apiErr *messagebird.APIError
+		if errors.As(err, &apiErr) && !apiErr.Temporary() {
+			return queue.Permanent(fmt.Errorf("%T: SendMessage: %w", c.snd, err))
+		}
+		return fmt.Errorf("%T: SendMessage: %s", c.snd, err)
+	}
+
+	// Messages scheduled too far ahead to be delayed in the queue are
+	// scheduled by MessageBird, and remain scheduled until then.
+	status := birdbroker.StatusSent
+	if m.ScheduledAt != nil && m.ScheduledAt.After(time.Now()) {
+		status = birdbroker.StatusScheduled
+	}
+	c.update(ctx, m, func(r *birdbroker.Record) {
+		applySent(r, mbms)
+		// A delivery report may have settled the message already.
+		if r.Status == birdbroker.StatusSending {
+			r.Status = status
+			r.Error = ""
+		}
+	})
+	return nil
+}
+
+// claim moves the record of m to the sending status, unless it was cancelled,
+// in which case errCancelled is returned, or is being or was sent already, in
+// which case errClaimed is returned. The status is checked and changed in a
+// single update, so a message is never both cancelled and sent, nor sent
+// twice. Messages without a record are sent regardless.
+func (c *handler) claim(ctx context.Context, m *birdbroker.Message) error {
+	if m.ID == "" {
+		return nil
+	}
+	err := c.st.Update(ctx, m.ID, func(r *birdbroker.Record) error {
+		switch r.Status {
+		case birdbroker.StatusCancelled:
+			return errCancelled
+		case birdbroker.StatusSending, birdbroker.StatusSent, birdbroker.StatusDelivered:
+			return fmt.Errorf("%w (status %s)", errClaimed, r.Status)
+		case birdbroker.StatusScheduled:
+			// Messages are scheduled both while they wait in the queue,
+			// and once they were handed to MessageBird.
+			if r.MessageBirdID != "" {
+				return fmt.Errorf("%w (status %s)", errClaimed, r.Status)
+			}
+		}
+		r.Status = birdbroker.StatusSending
+		return nil
+	})
+	switch {
+	case errors.Is(err, errCancelled), errors.Is(err, errClaimed):
+		return err
+	case errors.Is(err, birdbroker.ErrNotFound):
+		log.Printf("%T: Update: %s", c.st, err)
+		return nil
+	case err != nil:
+		// Without the sending status, the message could still be
+		// cancelled: retry later rather than risk sending it anyway.
+		return fmt.Errorf("%T: Update: %s", c.st, err)
+	}
+	return nil
+}
+
+// pendingRecipients returns the recipients of m that the message was not
+// handed to MessageBird for yet. If the record of m can't be found, all
+// recipients are returned.
+func (c *handler) pendingRecipients(ctx context.Context, m *birdbroker.Message) []string {
+	if m.ID == "" {
+		return m.AllRecipients()
+	}
+	r, err := c.st.Get(ctx, m.ID)
+	if err != nil {
+		log.Printf("%T: Get: %s", c.st, err)
+		return m.AllRecipients()
+	}
+	if len(r.Recipients) == 0 {
+		return m.AllRecipients()
+	}
+
+	var rs []string
+	for _, rcpt := range r.Recipients {
+		if rcpt.MessageBirdID == "" {
+			rs = append(rs, rcpt.Recipient)
+		}
+	}
+	return rs
+}
+
+// applySent records the recipients MessageBird reported for the messages
+// mbms in r.
+func applySent(r *birdbroker.Record, mbms []*messagebird.Message) {
+	for _, mbm := range mbms {
+		if r.MessageBirdID == "" {
+			r.MessageBirdID = mbm.ID
+		}
+		for _, item := range mbm.Recipients.Items {
+			rs := birdbroker.RecipientStatus{
+				Recipient:     strconv.FormatInt(item.Recipient, 10),
+				Status:        item.Status,
+				MessageBirdID: mbm.ID,
+				UpdatedAt:     time.Now(),
+			}
+			if item.StatusDatetime != nil {
+				rs.UpdatedAt = *item.StatusDatetime
+			}
+			setRecipientStatus(r, rs)
+		}
+	}
+}
+
+// setRecipientStatus replaces the status of the recipient of rs in r, or adds
+// it if r does not know the recipient yet. Like delivery reports, statuses
+// older than the one r holds are ignored: a report may be stored before the
+// status MessageBird returned when the message was sent.
+func setRecipientStatus(r *birdbroker.Record, rs birdbroker.RecipientStatus) {
+	for i, cur := range r.Recipients {
+		if birdbroker.NormalizeRecipient(cur.Recipient) != rs.Recipient {
+			continue
+		}
+		if rs.UpdatedAt.Before(cur.UpdatedAt) {
+			if cur.MessageBirdID == "" {
+				r.Recipients[i].MessageBirdID = rs.MessageBirdID
+			}
+			return
+		}
+		rs.Recipient = cur.Recipient
+		r.Recipients[i] = rs
+		return
+	}
+	r.Recipients = append(r.Recipients, rs)
+}
+
+// JobBuried marks the record of m as buried, after the consumer gave up on it
+// for the reason in br.
+func (c *handler) JobBuried(ctx context.Context, m *birdbroker.Message, br *birdbroker.BuryRecord) {
+	c.update(ctx, m, func(r *birdbroker.Record) {
+		r.Status = birdbroker.StatusBuried
+		r.Error = br.Error
+		r.Bury = br
+	})
+}
+
+// JobRetried records that m is held by the job identified by jobID, after the
+// consumer put it back to be retried, so it can still be cancelled.
+func (c *handler) JobRetried(ctx context.Context, m *birdbroker.Message, jobID uint64) {
+	c.update(ctx, m, func(r *birdbroker.Record) {
+		r.JobID = jobID
+	})
+}
+
+// update applies fn to the record of m. Messages queued before records were
+// introduced have no ID, and are skipped.
+func (c *handler) update(ctx context.Context, m *birdbroker.Message, fn func(r *birdbroker.Record)) {
+	if m.ID == "" {
+		return
+	}
+	err := c.st.Update(ctx, m.ID, func(r *birdbroker.Record) error {
+		fn(r)
+		return nil
+	})
+	if err != nil {
+		log.Printf("%T: Update: %s", c.st, err)
+	}
+}
@@ -0,0 +1,252 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/epels/birdbroker-go"
+	"github.com/epels/birdbroker-go/internal/mock"
+	"github.com/epels/birdbroker-go/messagebird"
+	"github.com/epels/birdbroker-go/queue"
+	"github.com/epels/birdbroker-go/store"
+)
+
+func TestServeJob(t *testing.T) {
+	ctx := context.Background()
+	m := &birdbroker.Message{
+		ID:         "abc",
+		Body:       "Hello",
+		Originator: "Foo Inc",
+		Recipients: []string{"31612345678", "31687654321"},
+	}
+
+	t.Run("Sent", func(t *testing.T) {
+		st := store.NewMemory()
+		st.Create(ctx, &birdbroker.Record{ID: "abc", Status: birdbroker.StatusQueued})
+		h := NewHandler(&mock.MessageBird{
+			SendMessageFunc: func(m *birdbroker.Message) ([]*messagebird.Message, error) {
+				return []*messagebird.Message{{
+					ID: "mb-1",
+					Recipients: messagebird.Recipients{Items: []messagebird.Recipient{
+						{Recipient: 31612345678, Status: "sent"},
+						{Recipient: 31687654321, Status: "sent"},
+					}},
+				}}, nil
+			},
+		}, st)
+
+		if err := h.ServeJob(ctx, m); err != nil {
+			t.Fatalf("Got %s, expected nil", err)
+		}
+		r, _ := st.Get(ctx, "abc")
+		if r.Status != birdbroker.StatusSent || r.MessageBirdID != "mb-1" || len(r.Recipients) != 2 {
+			t.Errorf("Got %+v, expected a sent record with 2 recipients", r)
+		}
+	})
+
+	t.Run("Delivery report stored first", func(t *testing.T) {
+		st := store.NewMemory()
+		st.Create(ctx, &birdbroker.Record{ID: "abc", Status: birdbroker.StatusQueued, Recipients: []birdbroker.RecipientStatus{
+			{Recipient: "31612345678", Status: birdbroker.RecipientPending},
+		}})
+		sentAt := time.Now().Add(-time.Minute)
+		h := NewHandler(&mock.MessageBird{
+			SendMessageFunc: func(m *birdbroker.Message) ([]*messagebird.Message, error) {
+				// The report is handled while the response is on its way.
+				st.Update(ctx, "abc", func(r *birdbroker.Record) error {
+					r.Status = birdbroker.StatusDelivered
+					r.Recipients[0] = birdbroker.RecipientStatus{
+						Recipient:     "31612345678",
+						Status:        messagebird.StatusDelivered,
+						MessageBirdID: "mb-1",
+						UpdatedAt:     time.Now(),
+					}
+					return nil
+				})
+				return []*messagebird.Message{{
+					ID: "mb-1",
+					Recipients: messagebird.Recipients{Items: []messagebird.Recipient{
+						{Recipient: 31612345678, Status: "sent", StatusDatetime: &sentAt},
+					}},
+				}}, nil
+			},
+		}, st)
+
+		if err := h.ServeJob(ctx, &birdbroker.Message{ID: "abc", Recipient: "31612345678"}); err != nil {
+			t.Fatalf("Got %s, expected nil", err)
+		}
+		r, _ := st.Get(ctx, "abc")
+		if r.Status != birdbroker.StatusDelivered || r.Recipients[0].Status != messagebird.StatusDelivered {
+			t.Errorf("Got %+v, expected a delivered record", r)
+		}
+	})
+
+	t.Run("Only sends to pending recipients", func(t *testing.T) {
+		st := store.NewMemory()
+		st.Create(ctx, &birdbroker.Record{ID: "abc", Recipients: []birdbroker.RecipientStatus{
+			{Recipient: "31612345678", MessageBirdID: "mb-1"},
+			{Recipient: "31687654321"},
+		}})
+		var got []string
+		h := NewHandler(&mock.MessageBird{
+			SendMessageFunc: func(m *birdbroker.Message) ([]*messagebird.Message, error) {
+				got = m.AllRecipients()
+				return nil, nil
+			},
+		}, st)
+
+		if err := h.ServeJob(ctx, m); err != nil {
+			t.Fatalf("Got %s, expected nil", err)
+		}
+		if len(got) != 1 || got[0] != "31687654321" {
+			t.Errorf("Got %v, expected [31687654321]", got)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		st := store.NewMemory()
+		st.Create(ctx, &birdbroker.Record{ID: "abc", Status: birdbroker.StatusCancelled})
+		h := NewHandler(&mock.MessageBird{
+			SendMessageFunc: func(m *birdbroker.Message) ([]*messagebird.Message, error) {
+				t.Fatalf("Must never be called")
+				return nil, nil
+			},
+		}, st)
+
+		if err := h.ServeJob(ctx, m); err != nil {
+			t.Errorf("Got %s, expected nil", err)
+		}
+		if r, _ := st.Get(ctx, "abc"); r.Status != birdbroker.StatusCancelled {
+			t.Errorf("Got %q, expected %q", r.Status, birdbroker.StatusCancelled)
+		}
+	})
+
+	t.Run("Claimed already", func(t *testing.T) {
+		for _, r := range []birdbroker.Record{
+			{ID: "abc", Status: birdbroker.StatusSending},
+			{ID: "abc", Status: birdbroker.StatusSent, MessageBirdID: "mb-1"},
+			{ID: "abc", Status: birdbroker.StatusScheduled, MessageBirdID: "mb-1"},
+			{ID: "abc", Status: birdbroker.StatusDelivered, MessageBirdID: "mb-1"},
+		} {
+			st := store.NewMemory()
+			st.Create(ctx, &r)
+			h := NewHandler(&mock.MessageBird{
+				SendMessageFunc: func(m *birdbroker.Message) ([]*messagebird.Message, error) {
+					t.Fatalf("Must never be called")
+					return nil, nil
+				},
+			}, st)
+
+			if err := h.ServeJob(ctx, m); err != nil {
+				t.Errorf("Got %s, expected nil", err)
+			}
+			if cur, _ := st.Get(ctx, "abc"); cur.Status != r.Status {
+				t.Errorf("Got %q, expected %q", cur.Status, r.Status)
+			}
+		}
+	})
+
+	t.Run("Scheduled in the queue", func(t *testing.T) {
+		st := store.NewMemory()
+		st.Create(ctx, &birdbroker.Record{ID: "abc", Status: birdbroker.StatusScheduled})
+		var called bool
+		h := NewHandler(&mock.MessageBird{
+			SendMessageFunc: func(m *birdbroker.Message) ([]*messagebird.Message, error) {
+				called = true
+				return []*messagebird.Message{{ID: "mb-1"}}, nil
+			},
+		}, st)
+
+		if err := h.ServeJob(ctx, m); err != nil {
+			t.Fatalf("Got %s, expected nil", err)
+		}
+		if !called {
+			t.Error("Expected the message to be sent")
+		}
+		if r, _ := st.Get(ctx, "abc"); r.Status != birdbroker.StatusSent {
+			t.Errorf("Got %q, expected %q", r.Status, birdbroker.StatusSent)
+		}
+	})
+
+	t.Run("Record can't be claimed", func(t *testing.T) {
+		h := NewHandler(&mock.MessageBird{
+			SendMessageFunc: func(m *birdbroker.Message) ([]*messagebird.Message, error) {
+				t.Fatalf("Must never be called")
+				return nil, nil
+			},
+		}, &mock.Store{
+			UpdateFunc: func(id string, fn func(r *birdbroker.Record) error) error {
+				return errors.New("some error")
+			},
+		})
+
+		if err := h.ServeJob(ctx, m); err == nil {
+			t.Errorf("Got nil, expected error")
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		tt := []struct {
+			name      string
+			err       error
+			permanent bool
+		}{
+			{"Temporary", &messagebird.APIError{StatusCode: http.StatusServiceUnavailable}, false},
+			{"Permanent", &messagebird.APIError{StatusCode: http.StatusUnprocessableEntity}, true},
+			{"Other", errors.New("some error"), false},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				st := store.NewMemory()
+				st.Create(ctx, &birdbroker.Record{ID: "abc"})
+				h := NewHandler(&mock.MessageBird{
+					SendMessageFunc: func(m *birdbroker.Message) ([]*messagebird.Message, error) {
+						return nil, tc.err
+					},
+				}, st)
+
+				err := h.ServeJob(ctx, m)
+				if err == nil {
+					t.Fatalf("Got nil, expected error")
+				}
+				if p := queue.IsPermanent(err); p != tc.permanent {
+					t.Errorf("Got %t, expected %t", p, tc.permanent)
+				}
+				if r, _ := st.Get(ctx, "abc"); r.Status != birdbroker.StatusFailed || r.Error == "" {
+					t.Errorf("Got %+v, expected a failed record", r)
+				}
+			})
+		}
+	})
+}
+
+func TestJobBuried(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemory()
+	st.Create(ctx, &birdbroker.Record{ID: "abc", Status: birdbroker.StatusFailed})
+	h := NewHandler(nil, st)
+
+	br := &birdbroker.BuryRecord{JobID: 42, Reason: birdbroker.BuryMaxAttempts, Error: "gave up"}
+	h.JobBuried(ctx, &birdbroker.Message{ID: "abc"}, br)
+
+	r, _ := st.Get(ctx, "abc")
+	if r.Status != birdbroker.StatusBuried || r.Error != "gave up" || r.Bury == nil || r.Bury.JobID != 42 {
+		t.Errorf("Got %+v, expected a buried record", r)
+	}
+}
+
+func TestJobRetried(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemory()
+	st.Create(ctx, &birdbroker.Record{ID: "abc", Status: birdbroker.StatusFailed, JobID: 42})
+	h := NewHandler(nil, st)
+
+	h.JobRetried(ctx, &birdbroker.Message{ID: "abc"}, 43)
+
+	if r, _ := st.Get(ctx, "abc"); r.JobID != 43 {
+		t.Errorf("Got %d, expected 43", r.JobID)
+	}
+}